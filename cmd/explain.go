@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/pkg/helmspray"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var explainValuesUsage = `
+This command explains where the values given to the release of a sub-chart come from. The values are
+computed as for a spray: default values of the sub-chart, values of the umbrella chart (including the
+'#!' directives), values of the current revision of the release with '--reuse-values', values files
+of the sub-charts ('valuesFiles' lists and '--values-dir'), values files, '--set', '--set-string' and
+'--set-file' flags, and '<chart name or alias>.enabled' toggles.
+
+For each leaf value of the sub-chart, or under the given path, the winning source is given (file and
+line, '#!' directive, flag...), followed by the overridden ones.
+The explanation is written to stdout, the spray messages being written to stderr.
+
+ $ helm spray explain-values ./umbrella-chart backend
+ $ helm spray explain-values ./umbrella-chart backend image.tag -f prod.yaml --set backend.replicas=3
+`
+
+func newExplainValuesCmd() *cobra.Command {
+
+	s := &helmspray.Spray{}
+
+	cmd := &cobra.Command{
+		Use:          "explain-values [CHART] [SUBCHART] [PATH]",
+		Short:        "explain where the values given to the release of a sub-chart come from",
+		Long:         explainValuesUsage,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			// Keep stdout for the explanation
+			log.SetOutput(os.Stderr)
+
+			if len(args) < 2 {
+				return errors.New("this command needs at least 2 arguments: chart name and sub-chart name or alias")
+			} else if len(args) > 3 {
+				return errors.New("this command accepts only 3 arguments: chart name, sub-chart name or alias, and path of the values")
+			}
+			if err := checkChartArgs(s, args[:1]); err != nil {
+				return err
+			}
+			valuePath := ""
+			if len(args) == 3 {
+				valuePath = args[2]
+			}
+
+			if err := s.FetchChart(); err != nil {
+				return err
+			}
+
+			return s.ExplainValues(os.Stdout, args[1], valuePath)
+		},
+	}
+
+	f := cmd.Flags()
+	addChartFlags(f, s)
+	f.BoolVar(&s.ResetValues, "reset-values", false, "explain the values as when upgrading with '--reset-values'")
+	f.BoolVar(&s.ReuseValues, "reuse-values", false, "explain the values as when upgrading with '--reuse-values': the values of the current revision of the release are reused")
+	f.StringVar(&s.Kube.Context, "kube-context", "", "name of the kubeconfig context to use")
+	f.StringVar(&s.Kube.Kubeconfig, "kubeconfig", "", "path to the kubeconfig file")
+
+	s.SetFromHelmEnv()
+
+	return cmd
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"github.com/gemalto/helm-spray/v4/pkg/helmspray"
+	"github.com/spf13/cobra"
+)
+
+var exportUsage = `
+This command exports the releases of an umbrella chart as GitOps objects, so that the same umbrella
+chart can be deployed either by a spray or by a GitOps tool:
+  - "argocd": an Argo CD Application per release, whose sync-wave is the weight of the release,
+  - "flux": a Flux HelmRelease per release, depending on the releases of the previous weight.
+
+Each object deploys the umbrella chart, taken from the given repository, with the values that a spray
+would give to the release ('#!' directives, values files, '--set' flags, '<chart name or alias>.enabled'
+toggles). The objects are written into the '<release name>.yaml' files of the output directory.
+
+ $ helm spray export ./umbrella-chart --format argocd --repo-url https://charts.example.com
+ $ helm spray export ./umbrella-chart --format flux --source-kind GitRepository --source-name solution --path charts/umbrella-chart
+`
+
+func newExportCmd() *cobra.Command {
+
+	s := &helmspray.Spray{}
+
+	cmd := &cobra.Command{
+		Use:          "export [CHART]",
+		Short:        "export the releases of an umbrella chart as Argo CD Applications or Flux HelmReleases",
+		Long:         exportUsage,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			if err := checkChartArgs(s, args); err != nil {
+				return err
+			}
+
+			if err := s.FetchChart(); err != nil {
+				return err
+			}
+
+			_, err := s.Export()
+			return err
+		},
+	}
+
+	f := cmd.Flags()
+	addChartFlags(f, s)
+	f.StringVar(&s.OutputDir, "output-dir", "gitops", "directory into which the objects of the releases are written")
+	f.StringVar(&s.GitOps.Format, "format", helmspray.ExportArgoCD, "format of the exported objects: \"argocd\" (Argo CD Applications) or \"flux\" (Flux HelmReleases)")
+	f.StringVar(&s.GitOps.RepoURL, "repo-url", "", "URL of the Helm or Git repository holding the umbrella chart (Argo CD)")
+	f.StringVar(&s.GitOps.Chart, "chart", "", "name of the umbrella chart in the Helm repository (default to the name of the chart)")
+	f.StringVar(&s.GitOps.Path, "path", "", "path of the umbrella chart in the Git repository, instead of a chart of a Helm repository")
+	f.StringVar(&s.GitOps.Revision, "revision", "", "version of the chart, or Git revision (default to the version of the chart)")
+	f.StringVar(&s.GitOps.Project, "project", "default", "Argo CD project of the applications")
+	f.StringVar(&s.GitOps.ArgoCDNamespace, "argocd-namespace", "argocd", "namespace of the Argo CD applications")
+	f.StringVar(&s.GitOps.DestinationServer, "destination-server", "https://kubernetes.default.svc", "Kubernetes API server into which the Argo CD applications are deployed")
+	f.StringVar(&s.GitOps.SourceKind, "source-kind", "HelmRepository", "kind of the Flux source holding the umbrella chart: \"HelmRepository\" or \"GitRepository\"")
+	f.StringVar(&s.GitOps.SourceName, "source-name", "", "name of the Flux source holding the umbrella chart")
+	f.StringVar(&s.GitOps.Interval, "interval", "10m", "reconciliation interval of the Flux helm releases")
+
+	s.SetFromHelmEnv()
+
+	return cmd
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/pkg/helmspray"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var graphUsage = `
+This command outputs the deployment order of the sub-charts of an umbrella chart: the sub-charts are
+grouped into layers by weight, each layer being deployed after the previous one.
+
+Each sub-chart is annotated with its alias, tags, targeted state, app version and corresponding release,
+plus the status of the release when the cluster is reachable.
+The graph is written to stdout, the spray messages being written to stderr.
+
+ $ helm spray graph ./umbrella-chart --format dot | dot -Tsvg > umbrella-chart.svg
+ $ helm spray graph ./umbrella-chart --format mermaid -f myvalues.yaml
+`
+
+func newGraphCmd() *cobra.Command {
+
+	s := &helmspray.Spray{}
+
+	cmd := &cobra.Command{
+		Use:          "graph [CHART]",
+		Short:        "output the deployment order of the sub-charts of an umbrella chart",
+		Long:         graphUsage,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			// Keep stdout for the graph
+			log.SetOutput(os.Stderr)
+
+			if err := checkChartArgs(s, args); err != nil {
+				return err
+			}
+
+			if err := s.FetchChart(); err != nil {
+				return err
+			}
+
+			return s.Graph(os.Stdout)
+		},
+	}
+
+	f := cmd.Flags()
+	addChartFlags(f, s)
+	f.StringVar(&s.GraphFormat, "format", helmspray.GraphASCII, "format of the graph: \"dot\" (Graphviz), \"mermaid\" or \"ascii\"")
+	f.StringVar(&s.Kube.Context, "kube-context", "", "name of the kubeconfig context to use")
+	f.StringVar(&s.Kube.Kubeconfig, "kubeconfig", "", "path to the kubeconfig file")
+
+	s.SetFromHelmEnv()
+
+	return cmd
+}
@@ -13,15 +13,18 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gemalto/helm-spray/v4/internal/log"
-	"github.com/gemalto/helm-spray/v4/pkg/helm"
 	"github.com/gemalto/helm-spray/v4/pkg/helmspray"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -73,113 +76,195 @@ var version = "SNAPSHOT"
 func NewRootCmd() *cobra.Command {
 
 	s := &helmspray.Spray{}
+	var clusterContexts []string
+	var clusterValues []string
+	var clustersFile string
+	var reportFile string
 
 	cmd := &cobra.Command{
 		Use:          "helm spray [CHART]",
 		Short:        fmt.Sprintf("upgrade subcharts from an umbrella chart (helm-spray %s)", version),
 		Long:         globalUsage,
 		SilenceUsage: true,
+		// The chart is given as argument, alongside the subcommands
+		Args: cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 
-			if len(args) == 0 {
-				return errors.New("this command needs at least 1 argument: chart name")
-			} else if len(args) > 1 {
-				return errors.New("this command accepts only 1 argument: chart name")
+			if err := checkChartArgs(s, args); err != nil {
+				return err
 			}
 
-			s.ChartName = args[0]
-
-			if s.ChartVersion != "" {
-				if strings.HasSuffix(s.ChartName, "tgz") {
-					return errors.New("cannot use --version together with chart archive")
+			if len(clusterContexts) > 0 && clustersFile != "" {
+				return errors.New("cannot use both --clusters and --clusters-file together")
+			}
+			if clustersFile != "" {
+				config, err := helmspray.LoadClustersConfig(clustersFile)
+				if err != nil {
+					return err
 				}
-
-				if _, err := os.Stat(s.ChartName); err == nil {
-					return errors.New("cannot use --version together with chart directory")
+				s.Clusters = config.Clusters
+				if config.Policy != "" && !cmd.Flags().Changed("clusters-policy") {
+					s.ClustersPolicy = config.Policy
 				}
-
-				if strings.HasPrefix(s.ChartName, "http://") || strings.HasPrefix(s.ChartName, "https://") {
-					return errors.New("cannot use --version together with chart HTTP(S) URL")
+				if config.HaltOnFailure != nil && !cmd.Flags().Changed("halt-on-cluster-failure") {
+					s.HaltOnClusterFailure = *config.HaltOnFailure
 				}
 			}
-
-			if s.PrefixReleasesWithNamespace == true && s.PrefixReleases != "" {
-				return errors.New("cannot use both --prefix-releases and --prefix-releases-with-namespace together")
+			for _, context := range clusterContexts {
+				s.Clusters = append(s.Clusters, helmspray.Cluster{Name: context, Context: context})
 			}
-
-			if len(s.Targets) > 0 && len(s.Excludes) > 0 {
-				return errors.New("cannot use both --target and --exclude together")
+			if len(s.Clusters) > 0 && cmd.Flags().Changed("kube-context") {
+				return errors.New("cannot use --kube-context together with --clusters or --clusters-file")
 			}
-
-			// If chart is specified through an URL, then fetch it from the URL.
-			if strings.HasPrefix(s.ChartName, "http://") || strings.HasPrefix(s.ChartName, "https://") || strings.HasPrefix(s.ChartName, "oci://") {
-				if s.ChartVersion != "" {
-					log.Info(1, "fetching chart from URL \"%s\" with version \"%s\"...", s.ChartName, s.ChartVersion)
-				} else {
-					log.Info(1, "fetching chart from URL \"%s\"...", s.ChartName)
+			if len(clusterValues) > 0 {
+				if len(s.Clusters) == 0 {
+					return errors.New("cannot use --cluster-values without --clusters or --clusters-file")
 				}
 				var err error
-				fetchedChartName, err := helm.Fetch(s.ChartName, s.ChartVersion)
+				s.Clusters, err = helmspray.ValuesForClusters(s.Clusters, clusterValues)
 				if err != nil {
-					return fmt.Errorf("fetching chart %s with version %s: %w", s.ChartName, s.ChartVersion, err)
+					return err
 				}
-				s.ChartName = fetchedChartName
-			} else if _, err := os.Stat(s.ChartName); err != nil {
-				// If local file (or directory) does not exist, then fetch it from a repo.
-				if s.ChartVersion != "" {
-					log.Info(1, "fetching chart \"%s\" from repos with version \"%s\"...", s.ChartName, s.ChartVersion)
-				} else {
-					log.Info(1, "fetching chart \"%s\" from repos...", s.ChartName)
+			}
+
+			// On SIGINT or SIGTERM, no more release is upgraded and the in-flight upgrade is given a grace period
+			ctx, stop := signalContext()
+			defer stop()
+
+			if len(s.Clusters) > 0 {
+				results, err := s.RunClusters(ctx)
+				if reportFile != "" && results != nil {
+					if writeErr := writeReportFile(reportFile, results); writeErr != nil {
+						log.Error("Error: %s", writeErr)
+					}
 				}
-				var err error
-				fetchedChartName, err := helm.Fetch(s.ChartName, s.ChartVersion)
-				if err != nil {
-					return fmt.Errorf("fetching chart %s with version %s: %w", s.ChartName, s.ChartVersion, err)
+				return err
+			}
+			report, err := s.Run(ctx)
+			if reportFile != "" && report != nil {
+				if writeErr := writeReportFile(reportFile, report); writeErr != nil {
+					log.Error("Error: %s", writeErr)
 				}
-				s.ChartName = fetchedChartName
-			} else {
-				log.Info(1, "processing chart from local file or directory \"%s\"...", s.ChartName)
 			}
-
-			return s.Spray()
+			return err
 		},
 	}
 
 	f := cmd.Flags()
+	addChartFlags(f, s)
+	f.BoolVar(&s.CreateNamespace, "create-namespace", false, "automatically create the namespace if necessary")
+	f.BoolVar(&s.ResetValues, "reset-values", false, "when upgrading, reset the values to the ones built into the chart")
+	f.BoolVar(&s.ReuseValues, "reuse-values", false, "when upgrading, reuse the last release's values and merge in any overrides from the command line via '--set' and '-f'.\nIf '--reset-values' is specified, this is ignored")
+	f.BoolVar(&s.SkipPreflight, "skip-preflight", false, "do not run the pre-flight checks (schema validation and local rendering of the releases) before the first upgrade")
+	f.StringSliceVar(&s.KnownKinds, "known-kinds", []string{}, "kinds of custom resources not defined by the CRDs of the chart, accepted by the pre-flight checks,\nas \"<apiVersion>/<kind>\" or \"<kind>\" (can specify multiple)")
+	f.BoolVar(&s.SkipSchemaValidation, "skip-schema-validation", false, "do not validate the values of the releases against the schemas of the umbrella chart and of the sub-charts before the first upgrade")
+	f.BoolVar(&s.Force, "force", false, "force resource update through delete/recreate if needed")
+	f.IntVar(&s.GracePeriod, "grace-period", 30, "time in seconds given to the in-flight upgrade to complete when the spray is interrupted by SIGINT or SIGTERM,\nbefore it is rolled back")
+	f.StringVar(&reportFile, "report-file", "", "write the report of the spray, with the status of each release, into the given JSON file (also when the spray fails or is interrupted)")
+	f.IntVar(&s.Timeout, "timeout", 300, "time in seconds to wait for any individual Kubernetes operation (like Jobs for hooks)\nand for liveness and readiness (like Deployments and regular Jobs completion)")
+	f.StringSliceVar(&s.WaitFor, "wait-for", []string{}, "specify additional kinds of resources to wait for before processing the next weight (can specify multiple):\n    \"service\" (LoadBalancer ingress assigned), \"ingress\" (address assigned), \"pvc\" (claim bound)")
+	f.BoolVar(&s.RunTests, "run-tests", false, "run the tests of the releases of each weight once they are ready, and stop the spray if a test fails.\nTests of a sub-chart can be disabled by setting its '<chart name or alias>.runTests' value to false")
+	f.StringVar(&s.HooksFile, "hooks-file", "", "specify a YAML file declaring spray hooks (under the 'hooks' element), in addition to the ones declared\nunder the 'spray.hooks' element of the values")
+	f.StringArrayVar(&s.NotifyWebhooks, "notify-webhook", []string{}, "post JSON events to the given URL at spray start, after each weight, on failure and on completion (can specify multiple)")
+	f.StringVar(&s.NotifyTemplate, "notify-template", "", "specify a Go template file used to generate the payload of the notifications from the events")
+	f.IntVar(&s.NotifyRetries, "notify-retries", 3, "number of retries when posting a notification fails")
+	f.IntVar(&s.NotifyTimeout, "notify-timeout", 10, "time in seconds to wait for each notification to be posted")
+	f.BoolVar(&s.DryRun, "dry-run", false, "simulate a spray")
+	f.StringVar(&s.Kube.Context, "kube-context", "", "name of the kubeconfig context to use")
+	f.StringVar(&s.Kube.Kubeconfig, "kubeconfig", "", "path to the kubeconfig file")
+	f.StringVar(&s.Kube.APIServer, "kube-apiserver", "", "the address and the port for the Kubernetes API server")
+	f.StringVar(&s.Kube.Token, "kube-token", "", "bearer token used for authentication")
+	f.StringVar(&s.Kube.AsUser, "kube-as-user", "", "username to impersonate for the operation")
+	f.StringSliceVar(&clusterContexts, "clusters", []string{}, "spray the chart into each of the clusters corresponding to the given kube contexts (can specify multiple)")
+	f.StringArrayVar(&clusterValues, "cluster-values", []string{}, "specify a values file for a given cluster, with format \"<context>=<values file>\" (can specify multiple)")
+	f.StringVar(&clustersFile, "clusters-file", "", "specify a YAML file describing the clusters to spray the chart into, with their values files and the clusters policy")
+	f.StringVar(&s.ClustersPolicy, "clusters-policy", helmspray.PolicySequential, "policy for spraying several clusters: \"sequential\" (one after the other) or \"rolling\"\n(canary clusters first, then the other clusters in parallel)")
+	f.BoolVar(&s.HaltOnClusterFailure, "halt-on-cluster-failure", true, "do not spray the remaining clusters when the spray of a cluster fails")
+
+	s.SetFromHelmEnv()
+
+	cmd.AddCommand(newTemplateCmd())
+	cmd.AddCommand(newExportCmd())
+	cmd.AddCommand(newGraphCmd())
+	cmd.AddCommand(newExplainValuesCmd())
+
+	return cmd
+}
+
+// Check the chart argument and the flags common to all the commands
+func checkChartArgs(s *helmspray.Spray, args []string) error {
+	if len(args) == 0 {
+		return errors.New("this command needs at least 1 argument: chart name")
+	} else if len(args) > 1 {
+		return errors.New("this command accepts only 1 argument: chart name")
+	}
+
+	s.ChartName = args[0]
+	return s.Validate()
+}
+
+// Add the flags common to all the commands, related to the chart, the releases and the values
+func addChartFlags(f *pflag.FlagSet, s *helmspray.Spray) {
 	f.StringVarP(&s.ChartVersion, "version", "", "", "specify the exact chart version to install. If this is not specified, the latest version is installed")
+	f.StringVar(&s.ChartFetch.CacheDir, "chart-cache-dir", "", "directory of the cache of the fetched charts (default to the 'spray/charts' directory of the helm cache)")
+	f.BoolVar(&s.ChartFetch.Offline, "offline", false, "do not access the chart repositories: fetched charts are taken from the chart cache only")
+	f.BoolVar(&s.ChartFetch.Verify, "verify", false, "verify the provenance of the fetched chart before using it")
+	f.StringVar(&s.ChartFetch.Keyring, "keyring", "", "keyring containing the public keys used to verify the provenance of the fetched chart (default to the GnuPG public keyring)")
+	f.StringVar(&s.ChartFetch.Digest, "chart-digest", "", "expected digest of the fetched chart archive, as \"sha256:<hex>\": the chart is refused if its digest does not match")
+	f.StringVar(&s.ChartFetch.Repository.URL, "repo", "", "chart repository URL where to locate the requested chart")
+	f.StringVar(&s.ChartFetch.Repository.Username, "username", "", "chart repository or registry username (default to the HELM_SPRAY_REPO_USERNAME environment variable)")
+	f.StringVar(&s.ChartFetch.Repository.Password, "password", "", "chart repository or registry password (default to the HELM_SPRAY_REPO_PASSWORD environment variable)")
+	f.StringVar(&s.ChartFetch.Repository.PasswordFile, "password-file", "", "file containing the chart repository or registry password")
+	f.StringVar(&s.ChartFetch.Repository.CAFile, "ca-file", "", "verify certificates of HTTPS-enabled servers using this CA bundle")
+	f.StringVar(&s.ChartFetch.Repository.CertFile, "cert-file", "", "identify HTTPS client using this SSL certificate file")
+	f.StringVar(&s.ChartFetch.Repository.KeyFile, "key-file", "", "identify HTTPS client using this SSL key file")
+	f.BoolVar(&s.ChartFetch.Repository.InsecureSkipTLSVerify, "insecure-skip-tls-verify", false, "skip TLS certificate checks for the chart download and the remote values files")
+	f.BoolVar(&s.ChartFetch.Repository.PassCredentialsAll, "pass-credentials", false, "pass the credentials to all domains, including the ones of the remote values files")
 	f.StringSliceVarP(&s.Targets, "target", "t", []string{}, "specify the subchart to target (can specify multiple). If '--target' is not specified, all subcharts are targeted")
 	f.StringSliceVarP(&s.Excludes, "exclude", "x", []string{}, "specify the subchart to exclude (can specify multiple): process all subcharts except the ones specified in '--exclude'")
 	f.StringVarP(&s.PrefixReleases, "prefix-releases", "", "", "prefix the releases by the given string, resulting into releases names formats:\n    \"<prefix>-<chart name or alias>\"\nAllowed characters are a-z A-Z 0-9 and -")
 	f.BoolVar(&s.PrefixReleasesWithNamespace, "prefix-releases-with-namespace", false, "prefix the releases by the name of the namespace, resulting into releases names formats:\n    \"<namespace>-<chart name or alias>\"")
-	f.BoolVar(&s.CreateNamespace, "create-namespace", false, "automatically create the namespace if necessary")
-	f.BoolVar(&s.ResetValues, "reset-values", false, "when upgrading, reset the values to the ones built into the chart")
-	f.BoolVar(&s.ReuseValues, "reuse-values", false, "when upgrading, reuse the last release's values and merge in any overrides from the command line via '--set' and '-f'.\nIf '--reset-values' is specified, this is ignored")
-	f.StringSliceVarP(&s.ValuesOpts.ValueFiles, "values", "f", []string{}, "specify values in a YAML file or a URL (can specify multiple)")
+	f.StringSliceVarP(&s.ValuesOpts.ValueFiles, "values", "f", []string{}, "specify values in a YAML file or a URL (can specify multiple).\nFiles encrypted with sops, or prefixed with 'secrets://', are decrypted before being used")
+	f.StringVar(&s.ValuesDir, "values-dir", "", "directory of the values files of the sub-charts, named '<chart name or alias>.yaml' (or '.yml'): their values are set under the key of their sub-chart")
 	f.StringArrayVar(&s.ValuesOpts.Values, "set", []string{}, "set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
 	f.StringArrayVar(&s.ValuesOpts.StringValues, "set-string", []string{}, "set STRING values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
 	f.StringArrayVar(&s.ValuesOpts.FileValues, "set-file", []string{}, "set values from respective files specified via the command line (can specify multiple or separate values with commas: key1=path1,key2=path2)")
-	f.BoolVar(&s.Force, "force", false, "force resource update through delete/recreate if needed")
-	f.IntVar(&s.Timeout, "timeout", 300, "time in seconds to wait for any individual Kubernetes operation (like Jobs for hooks)\nand for liveness and readiness (like Deployments and regular Jobs completion)")
-	f.BoolVar(&s.DryRun, "dry-run", false, "simulate a spray")
+	f.BoolVar(&s.Interpolate, "interpolate", false, "enable the '#! {{ env ... }}' and '#! {{ readFile ... }}' clauses in the values files given through '--values'/'-f' and '--values-dir'")
+	f.BoolVar(&s.StrictEnv, "strict-env", false, "fail when an environment variable referenced by an '#! {{ env ... }}' clause of a values file is not defined")
+	f.StringVar(&s.SecretsKeys.AgeIdentityFile, "age-identity", "", "age identity file used to decrypt the encrypted values files")
+	f.StringVar(&s.SecretsKeys.PGPKeyring, "pgp-keyring", "", "GnuPG home directory holding the PGP keyring used to decrypt the encrypted values files")
 	f.BoolVarP(&s.Verbose, "verbose", "v", false, "enable spray verbose output")
 	f.BoolVar(&s.Debug, "debug", false, "enable helm debug output (also include spray verbose output)")
+}
 
-	// When called through helm, debug mode is transmitted through the HELM_DEBUG envvar
-	helmDebug := os.Getenv("HELM_DEBUG")
-	if helmDebug == "1" || strings.EqualFold(helmDebug, "true") || strings.EqualFold(helmDebug, "on") {
-		s.Debug = true
-	}
-	if s.Debug {
-		s.Verbose = true
+// Context cancelled on SIGINT or SIGTERM
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			// A second signal terminates helm spray at once, without waiting for the in-flight upgrade
+			signal.Stop(signals)
+			log.Info(1, "received %s, interrupting the spray: no more release will be upgraded (send the signal again to terminate at once)", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
 	}
+}
 
-	// When called through helm, namespace is transmitted through the HELM_NAMESPACE envvar
-	namespace := os.Getenv("HELM_NAMESPACE")
-	if len(namespace) > 0 {
-		s.Namespace = namespace
-	} else {
-		s.Namespace = "default"
+func writeReportFile(file string, report interface{}) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("generating report file: %w", err)
 	}
-
-	return cmd
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return fmt.Errorf("writing report file: %w", err)
+	}
+	return nil
 }
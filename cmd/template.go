@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"github.com/gemalto/helm-spray/v4/pkg/helmspray"
+	"github.com/spf13/cobra"
+)
+
+var templateUsage = `
+This command renders locally the manifests of the releases that a spray of the umbrella chart would
+deploy, without accessing the cluster.
+
+The values are processed the same way as for a spray ('#!' directives, values files, '--set' flags,
+'<chart name or alias>.enabled' toggles). The manifests of each release are written into the
+'<release name>.yaml' file of the output directory, along with an 'index.yaml' file listing the
+releases with their weight, in their order of deployment.
+
+ $ helm spray template ./umbrella-chart --output-dir manifests
+ $ helm spray template ./umbrella-chart -f myvalues.yaml --kube-version 1.29.0 --api-versions monitoring.coreos.com/v1
+`
+
+func newTemplateCmd() *cobra.Command {
+
+	s := &helmspray.Spray{}
+
+	cmd := &cobra.Command{
+		Use:          "template [CHART]",
+		Short:        "render the releases of an umbrella chart locally",
+		Long:         templateUsage,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			if err := checkChartArgs(s, args); err != nil {
+				return err
+			}
+
+			if err := s.FetchChart(); err != nil {
+				return err
+			}
+
+			_, err := s.Template()
+			return err
+		},
+	}
+
+	f := cmd.Flags()
+	addChartFlags(f, s)
+	f.StringVar(&s.OutputDir, "output-dir", "manifests", "directory into which the manifests of the releases and the index file are written")
+	f.StringVar(&s.KubeVersion, "kube-version", "", "Kubernetes version used for Capabilities.KubeVersion")
+	f.StringSliceVarP(&s.APIVersions, "api-versions", "a", []string{}, "Kubernetes API versions used for Capabilities.APIVersions (can specify multiple)")
+
+	s.SetFromHelmEnv()
+
+	return cmd
+}
@@ -0,0 +1,75 @@
+package apis
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Removal of an API version for some kinds of objects, in a given Kubernetes release
+type Removal struct {
+	APIVersion string
+	Kinds      []string
+	// Kubernetes release in which the API version is no longer served, as "<major>.<minor>"
+	RemovedIn   string
+	Replacement string
+}
+
+// Removals are the known removals of API versions, per Kubernetes release
+// (see https://kubernetes.io/docs/reference/using-api/deprecation-guide/)
+var Removals = []Removal{
+	{APIVersion: "extensions/v1beta1", Kinds: []string{"DaemonSet", "Deployment", "ReplicaSet"}, RemovedIn: "1.16", Replacement: "apps/v1"},
+	{APIVersion: "extensions/v1beta1", Kinds: []string{"NetworkPolicy"}, RemovedIn: "1.16", Replacement: "networking.k8s.io/v1"},
+	{APIVersion: "extensions/v1beta1", Kinds: []string{"PodSecurityPolicy"}, RemovedIn: "1.16", Replacement: "policy/v1beta1"},
+	{APIVersion: "apps/v1beta1", Kinds: []string{"Deployment", "ReplicaSet", "StatefulSet"}, RemovedIn: "1.16", Replacement: "apps/v1"},
+	{APIVersion: "apps/v1beta2", Kinds: []string{"DaemonSet", "Deployment", "ReplicaSet", "StatefulSet"}, RemovedIn: "1.16", Replacement: "apps/v1"},
+	{APIVersion: "extensions/v1beta1", Kinds: []string{"Ingress"}, RemovedIn: "1.22", Replacement: "networking.k8s.io/v1"},
+	{APIVersion: "networking.k8s.io/v1beta1", Kinds: []string{"Ingress", "IngressClass"}, RemovedIn: "1.22", Replacement: "networking.k8s.io/v1"},
+	{APIVersion: "admissionregistration.k8s.io/v1beta1", Kinds: []string{"MutatingWebhookConfiguration", "ValidatingWebhookConfiguration"}, RemovedIn: "1.22", Replacement: "admissionregistration.k8s.io/v1"},
+	{APIVersion: "apiextensions.k8s.io/v1beta1", Kinds: []string{"CustomResourceDefinition"}, RemovedIn: "1.22", Replacement: "apiextensions.k8s.io/v1"},
+	{APIVersion: "apiregistration.k8s.io/v1beta1", Kinds: []string{"APIService"}, RemovedIn: "1.22", Replacement: "apiregistration.k8s.io/v1"},
+	{APIVersion: "certificates.k8s.io/v1beta1", Kinds: []string{"CertificateSigningRequest"}, RemovedIn: "1.22", Replacement: "certificates.k8s.io/v1"},
+	{APIVersion: "coordination.k8s.io/v1beta1", Kinds: []string{"Lease"}, RemovedIn: "1.22", Replacement: "coordination.k8s.io/v1"},
+	{APIVersion: "rbac.authorization.k8s.io/v1beta1", Kinds: []string{"ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding"}, RemovedIn: "1.22", Replacement: "rbac.authorization.k8s.io/v1"},
+	{APIVersion: "scheduling.k8s.io/v1beta1", Kinds: []string{"PriorityClass"}, RemovedIn: "1.22", Replacement: "scheduling.k8s.io/v1"},
+	{APIVersion: "storage.k8s.io/v1beta1", Kinds: []string{"CSIDriver", "CSINode", "StorageClass", "VolumeAttachment"}, RemovedIn: "1.22", Replacement: "storage.k8s.io/v1"},
+	{APIVersion: "batch/v1beta1", Kinds: []string{"CronJob"}, RemovedIn: "1.25", Replacement: "batch/v1"},
+	{APIVersion: "discovery.k8s.io/v1beta1", Kinds: []string{"EndpointSlice"}, RemovedIn: "1.25", Replacement: "discovery.k8s.io/v1"},
+	{APIVersion: "events.k8s.io/v1beta1", Kinds: []string{"Event"}, RemovedIn: "1.25", Replacement: "events.k8s.io/v1"},
+	{APIVersion: "autoscaling/v2beta1", Kinds: []string{"HorizontalPodAutoscaler"}, RemovedIn: "1.25", Replacement: "autoscaling/v2"},
+	{APIVersion: "policy/v1beta1", Kinds: []string{"PodDisruptionBudget"}, RemovedIn: "1.25", Replacement: "policy/v1"},
+	{APIVersion: "policy/v1beta1", Kinds: []string{"PodSecurityPolicy"}, RemovedIn: "1.25", Replacement: "Pod Security Admission"},
+	{APIVersion: "node.k8s.io/v1beta1", Kinds: []string{"RuntimeClass"}, RemovedIn: "1.25", Replacement: "node.k8s.io/v1"},
+	{APIVersion: "autoscaling/v2beta2", Kinds: []string{"HorizontalPodAutoscaler"}, RemovedIn: "1.26", Replacement: "autoscaling/v2"},
+	{APIVersion: "flowcontrol.apiserver.k8s.io/v1beta1", Kinds: []string{"FlowSchema", "PriorityLevelConfiguration"}, RemovedIn: "1.26", Replacement: "flowcontrol.apiserver.k8s.io/v1"},
+	{APIVersion: "storage.k8s.io/v1beta1", Kinds: []string{"CSIStorageCapacity"}, RemovedIn: "1.27", Replacement: "storage.k8s.io/v1"},
+	{APIVersion: "flowcontrol.apiserver.k8s.io/v1beta2", Kinds: []string{"FlowSchema", "PriorityLevelConfiguration"}, RemovedIn: "1.29", Replacement: "flowcontrol.apiserver.k8s.io/v1"},
+	{APIVersion: "flowcontrol.apiserver.k8s.io/v1beta3", Kinds: []string{"FlowSchema", "PriorityLevelConfiguration"}, RemovedIn: "1.32", Replacement: "flowcontrol.apiserver.k8s.io/v1"},
+}
+
+// RemovalOf returns the removal of the API version of the given kind of object, if any
+func RemovalOf(apiVersion string, kind string) (Removal, bool) {
+	for _, removal := range Removals {
+		if removal.APIVersion != apiVersion {
+			continue
+		}
+		for _, k := range removal.Kinds {
+			if k == kind {
+				return removal, true
+			}
+		}
+	}
+	return Removal{}, false
+}
+
+// MinorVersion returns the minor version of a "<major>.<minor>" Kubernetes release, ignoring any suffix of the minor
+// version such as "+" (e.g. "1.27+")
+func MinorVersion(version string) (int, bool) {
+	version = strings.TrimPrefix(version, "v")
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return 0, false
+	}
+	minor := strings.TrimRightFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	m, err := strconv.Atoi(minor)
+	return m, err == nil
+}
@@ -18,13 +18,15 @@ type Dependency struct {
 	Targeted                 bool
 	Weight                   int
 	CorrespondingReleaseName string
+	Tags                     []string
 	HasTags                  bool
 	AllowedByTags            bool
+	RunTests                 bool
 }
 
-func Get(chart *chart.Chart, values *chartutil.Values, targets []string, excludes []string, releasePrefix string, verbose bool) ([]Dependency, error) {
+func Get(chart *chart.Chart, values *chartutil.Values, targets []string, excludes []string, releasePrefix string, logger *log.Logger, verbose bool) ([]Dependency, error) {
 	// Compute tags
-	providedTags := tags(values, verbose)
+	providedTags := tags(values, logger, verbose)
 
 	// Build the list of all dependencies, and their key attributes
 	dependencies := make([]Dependency, len(chart.Metadata.Dependencies))
@@ -63,6 +65,7 @@ func Get(chart *chart.Chart, values *chartutil.Values, targets []string, exclude
 
 		// Loop on the tags associated to the dependency and check with the tags provided in the values
 		dependencies[i].AllowedByTags = false
+		dependencies[i].Tags = req.Tags
 		if len(req.Tags) == 0 {
 			dependencies[i].HasTags = false
 			dependencies[i].AllowedByTags = true
@@ -104,6 +107,17 @@ func Get(chart *chart.Chart, values *chartutil.Values, targets []string, exclude
 			return nil, fmt.Errorf("computing weight value for sub-chart \"%s\", value shall be positive or equal to zero", dependencies[i].UsedName)
 		}
 		dependencies[i].Weight = weightInteger
+
+		// Tests are run for all dependencies when requested, unless "<dependency>.runTests" is set to false
+		dependencies[i].RunTests = true
+		if runTests, err := values.PathValue(dependencies[i].UsedName + ".runTests"); err == nil {
+			b, ok := runTests.(bool)
+			if !ok {
+				return nil, fmt.Errorf("computing runTests value for sub-chart \"%s\", value shall be a boolean", dependencies[i].UsedName)
+			}
+			dependencies[i].RunTests = b
+		}
+
 		dependencies[i].CorrespondingReleaseName = releasePrefix + dependencies[i].UsedName
 
 		// Get the AppVersion that is contained in the Chart.yaml file of the dependency sub-chart
@@ -117,11 +131,11 @@ func Get(chart *chart.Chart, values *chartutil.Values, targets []string, exclude
 	return dependencies, nil
 }
 
-func tags(values *chartutil.Values, verbose bool) map[string]interface{} {
+func tags(values *chartutil.Values, logger *log.Logger, verbose bool) map[string]interface{} {
 	// Get the list of "tags" specified in the values...
 	// (locally-provided values only; values coming from server are not considered)
 	if verbose {
-		log.Info(1, "looking for \"tags\" in values provided through \"--values/-f\", \"--set\", \"--set-string\", and \"--set-file\"...")
+		logger.Info(1, "looking for \"tags\" in values provided through \"--values/-f\", \"--set\", \"--set-string\", and \"--set-file\"...")
 	}
 	var providedTags map[string]interface{}
 	tags, err := values.Table("tags")
@@ -130,7 +144,7 @@ func tags(values *chartutil.Values, verbose bool) map[string]interface{} {
 	}
 	if verbose {
 		for k, v := range providedTags {
-			log.Info(2, fmt.Sprintf("found tag \"%s: %s\"", k, fmt.Sprint(v)))
+			logger.Info(2, "found tag \"%s: %s\"", k, fmt.Sprint(v))
 		}
 	}
 	return providedTags
@@ -0,0 +1,330 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/pkg/kubectl"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"helm.sh/helm/v3/pkg/chartutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events at which hooks can be executed
+const (
+	PreSpray   = "pre-spray"
+	PreWeight  = "pre-weight"
+	PostWeight = "post-weight"
+	PostSpray  = "post-spray"
+)
+
+// Failure policies of the hooks
+const (
+	Abort  = "abort"
+	Ignore = "ignore"
+)
+
+// Hook ...
+type Hook struct {
+	Name      string   `json:"name"`
+	Event     string   `json:"event"`
+	Weights   []int    `json:"weights,omitempty"`
+	Command   []string `json:"command,omitempty"`
+	Job       *Job     `json:"job,omitempty"`
+	OnFailure string   `json:"onFailure,omitempty"`
+	Timeout   int      `json:"timeout,omitempty"`
+}
+
+// Job ...
+type Job struct {
+	Image              string   `json:"image"`
+	Command            []string `json:"command,omitempty"`
+	Args               []string `json:"args,omitempty"`
+	ServiceAccountName string   `json:"serviceAccountName,omitempty"`
+}
+
+// Context given to the hooks through environment variables, plus the kubectl client running their jobs (the kubectl
+// binary if nil) and the logger of the hooks and of their commands (stdout and stderr if nil)
+type Context struct {
+	Kube      util.KubeConfig
+	Kubectl   kubectl.Client
+	Log       *log.Logger
+	Chart     string
+	Namespace string
+	Event     string
+	Weight    int
+	Releases  []string
+	Status    string
+	Error     string
+}
+
+var invalidJobNameCharacters = regexp.MustCompile(`[^a-z0-9\-]+`)
+
+// Interval between the checks of the completion of the jobs
+const jobCheckInterval = 2 * time.Second
+
+// Get the hooks declared under "spray.hooks" in the values of the umbrella chart and in the optional hooks file
+func Get(values chartutil.Values, hooksFile string, defaultTimeout int) ([]Hook, error) {
+	hooks, err := fromValues(values, "spray.hooks")
+	if err != nil {
+		return nil, fmt.Errorf("reading hooks from values: %w", err)
+	}
+
+	if hooksFile != "" {
+		fileValues, err := chartutil.ReadValuesFile(hooksFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading hooks file \"%s\": %w", hooksFile, err)
+		}
+		fileHooks, err := fromValues(fileValues, "hooks")
+		if err != nil {
+			return nil, fmt.Errorf("reading hooks from file \"%s\": %w", hooksFile, err)
+		}
+		hooks = append(hooks, fileHooks...)
+	}
+
+	for i := range hooks {
+		if hooks[i].Name == "" {
+			return nil, fmt.Errorf("hook #%d has no name", i)
+		}
+		switch hooks[i].Event {
+		case PreSpray, PreWeight, PostWeight, PostSpray:
+		default:
+			return nil, fmt.Errorf("hook \"%s\" has an invalid event \"%s\", allowed events are \"%s\", \"%s\", \"%s\" and \"%s\"", hooks[i].Name, hooks[i].Event, PreSpray, PreWeight, PostWeight, PostSpray)
+		}
+		if (len(hooks[i].Command) == 0) == (hooks[i].Job == nil) {
+			return nil, fmt.Errorf("hook \"%s\" shall specify either a command or a job", hooks[i].Name)
+		}
+		if hooks[i].Job != nil && hooks[i].Job.Image == "" {
+			return nil, fmt.Errorf("hook \"%s\" shall specify the image of its job", hooks[i].Name)
+		}
+		if hooks[i].OnFailure == "" {
+			hooks[i].OnFailure = Abort
+		} else if hooks[i].OnFailure != Abort && hooks[i].OnFailure != Ignore {
+			return nil, fmt.Errorf("hook \"%s\" has an invalid failure policy \"%s\", allowed policies are \"%s\" and \"%s\"", hooks[i].Name, hooks[i].OnFailure, Abort, Ignore)
+		}
+		if hooks[i].Timeout <= 0 {
+			hooks[i].Timeout = defaultTimeout
+		}
+	}
+	return hooks, nil
+}
+
+func fromValues(values chartutil.Values, path string) ([]Hook, error) {
+	raw, err := values.PathValue(path)
+	if err != nil {
+		// No hook declared
+		return nil, nil
+	}
+	// Values are generic maps: convert them into hooks through their JSON representation
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// Run the hooks matching the event (and weight) of the context.
+// The returned error is the one of the first failing hook having an "abort" failure policy. The commands are killed,
+// and the jobs deleted, once the given context is cancelled.
+func Run(ctx context.Context, hooks []Hook, hookContext Context, verbose bool, debug bool) error {
+	for _, hook := range hooks {
+		if !hook.matches(hookContext) {
+			continue
+		}
+		hookContext.Log.Info(2, "running %s hook \"%s\"...", hookContext.Event, hook.Name)
+		var err error
+		if hook.Job != nil {
+			err = hook.runJob(ctx, hookContext, verbose, debug)
+		} else {
+			err = hook.runCommand(ctx, hookContext, debug)
+		}
+		if err != nil {
+			if hook.OnFailure == Ignore {
+				hookContext.Log.Info(3, "warning: %s hook \"%s\" failed (ignored): %s", hookContext.Event, hook.Name, err)
+				continue
+			}
+			return fmt.Errorf("%s hook \"%s\" failed: %w", hookContext.Event, hook.Name, err)
+		}
+		hookContext.Log.Info(3, "hook \"%s\" completed", hook.Name)
+	}
+	return nil
+}
+
+func (h Hook) matches(hookContext Context) bool {
+	if h.Event != hookContext.Event {
+		return false
+	}
+	if len(h.Weights) == 0 || (hookContext.Event != PreWeight && hookContext.Event != PostWeight) {
+		return true
+	}
+	for _, w := range h.Weights {
+		if w == hookContext.Weight {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Context) env() map[string]string {
+	env := map[string]string{
+		"SPRAY_HOOK_EVENT": c.Event,
+		"SPRAY_CHART":      c.Chart,
+		"SPRAY_NAMESPACE":  c.Namespace,
+		"SPRAY_RELEASES":   strings.Join(c.Releases, ","),
+		"SPRAY_STATUS":     c.Status,
+		"SPRAY_ERROR":      c.Error,
+	}
+	if c.Event == PreWeight || c.Event == PostWeight {
+		env["SPRAY_WEIGHT"] = strconv.Itoa(c.Weight)
+	}
+	return env
+}
+
+func (h Hook) runCommand(ctx context.Context, hookContext Context, debug bool) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.Timeout)*time.Second)
+	defer cancel()
+
+	if debug {
+		hookContext.Log.Info(3, "running command: %v", h.Command)
+	}
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, "SPRAY_HOOK_NAME="+h.Name)
+	for k, v := range hookContext.env() {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	// Local commands target the same cluster as the spray
+	if hookContext.Kube.Context != "" {
+		cmd.Env = append(cmd.Env, "SPRAY_KUBE_CONTEXT="+hookContext.Kube.Context)
+	}
+	if hookContext.Kube.Kubeconfig != "" {
+		cmd.Env = append(cmd.Env, "KUBECONFIG="+hookContext.Kube.Kubeconfig)
+	}
+	stdout, stderr := hookContext.Log.Stdout(), hookContext.Log.Stderr()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	_ = stdout.Close()
+	_ = stderr.Close()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out after %ds", h.Timeout)
+		}
+		return err
+	}
+	return nil
+}
+
+func (h Hook) runJob(ctx context.Context, hookContext Context, verbose bool, debug bool) error {
+	// Jobs are named as with generateName, so that a hook run several times gets distinct jobs
+	name := invalidJobNameCharacters.ReplaceAllString(strings.ToLower("spray-hook-"+h.Name), "-")
+	suffix := "-" + rand.String(5)
+	if len(name)+len(suffix) > 63 {
+		name = name[:63-len(suffix)]
+	}
+	name = strings.TrimRight(name, "-") + suffix
+
+	env := []corev1.EnvVar{{Name: "SPRAY_HOOK_NAME", Value: h.Name}}
+	for k, v := range hookContext.env() {
+		env = append(env, corev1.EnvVar{Name: k, Value: v})
+	}
+	backoffLimit := int32(0)
+	ttl := int32(3600)
+	job := batchv1.Job{
+		TypeMeta: metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: hookContext.Namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "helm-spray", "helm-spray/hook": h.Event},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy:      corev1.RestartPolicyNever,
+					ServiceAccountName: h.Job.ServiceAccountName,
+					Containers: []corev1.Container{{
+						Name:    "hook",
+						Image:   h.Job.Image,
+						Command: h.Job.Command,
+						Args:    h.Job.Args,
+						Env:     env,
+					}},
+				},
+			},
+		},
+	}
+	manifest, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("generating job manifest: %w", err)
+	}
+	client := hookContext.Kubectl
+	if client == nil {
+		client = kubectl.CLI{Log: hookContext.Log}
+	}
+	if err := client.Create(manifest, hookContext.Kube, hookContext.Namespace, debug); err != nil {
+		return fmt.Errorf("creating job \"%s\": %w", name, err)
+	}
+
+	// The job is checked until it completes, its timeout is elapsed or the context is cancelled: the job is then deleted
+	timeout := time.NewTimer(time.Duration(h.Timeout) * time.Second)
+	defer timeout.Stop()
+	ticker := time.NewTicker(jobCheckInterval)
+	defer ticker.Stop()
+	for {
+		succeeded, err := client.AreJobsReady([]string{name}, hookContext.Kube, hookContext.Namespace, debug)
+		if err != nil {
+			return fmt.Errorf("checking completion of job \"%s\": %w", name, err)
+		}
+		failed := false
+		if !succeeded {
+			failed, err = client.IsJobFailed(name, hookContext.Kube, hookContext.Namespace, debug)
+			if err != nil {
+				return fmt.Errorf("checking completion of job \"%s\": %w", name, err)
+			}
+		}
+		if succeeded || failed {
+			if verbose || failed {
+				if logs, err := client.GetJobLogs(name, hookContext.Kube, hookContext.Namespace); err == nil {
+					hookContext.Log.WithNumberedLines(4, logs)
+				}
+			}
+			if failed {
+				return fmt.Errorf("job \"%s\" failed", name)
+			}
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			deleteJob(client, name, hookContext, debug)
+			return fmt.Errorf("timed out after %ds waiting for job \"%s\"", h.Timeout, name)
+		case <-ctx.Done():
+			deleteJob(client, name, hookContext, debug)
+			return fmt.Errorf("waiting for job \"%s\": %w", name, ctx.Err())
+		}
+	}
+}
+
+// Delete a job which has not completed, along with its pods
+func deleteJob(client kubectl.Client, name string, hookContext Context, debug bool) {
+	hookContext.Log.Info(3, "deleting job \"%s\"...", name)
+	if err := client.DeleteJob(name, hookContext.Kube, hookContext.Namespace, debug); err != nil {
+		hookContext.Log.Error("Error: cannot delete job \"%s\": %s", name, err)
+	}
+}
@@ -2,15 +2,127 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 )
 
+var output io.Writer = os.Stdout
+
+// Sink receives the spray messages, instead of stdout and stderr
+type Sink interface {
+	Info(level int, message string)
+	Error(message string)
+}
+
+// Logger writes the spray messages to its sink, or to stdout and stderr when it has none (as does a nil Logger)
+type Logger struct {
+	sink Sink
+	// Prefix of the messages and of the output of the commands
+	prefix string
+}
+
+// New returns a Logger sending the spray messages and the output of the helm and kubectl commands to the given sink, or
+// to stdout and stderr if the sink is nil
+func New(sink Sink) *Logger {
+	return &Logger{sink: sink}
+}
+
+// WithPrefix returns a Logger writing to the same destination, prefixing the messages and the output of the commands
+// (typically by the name of a cluster)
+func (l *Logger) WithPrefix(prefix string) *Logger {
+	return &Logger{sink: l.sinkOf(), prefix: l.prefixOf() + prefix}
+}
+
+// Logger of the package functions, writing to stdout and stderr
+var std *Logger
+
+// SetOutput sets the destination of the spray messages, stdout by default
+func SetOutput(w io.Writer) {
+	output = w
+}
+
+// Stdout returns the destination of the standard output of the commands run by spray, to be closed once the command
+// has completed
+func Stdout() io.WriteCloser {
+	return std.Stdout()
+}
+
+// Stderr returns the destination of the error output of the commands run by spray, to be closed once the command has
+// completed
+func Stderr() io.WriteCloser {
+	return std.Stderr()
+}
+
 // Log spray messages
 func Info(level int, str string, params ...interface{}) {
-	var logStr = "[spray] "
+	std.Info(level, str, params...)
+}
+
+func WithNumberedLines(level int, str string, params ...interface{}) {
+	std.WithNumberedLines(level, str, params...)
+}
+
+// Log error
+func Error(str string, params ...interface{}) {
+	std.Error(str, params...)
+}
+
+func (l *Logger) sinkOf() Sink {
+	if l == nil {
+		return nil
+	}
+	return l.sink
+}
+
+func (l *Logger) prefixOf() string {
+	if l == nil {
+		return ""
+	}
+	return l.prefix
+}
+
+// Stdout returns the destination of the standard output of the commands run by spray, to be closed once the command
+// has completed, so that its last line is logged even without a trailing newline
+func (l *Logger) Stdout() io.WriteCloser {
+	prefix := l.prefixOf()
+	if sink := l.sinkOf(); sink != nil {
+		return &lineWriter{emit: func(line string) { sink.Info(3, prefix+line) }}
+	}
+	if prefix != "" {
+		return &lineWriter{emit: func(line string) { _, _ = fmt.Fprintln(output, prefix+line) }}
+	}
+	return nopCloser{output}
+}
+
+// Stderr returns the destination of the error output of the commands run by spray, to be closed once the command has
+// completed, so that its last line is logged even without a trailing newline
+func (l *Logger) Stderr() io.WriteCloser {
+	prefix := l.prefixOf()
+	if sink := l.sinkOf(); sink != nil {
+		return &lineWriter{emit: func(line string) { sink.Error(prefix + line) }}
+	}
+	if prefix != "" {
+		return &lineWriter{emit: func(line string) { _, _ = fmt.Fprintln(os.Stderr, prefix+line) }}
+	}
+	return nopCloser{os.Stderr}
+}
+
+// Info logs spray messages
+func (l *Logger) Info(level int, str string, params ...interface{}) {
+	if sink := l.sinkOf(); sink != nil {
+		if len(params) != 0 {
+			str = fmt.Sprintf(str, params...)
+		}
+		sink.Info(level, l.prefixOf()+str)
+		return
+	}
+
+	var logStr = "[spray] " + l.prefixOf()
 
 	if level == 2 {
 		logStr = logStr + "  > "
@@ -23,13 +135,14 @@ func Info(level int, str string, params ...interface{}) {
 	}
 
 	if len(params) != 0 {
-		fmt.Println(logStr + fmt.Sprintf(str, params...))
+		_, _ = fmt.Fprintln(output, logStr+fmt.Sprintf(str, params...))
 	} else {
-		fmt.Println(logStr + str)
+		_, _ = fmt.Fprintln(output, logStr+str)
 	}
 }
 
-func WithNumberedLines(level int, str string, params ...interface{}) {
+// WithNumberedLines logs a text line by line, prefixing each line by its number
+func (l *Logger) WithNumberedLines(level int, str string, params ...interface{}) {
 	// Number of lines to be printed
 	numberOfLines := strings.Count(str, "\n")
 	if len(str) > 0 && !strings.HasSuffix(str, "\n") {
@@ -48,16 +161,65 @@ func WithNumberedLines(level int, str string, params ...interface{}) {
 	lineNbr := 0
 	scanner := bufio.NewScanner(strings.NewReader(str))
 	for scanner.Scan() {
-		Info(level, fmt.Sprintf(format, lineNbr, scanner.Text()), params...)
+		l.Info(level, fmt.Sprintf(format, lineNbr, scanner.Text()), params...)
 		lineNbr++
 	}
 }
 
-// Log error
-func Error(str string, params ...interface{}) {
+// Error logs errors
+func (l *Logger) Error(str string, params ...interface{}) {
+	if sink := l.sinkOf(); sink != nil {
+		if len(params) != 0 {
+			str = fmt.Sprintf(str, params...)
+		}
+		sink.Error(l.prefixOf() + str)
+		return
+	}
 	if len(params) != 0 {
-		os.Stderr.WriteString(fmt.Sprintf(str+"\n", params...))
+		os.Stderr.WriteString(l.prefixOf() + fmt.Sprintf(str+"\n", params...))
 	} else {
-		os.Stderr.WriteString(str + "\n")
+		os.Stderr.WriteString(l.prefixOf() + str + "\n")
+	}
+}
+
+// Writer forwarding each line written to it
+type lineWriter struct {
+	mu     sync.Mutex
+	buffer []byte
+	emit   func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buffer = append(w.buffer, p...)
+	for {
+		i := bytes.IndexByte(w.buffer, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(strings.TrimRight(string(w.buffer[:i]), "\r"))
+		w.buffer = w.buffer[i+1:]
 	}
+	return len(p), nil
+}
+
+// Close forwards the last line written, if it has no trailing newline
+func (w *lineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buffer) > 0 {
+		w.emit(strings.TrimRight(string(w.buffer), "\r"))
+		w.buffer = nil
+	}
+	return nil
+}
+
+// Writer directly writing to stdout or stderr, which are not closed
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
 }
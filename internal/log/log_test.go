@@ -0,0 +1,39 @@
+package log
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Sink recording the messages
+type recordingSink struct {
+	infos  []string
+	errors []string
+}
+
+func (s *recordingSink) Info(level int, message string) {
+	s.infos = append(s.infos, message)
+}
+
+func (s *recordingSink) Error(message string) {
+	s.errors = append(s.errors, message)
+}
+
+func TestCommandOutput(t *testing.T) {
+	sink := &recordingSink{}
+	logger := New(sink).WithPrefix("[eu] ")
+	stdout, stderr := logger.Stdout(), logger.Stderr()
+	_, _ = stdout.Write([]byte("first\r\nsec"))
+	_, _ = stdout.Write([]byte("ond\nlast"))
+	_, _ = stderr.Write([]byte("error"))
+	if !reflect.DeepEqual(sink.infos, []string{"[eu] first", "[eu] second"}) || len(sink.errors) != 0 {
+		t.Errorf("expected the complete lines only, got %v and %v", sink.infos, sink.errors)
+	}
+
+	// The last lines are forwarded once the command has completed, even without a trailing newline
+	_ = stdout.Close()
+	_ = stderr.Close()
+	if !reflect.DeepEqual(sink.infos, []string{"[eu] first", "[eu] second", "[eu] last"}) || !reflect.DeepEqual(sink.errors, []string{"[eu] error"}) {
+		t.Errorf("expected the last lines, got %v and %v", sink.infos, sink.errors)
+	}
+}
@@ -0,0 +1,158 @@
+package render
+
+import (
+	"fmt"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+)
+
+// Manifest is a Kubernetes object rendered from a template of a chart
+type Manifest struct {
+	// Path of the template the object comes from
+	Template   string
+	APIVersion string
+	Kind       string
+	Name       string
+	// Whether the object is a helm hook
+	Hook    bool
+	Content string
+}
+
+// Release describes the release to render
+type Release struct {
+	Name      string
+	Namespace string
+	IsUpgrade bool
+	// Capabilities of the cluster, the default helm ones being used when not set
+	Capabilities *chartutil.Capabilities
+}
+
+// Render renders locally the manifests of a release of a chart, given the values supplied by the user, the same way
+// helm does on install or upgrade (the 'lookup' function returning no object)
+func Render(chartPath string, release Release, values map[string]interface{}) ([]Manifest, error) {
+	// The chart is loaded for each release, as the processing of the dependencies updates it
+	chart, err := loader.Load(chartPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading chart \"%s\": %w", chartPath, err)
+	}
+	if err := chartutil.ProcessDependenciesWithMerge(chart, values); err != nil {
+		return nil, fmt.Errorf("processing dependencies: %w", err)
+	}
+	capabilities := release.Capabilities
+	if capabilities == nil {
+		capabilities = chartutil.DefaultCapabilities
+	}
+	options := chartutil.ReleaseOptions{
+		Name:      release.Name,
+		Namespace: release.Namespace,
+		Revision:  1,
+		IsUpgrade: release.IsUpgrade,
+		IsInstall: !release.IsUpgrade,
+	}
+	renderValues, err := chartutil.ToRenderValues(chart, values, options, capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("computing values: %w", err)
+	}
+	files, err := engine.Render(chart, renderValues)
+	if err != nil {
+		return nil, err
+	}
+	for name := range files {
+		if strings.HasSuffix(name, "NOTES.txt") {
+			delete(files, name)
+		}
+	}
+
+	hooks, manifests, err := releaseutil.SortManifests(files, capabilities.APIVersions, releaseutil.InstallOrder)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Manifest, 0, len(hooks)+len(manifests))
+	for _, m := range manifests {
+		manifest := Manifest{Template: m.Name, Content: m.Content}
+		if m.Head != nil {
+			manifest.APIVersion = m.Head.Version
+			manifest.Kind = m.Head.Kind
+			if m.Head.Metadata != nil {
+				manifest.Name = m.Head.Metadata.Name
+			}
+		}
+		result = append(result, manifest)
+	}
+	for _, h := range hooks {
+		manifest := Manifest{Template: h.Path, Kind: h.Kind, Name: h.Name, Hook: true, Content: h.Manifest}
+		var head releaseutil.SimpleHead
+		if err := yaml.Unmarshal([]byte(h.Manifest), &head); err == nil {
+			manifest.APIVersion = head.Version
+		}
+		result = append(result, manifest)
+	}
+	return result, nil
+}
+
+// CRDKinds returns the kinds declared by the CustomResourceDefinitions found in the 'crds/' directories of a chart and
+// of its sub-charts, and among the given manifests, as "<group>/<version>/<kind>" strings
+func CRDKinds(chartPath string, manifests []Manifest) ([]string, error) {
+	chart, err := loader.Load(chartPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading chart \"%s\": %w", chartPath, err)
+	}
+	kinds := make(map[string]bool)
+	for _, crd := range chart.CRDObjects() {
+		for _, content := range releaseutil.SplitManifests(string(crd.File.Data)) {
+			if err := addCRDKinds(kinds, content); err != nil {
+				return nil, fmt.Errorf("reading CRD file \"%s\": %w", crd.Filename, err)
+			}
+		}
+	}
+	for _, m := range manifests {
+		if m.Kind == "CustomResourceDefinition" {
+			if err := addCRDKinds(kinds, m.Content); err != nil {
+				return nil, fmt.Errorf("reading CRD from template \"%s\": %w", m.Template, err)
+			}
+		}
+	}
+	result := make([]string, 0, len(kinds))
+	for kind := range kinds {
+		result = append(result, kind)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+type customResourceDefinition struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Group string `json:"group"`
+		Names struct {
+			Kind string `json:"kind"`
+		} `json:"names"`
+		// Single version of the v1beta1 API
+		Version  string `json:"version"`
+		Versions []struct {
+			Name string `json:"name"`
+		} `json:"versions"`
+	} `json:"spec"`
+}
+
+func addCRDKinds(kinds map[string]bool, content string) error {
+	var crd customResourceDefinition
+	if err := yaml.Unmarshal([]byte(content), &crd); err != nil {
+		return err
+	}
+	if crd.Kind != "CustomResourceDefinition" || crd.Spec.Names.Kind == "" {
+		return nil
+	}
+	if crd.Spec.Version != "" {
+		kinds[crd.Spec.Group+"/"+crd.Spec.Version+"/"+crd.Spec.Names.Kind] = true
+	}
+	for _, version := range crd.Spec.Versions {
+		kinds[crd.Spec.Group+"/"+version.Name+"/"+crd.Spec.Names.Kind] = true
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// Prefix that can be given to a values file to explicitly flag it as encrypted
+const Prefix = "secrets://"
+
+// IsEncrypted tells whether a values file is encrypted, either because its name has the "secrets://" prefix,
+// or because it holds sops metadata. Also returns the path of the file, without the prefix.
+func IsEncrypted(file string) (string, bool, error) {
+	if strings.HasPrefix(file, Prefix) {
+		return strings.TrimPrefix(file, Prefix), true, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return file, false, fmt.Errorf("reading values file \"%s\": %w", file, err)
+	}
+	// Quick check before parsing the file
+	if !bytes.Contains(data, []byte("sops")) {
+		return file, false, nil
+	}
+	var content map[string]interface{}
+	if err := yaml.Unmarshal(data, &content); err != nil {
+		// Not a valid YAML file: let the values processing report the error
+		return file, false, nil
+	}
+	metadata, ok := content["sops"].(map[string]interface{})
+	if !ok {
+		return file, false, nil
+	}
+	_, hasMac := metadata["mac"]
+	return file, hasMac, nil
+}
+
+// Decrypt an encrypted values file, in memory, using sops
+func Decrypt(file string, keys util.SecretsKeys, logger *log.Logger, debug bool) ([]byte, error) {
+	if _, err := exec.LookPath("sops"); err != nil {
+		return nil, errors.New("sops is required to decrypt values files, but it cannot be found")
+	}
+
+	// Keep the file format, which sops cannot guess from the extension for some file names
+	var myargs = []string{"--decrypt"}
+	if ext := filepath.Ext(file); ext != ".yaml" && ext != ".yml" && ext != ".json" {
+		myargs = append(myargs, "--input-type", "yaml", "--output-type", "yaml")
+	}
+	myargs = append(myargs, file)
+
+	if debug {
+		logger.Info(2, "running sops command: %v", myargs)
+	}
+	cmd := exec.Command("sops", myargs...)
+	cmd.Env = os.Environ()
+	if keys.AgeIdentityFile != "" {
+		cmd.Env = append(cmd.Env, "SOPS_AGE_KEY_FILE="+keys.AgeIdentityFile)
+	}
+	if keys.PGPKeyring != "" {
+		cmd.Env = append(cmd.Env, "GNUPGHOME="+keys.PGPKeyring)
+	}
+	// The decrypted content is kept in memory and never logged
+	cmdOutput := &bytes.Buffer{}
+	cmdError := &bytes.Buffer{}
+	cmd.Stdout = cmdOutput
+	cmd.Stderr = cmdError
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("decrypting values file \"%s\": %w: %s", file, err, strings.TrimSpace(cmdError.String()))
+	}
+	return cmdOutput.Bytes(), nil
+}
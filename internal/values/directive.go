@@ -0,0 +1,288 @@
+package values
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Directives are "#!" comments of the values files holding a pipeline between "{{" and "}}", and ending their line:
+//
+//	directive := "#!" "{{" pipeline "}}"
+//	pipeline  := command { "|" command }
+//	command   := function { argument }
+//	argument  := word | string | "(" pipeline ")"
+//
+// Functions are ".Files.Get" (or ".File.Get"), "pick", "toYaml", "env", "readFile", "default", "required", "quote",
+// "indent" and "nindent". As in Go templates, the value of a command is given as the last argument of the next command
+// of the pipeline (except for "pick", where it is the picked source).
+// Words are sequences of characters other than spaces, '|', '(', ')' and quotes, which are not "}}". Strings are
+// double-quoted strings with Go escape sequences, or back-quoted raw strings.
+
+// Directive parsed from a line of a values file
+type directive struct {
+	// Offset of the directive in its line
+	offset int
+	// Text of the directive, from "#!" to "}}"
+	text     string
+	pipeline pipeline
+}
+
+type pipeline struct {
+	commands []command
+}
+
+type command struct {
+	pos      int
+	function string
+	args     []argument
+}
+
+// Argument of a command: a word or a string, or a nested pipeline
+type argument struct {
+	pos      int
+	text     string
+	pipeline *pipeline
+}
+
+// Error at a position of a line, the column being given from 1
+type positionError struct {
+	column int
+	err    error
+}
+
+func (e *positionError) Error() string {
+	return fmt.Sprintf("%d: %s", e.column, e.err)
+}
+
+func (e *positionError) Unwrap() error {
+	return e.err
+}
+
+func errorAt(pos int, format string, args ...interface{}) error {
+	return &positionError{column: pos + 1, err: fmt.Errorf(format, args...)}
+}
+
+// Find the directive ending a line: a "#!" followed by "{{", the line ending with "}}". Other "#!" comments are regular
+// comments. Returns nil if the line holds no directive.
+func findDirective(line string) (*directive, error) {
+	trimmed := strings.TrimRight(line, " \t\r")
+	if !strings.HasSuffix(trimmed, "}}") {
+		return nil, nil
+	}
+	offset := 0
+	for {
+		i := strings.Index(trimmed[offset:], "#!")
+		if i < 0 {
+			return nil, nil
+		}
+		offset += i
+		if strings.HasPrefix(strings.TrimLeft(trimmed[offset+2:], " \t"), "{{") {
+			break
+		}
+		offset += 2
+	}
+	p := parser{lexer: lexer{input: trimmed, pos: offset + 2}}
+	pipeline, err := p.parseDirective()
+	if err != nil {
+		return nil, err
+	}
+	return &directive{offset: offset, text: trimmed[offset:], pipeline: pipeline}, nil
+}
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenLeftDelim
+	tokenRightDelim
+	tokenPipe
+	tokenLeftParen
+	tokenRightParen
+	tokenWord
+	tokenString
+)
+
+type token struct {
+	typ tokenType
+	pos int
+	// Text of the words, and unquoted value of the strings
+	text string
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokenEOF:
+		return "end of line"
+	case tokenString:
+		return strconv.Quote(t.text)
+	case tokenWord:
+		return "\"" + t.text + "\""
+	}
+	return "\"" + map[tokenType]string{tokenLeftDelim: "{{", tokenRightDelim: "}}", tokenPipe: "|", tokenLeftParen: "(", tokenRightParen: ")"}[t.typ] + "\""
+}
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) && (l.input[l.pos] == ' ' || l.input[l.pos] == '\t') {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{typ: tokenEOF, pos: start}, nil
+	}
+	rest := l.input[l.pos:]
+	switch {
+	case strings.HasPrefix(rest, "{{"):
+		l.pos += 2
+		return token{typ: tokenLeftDelim, pos: start}, nil
+	case strings.HasPrefix(rest, "}}"):
+		l.pos += 2
+		return token{typ: tokenRightDelim, pos: start}, nil
+	case rest[0] == '|':
+		l.pos++
+		return token{typ: tokenPipe, pos: start}, nil
+	case rest[0] == '(':
+		l.pos++
+		return token{typ: tokenLeftParen, pos: start}, nil
+	case rest[0] == ')':
+		l.pos++
+		return token{typ: tokenRightParen, pos: start}, nil
+	case rest[0] == '"':
+		end := 1
+		for ; end < len(rest) && rest[end] != '"'; end++ {
+			if rest[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(rest) {
+			return token{}, errorAt(start, "unterminated quoted string")
+		}
+		text, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return token{}, errorAt(start, "invalid quoted string %s: %w", rest[:end+1], err)
+		}
+		l.pos += end + 1
+		return token{typ: tokenString, pos: start, text: text}, nil
+	case rest[0] == '`':
+		end := strings.IndexByte(rest[1:], '`')
+		if end < 0 {
+			return token{}, errorAt(start, "unterminated raw string")
+		}
+		l.pos += end + 2
+		return token{typ: tokenString, pos: start, text: rest[1 : end+1]}, nil
+	}
+	end := 0
+	for end < len(rest) && !strings.ContainsRune(" \t|()\"`", rune(rest[end])) && !strings.HasPrefix(rest[end:], "}}") {
+		end++
+	}
+	l.pos += end
+	return token{typ: tokenWord, pos: start, text: rest[:end]}, nil
+}
+
+type parser struct {
+	lexer  lexer
+	peeked *token
+}
+
+func (p *parser) next() (token, error) {
+	if p.peeked != nil {
+		t := *p.peeked
+		p.peeked = nil
+		return t, nil
+	}
+	return p.lexer.next()
+}
+
+func (p *parser) peek() (token, error) {
+	if p.peeked == nil {
+		t, err := p.lexer.next()
+		if err != nil {
+			return token{}, err
+		}
+		p.peeked = &t
+	}
+	return *p.peeked, nil
+}
+
+func (p *parser) expect(typ tokenType, description string) (token, error) {
+	t, err := p.next()
+	if err != nil {
+		return token{}, err
+	}
+	if t.typ != typ {
+		return token{}, errorAt(t.pos, "expected %s, found %s", description, t)
+	}
+	return t, nil
+}
+
+func (p *parser) parseDirective() (pipeline, error) {
+	if _, err := p.expect(tokenLeftDelim, "\"{{\""); err != nil {
+		return pipeline{}, err
+	}
+	pl, err := p.parsePipeline()
+	if err != nil {
+		return pipeline{}, err
+	}
+	if _, err := p.expect(tokenRightDelim, "\"|\" or \"}}\""); err != nil {
+		return pipeline{}, err
+	}
+	if _, err := p.expect(tokenEOF, "end of line after \"}}\""); err != nil {
+		return pipeline{}, err
+	}
+	return pl, nil
+}
+
+func (p *parser) parsePipeline() (pipeline, error) {
+	pl := pipeline{}
+	for {
+		c, err := p.parseCommand()
+		if err != nil {
+			return pipeline{}, err
+		}
+		pl.commands = append(pl.commands, c)
+		t, err := p.peek()
+		if err != nil {
+			return pipeline{}, err
+		}
+		if t.typ != tokenPipe {
+			return pl, nil
+		}
+		_, _ = p.next()
+	}
+}
+
+func (p *parser) parseCommand() (command, error) {
+	t, err := p.expect(tokenWord, "a function")
+	if err != nil {
+		return command{}, err
+	}
+	c := command{pos: t.pos, function: t.text}
+	for {
+		t, err := p.peek()
+		if err != nil {
+			return command{}, err
+		}
+		switch t.typ {
+		case tokenWord, tokenString:
+			_, _ = p.next()
+			c.args = append(c.args, argument{pos: t.pos, text: t.text})
+		case tokenLeftParen:
+			_, _ = p.next()
+			nested, err := p.parsePipeline()
+			if err != nil {
+				return command{}, err
+			}
+			if _, err := p.expect(tokenRightParen, "\"|\" or \")\""); err != nil {
+				return command{}, err
+			}
+			c.args = append(c.args, argument{pos: t.pos, pipeline: &nested})
+		default:
+			return c, nil
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package values
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindDirective(t *testing.T) {
+	tests := []struct {
+		line string
+		// Functions of the commands of the pipeline, nested pipelines being given between parentheses, or the expected
+		// error, or "" if the line holds no directive
+		expected string
+	}{
+		{line: "key: value", expected: ""},
+		{line: "# regular comment", expected: ""},
+		{line: "#! regular comment", expected: ""},
+		{line: "#! {{ .Files.Get a.yaml }} followed by text", expected: ""},
+		{line: "#! {{ .Files.Get a.yaml }}", expected: ".Files.Get[a.yaml]"},
+		{line: "#!{{.Files.Get a.yaml}}", expected: ".Files.Get[a.yaml]"},
+		{line: "key: #! {{ .Files.Get a.yaml }} \t\r", expected: ".Files.Get[a.yaml]"},
+		{line: "#! not a directive #! {{ env VAR }}", expected: "env[VAR]"},
+		{line: `#! {{ .Files.Get "my file.yaml" }}`, expected: ".Files.Get[my file.yaml]"},
+		{line: "#! {{ .Files.Get `C:\\a.yaml` }}", expected: ".Files.Get[C:\\a.yaml]"},
+		{line: `#! {{ env "A" | default "\"}}\"" | quote }}`, expected: `env[A] | default["}}"] | quote[]`},
+		{line: "#! {{ pick (.Files.Get a.yaml | pick b) c.d | indent 2 }}", expected: "pick[(.Files.Get[a.yaml] | pick[b]) c.d] | indent[2]"},
+		{line: "#! {{ }}", expected: "1:7: expected a function, found \"}}\""},
+		{line: "#! {{ env A | }}", expected: "1:15: expected a function, found \"}}\""},
+		{line: "#! {{ env A", expected: ""},
+		{line: "#! {{ env \"A }}", expected: "1:11: unterminated quoted string"},
+		{line: "#! {{ env `A }}", expected: "1:11: unterminated raw string"},
+		{line: `#! {{ env "\q" }}`, expected: "1:11: invalid quoted string \"\\q\": invalid syntax"},
+		{line: "#! {{ pick (.Files.Get a.yaml b }}", expected: "1:33: expected \"|\" or \")\", found \"}}\""},
+		{line: "#! {{ env A ) }}", expected: "1:13: expected \"|\" or \"}}\", found \")\""},
+		{line: "#! {{ env A }} }}", expected: "1:16: expected end of line after \"}}\", found \"}}\""},
+	}
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			d, err := findDirective(test.line)
+			var actual string
+			switch {
+			case err != nil:
+				actual = "1:" + err.Error()
+			case d != nil:
+				actual = formatPipeline(d.pipeline)
+				if !strings.HasPrefix(test.line[d.offset:], "#!") || !strings.HasSuffix(d.text, "}}") {
+					t.Errorf("invalid directive text \"%s\" at offset %d", d.text, d.offset)
+				}
+			}
+			if actual != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+// Format a pipeline as: function[arguments] | function[arguments]
+func formatPipeline(pl pipeline) string {
+	commands := make([]string, 0, len(pl.commands))
+	for _, c := range pl.commands {
+		args := make([]string, 0, len(c.args))
+		for _, arg := range c.args {
+			if arg.pipeline != nil {
+				args = append(args, "("+formatPipeline(*arg.pipeline)+")")
+			} else {
+				args = append(args, arg.text)
+			}
+		}
+		commands = append(commands, c.function+"["+strings.Join(args, " ")+"]")
+	}
+	return strings.Join(commands, " | ")
+}
+
+func FuzzFindDirective(f *testing.F) {
+	for _, seed := range []string{
+		"#! {{ .Files.Get a.yaml }}",
+		`key: #! {{ env "A" | default "\"}}\"" | quote }}`,
+		"#! {{ pick (.Files.Get `a b.yaml` | pick b) c.d | nindent 2 }}",
+		"#! {{ ((( }}",
+		"#!#!{{{{ }}}}",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		d, err := findDirective(line)
+		if err != nil {
+			if _, ok := err.(*positionError); !ok {
+				t.Errorf("error without position: %s", err)
+			}
+			return
+		}
+		if d != nil && (len(d.pipeline.commands) == 0 || !strings.HasPrefix(line[d.offset:], d.text)) {
+			t.Errorf("invalid directive %+v for %q", d, line)
+		}
+	})
+}
@@ -0,0 +1,529 @@
+package values
+
+import (
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/log"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var pathSegmentExpression = regexp.MustCompile(`^([^\[\]]*)((?:\[\d+\])*)$`)
+
+// Files that can be included, either the files of the umbrella chart, or files of the local filesystem
+type includeSource interface {
+	// Returns the files matching the given name or glob pattern, as referenced from the given file
+	glob(pattern string, from string) ([]includedFile, error)
+}
+
+type includedFile struct {
+	name string
+	data []byte
+}
+
+type chartSource struct {
+	chart *chart.Chart
+}
+
+type fileSystemSource struct{}
+
+type directiveProcessor struct {
+	source includeSource
+	// Whether the "env" and "readFile" functions are enabled, which is never the case for the files of a chart
+	interpolation bool
+	// Directory against which the paths given to "readFile" are resolved, and which they cannot escape
+	baseDir   string
+	strictEnv bool
+	log       *log.Logger
+	verbose   bool
+	// Files being processed, to detect include cycles
+	stack []string
+	// Origin of the lines of the processed file
+	lines []LineOrigin
+}
+
+// LineOrigin locates a line of a processed values file in the original file: the line itself, or the directive which
+// produced it
+type LineOrigin struct {
+	// Line of the original file, from 1
+	Line int
+	// Text of the directive, for the lines produced by a directive
+	Directive string
+}
+
+// Value of a command of a directive: a text, the files returned by ".Files.Get", or values picked from files, the last
+// two being converted into text when inserted into a values file or given to a text function
+type value struct {
+	kind  valueKind
+	text  string
+	files []includedFile
+	data  interface{}
+	// Name of the file (or glob pattern) the files or the picked values come from
+	source string
+}
+
+type valueKind int
+
+const (
+	textValue valueKind = iota
+	filesValue
+	dataValue
+)
+
+// Search the directives in the default values file of the chart and replace them by their value.
+// Allows:
+//   - Including a file:
+//     #! {{ .Files.Get myfile.yaml }}
+//   - Including several files matching a glob pattern, their values being merged in the lexical order of their names:
+//     #! {{ .Files.Get "values/*.yaml" }}
+//   - Including a sub-part of a file, picking a specific path. Paths can target a Yaml element (aka table), a list,
+//     a list item or a leaf value:
+//     #! {{ pick (.Files.Get myfile.yaml) tag }}
+//     #! {{ .Files.Get myfile.yaml | pick servers[0].host }}
+//   - Indenting the include content, optionally starting with a new line, or converting it into YAML:
+//     #! {{ .Files.Get myfile.yaml | indent 2 }}
+//     tag: #! {{ pick (.Files.Get myfile.yaml) tag | toYaml }}
+//   - All combined...:
+//     #! {{ pick (.Files.Get "myfile.yaml") "tag.subTag" | indent 4 }}
+//
+// The "env" and "readFile" functions (see interpolate.go) are not available to the files of the chart.
+//
+// Included files may themselves contain directives, which are processed recursively.
+// Returns the processed values and the origin of their lines.
+func processChartValuesFile(chart *chart.Chart, logger *log.Logger, verbose bool) (string, []LineOrigin, error) {
+	var chartValues string
+	for _, f := range chart.Raw {
+		if f.Name == chartutil.ValuesfileName {
+			chartValues = string(f.Data)
+		}
+	}
+
+	if verbose {
+		logger.Info(1, "looking for \"#!\" directives into the values file of the umbrella chart...")
+	}
+
+	p := directiveProcessor{source: chartSource{chart: chart}, log: logger, verbose: verbose}
+	updated, err := p.process(chartutil.ValuesfileName, chartValues)
+	if err != nil {
+		return "", nil, err
+	}
+	return updated, p.lines, nil
+}
+
+// ProcessValuesFile processes the directives of the content of a values file of the local filesystem (typically given
+// through '--values'/'-f'). Included and read files are searched relatively to the directory of the values file, the
+// "env" and "readFile" functions being only available when interpolate is set.
+// Returns the updated content of the file and the origin of its lines, the origins being nil if the content is unchanged.
+func ProcessValuesFile(file string, content string, interpolate bool, strictEnv bool, logger *log.Logger, verbose bool) (string, []LineOrigin, error) {
+	if !strings.Contains(content, "#!") {
+		return content, nil, nil
+	}
+
+	if verbose {
+		logger.Info(1, "looking for \"#!\" directives into the values file \"%s\"...", file)
+	}
+
+	p := directiveProcessor{source: fileSystemSource{}, interpolation: interpolate, baseDir: filepath.Dir(file), strictEnv: strictEnv, log: logger, verbose: verbose}
+	updated, err := p.process(filepath.Clean(file), content)
+	if err != nil {
+		return "", nil, err
+	}
+	if updated == content {
+		return content, nil, nil
+	}
+	return updated, p.lines, nil
+}
+
+func (p *directiveProcessor) process(name string, content string) (string, error) {
+	for _, parent := range p.stack {
+		if parent == name {
+			return "", fmt.Errorf("include cycle detected: %s -> %s", strings.Join(p.stack, " -> "), name)
+		}
+	}
+	p.stack = append(p.stack, name)
+	defer func() { p.stack = p.stack[:len(p.stack)-1] }()
+
+	// The origin of the lines is only kept for the processed file itself, not for the included ones
+	topLevel := len(p.stack) == 1
+	if !strings.Contains(content, "#!") {
+		if topLevel {
+			p.lines = unchangedLines(content)
+		}
+		return content, nil
+	}
+	lines := strings.SplitAfter(content, "\n")
+	var sb strings.Builder
+	for i, line := range lines {
+		start := sb.Len()
+		d, err := findDirective(strings.TrimRight(line, "\n"))
+		if err == nil && d != nil {
+			var v value
+			if v, err = p.evaluate(name, d, d.pipeline); err == nil {
+				var text string
+				if text, err = v.String(); err == nil {
+					sb.WriteString(line[:d.offset])
+					sb.WriteString(text)
+				}
+			}
+		}
+		if err != nil {
+			// The errors of the directives are prefixed by their column
+			return "", fmt.Errorf("%s:%d:%w", name, i+1, err)
+		}
+		if d == nil {
+			sb.WriteString(line)
+		} else if strings.HasSuffix(line, "\n") {
+			sb.WriteString("\n")
+		}
+		if topLevel && line != "" {
+			origin := LineOrigin{Line: i + 1}
+			if d != nil {
+				origin.Directive = d.text
+			}
+			// A directive produces the lines of its value
+			for n := strings.Count(strings.TrimSuffix(sb.String()[start:], "\n"), "\n"); n >= 0; n-- {
+				p.lines = append(p.lines, origin)
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+// Origin of the lines of a file without directive
+func unchangedLines(content string) []LineOrigin {
+	lines := make([]LineOrigin, 0)
+	for i, line := range strings.SplitAfter(content, "\n") {
+		if line != "" {
+			lines = append(lines, LineOrigin{Line: i + 1})
+		}
+	}
+	return lines
+}
+
+// Signature of the functions of the directives
+type function struct {
+	// Number of arguments, including the value of the previous command of the pipeline
+	args int
+	// Whether the function can get the value of the previous command of the pipeline
+	piped bool
+}
+
+var functions = map[string]function{
+	".Files.Get": {args: 1},
+	".File.Get":  {args: 1},
+	"pick":       {args: 2, piped: true},
+	"toYaml":     {args: 1, piped: true},
+	"env":        {args: 1},
+	"readFile":   {args: 1},
+	"default":    {args: 2, piped: true},
+	"required":   {args: 2, piped: true},
+	"quote":      {args: 1, piped: true},
+	"indent":     {args: 2, piped: true},
+	"nindent":    {args: 2, piped: true},
+}
+
+// Call of a function by a directive
+type call struct {
+	// File holding the directive
+	file      string
+	directive *directive
+	function  string
+	args      []value
+	// Whether the last argument is the value of the previous command of the pipeline
+	piped bool
+	// Next commands of the pipeline
+	next []command
+}
+
+// Evaluate a pipeline, the value of each command being given as the last argument of the next one
+func (p *directiveProcessor) evaluate(name string, d *directive, pl pipeline) (value, error) {
+	var piped *value
+	for i, c := range pl.commands {
+		f, ok := functions[c.function]
+		if !ok {
+			return value{}, errorAt(c.pos, "unknown function \"%s\"", c.function)
+		}
+		if piped != nil && !f.piped {
+			return value{}, errorAt(c.pos, "\"%s\" can only be used at the beginning of a pipeline", c.function)
+		}
+		expected := f.args
+		if piped != nil {
+			expected--
+		}
+		if len(c.args) != expected {
+			return value{}, errorAt(c.pos, "function \"%s\" expects %d argument(s), got %d", c.function, expected, len(c.args))
+		}
+
+		args := make([]value, 0, f.args)
+		for _, arg := range c.args {
+			if arg.pipeline == nil {
+				args = append(args, value{kind: textValue, text: arg.text})
+				continue
+			}
+			v, err := p.evaluate(name, d, *arg.pipeline)
+			if err != nil {
+				return value{}, err
+			}
+			args = append(args, v)
+		}
+		if piped != nil {
+			args = append(args, *piped)
+		}
+
+		v, err := p.call(call{file: name, directive: d, function: c.function, args: args, piped: piped != nil, next: pl.commands[i+1:]})
+		if err != nil {
+			return value{}, errorAt(c.pos, "%w", err)
+		}
+		piped = &v
+	}
+	return *piped, nil
+}
+
+func (p *directiveProcessor) call(c call) (value, error) {
+	switch c.function {
+	case ".Files.Get", ".File.Get":
+		return p.filesGet(c)
+	case "pick":
+		return pickValue(c)
+	case "toYaml":
+		return toYaml(c.args[0])
+	}
+	// Other functions work on texts
+	args := make([]string, len(c.args))
+	for i := range c.args {
+		var err error
+		if args[i], err = c.args[i].String(); err != nil {
+			return value{}, err
+		}
+	}
+	text, err := p.interpolate(c, args)
+	if err != nil {
+		return value{}, err
+	}
+	return value{kind: textValue, text: text}, nil
+}
+
+// Get the files matching a name or a glob pattern, after processing their own directives
+func (p *directiveProcessor) filesGet(c call) (value, error) {
+	pattern, err := c.args[0].String()
+	if err != nil {
+		return value{}, err
+	}
+	if p.verbose {
+		p.log.Info(2, "found reference to values file \"%s\"", pattern)
+	}
+
+	files, err := p.source.glob(pattern, c.file)
+	if err != nil {
+		return value{}, err
+	}
+	if len(files) == 0 {
+		return value{}, fmt.Errorf("finding file \"%s\" referenced in the \"%s\" clause", pattern, c.directive.text)
+	}
+
+	// Process the directives of the included files themselves
+	for i := range files {
+		processed, err := p.process(files[i].name, string(files[i].data))
+		if err != nil {
+			return value{}, err
+		}
+		files[i].data = []byte(processed)
+	}
+	return value{kind: filesValue, files: files, source: pattern}, nil
+}
+
+// Pick the values at a path, given as "pick <source> <path>" or "<source> | pick <path>". The source can be files, values
+// previously picked, or a YAML text.
+func pickValue(c call) (value, error) {
+	source, pathArg := c.args[0], c.args[1]
+	if c.piped {
+		source, pathArg = c.args[1], c.args[0]
+	}
+	valuePath, err := pathArg.String()
+	if err != nil {
+		return value{}, err
+	}
+	data, err := source.values()
+	if err != nil {
+		return value{}, err
+	}
+	picked, err := pick(data, valuePath)
+	if err != nil {
+		if source.source == "" {
+			return value{}, fmt.Errorf("finding values matching path \"%s\": %w", valuePath, err)
+		}
+		return value{}, fmt.Errorf("finding values matching path \"%s\" in values file \"%s\": %w", valuePath, source.source, err)
+	}
+	return value{kind: dataValue, data: picked, source: source.source}, nil
+}
+
+// Convert a value into YAML: the merged values of files, or the YAML representation of picked values or of a text
+func toYaml(v value) (value, error) {
+	var data interface{}
+	switch v.kind {
+	case filesValue:
+		values, err := v.values()
+		if err != nil {
+			return value{}, err
+		}
+		data = values
+	case dataValue:
+		data = v.data
+	default:
+		data = v.text
+	}
+	out, err := yaml.Marshal(data)
+	if err != nil {
+		return value{}, fmt.Errorf("generating YAML: %w", err)
+	}
+	return value{kind: textValue, text: strings.TrimSuffix(string(out), "\n")}, nil
+}
+
+// Values of a value: the merged values of files, picked values, or values read from a YAML text
+func (v value) values() (interface{}, error) {
+	switch v.kind {
+	case dataValue:
+		return v.data, nil
+	case filesValue:
+		data := make(map[string]interface{})
+		for _, f := range v.files {
+			values, err := chartutil.ReadValues(f.data)
+			if err != nil {
+				return nil, fmt.Errorf("reading values from file \"%s\": %w", f.name, err)
+			}
+			data = mergeMaps(data, values)
+		}
+		return data, nil
+	default:
+		values, err := chartutil.ReadValues([]byte(v.text))
+		if err != nil {
+			return nil, fmt.Errorf("reading values: %w", err)
+		}
+		return map[string]interface{}(values), nil
+	}
+}
+
+// Text of a value: the raw content of a single file, the merged values of several files, picked strings as is, or the
+// YAML representation of other picked values; without final newline
+func (v value) String() (string, error) {
+	switch v.kind {
+	case filesValue:
+		if len(v.files) == 1 {
+			return strings.TrimSuffix(string(v.files[0].data), "\n"), nil
+		}
+		data, err := v.values()
+		if err != nil {
+			return "", err
+		}
+		out, err := chartutil.Values(data.(map[string]interface{})).YAML()
+		if err != nil {
+			return "", fmt.Errorf("generating a valid YAML file from values of files \"%s\": %w", v.source, err)
+		}
+		return strings.TrimSuffix(out, "\n"), nil
+	case dataValue:
+		switch data := v.data.(type) {
+		case string:
+			return strings.TrimSuffix(data, "\n"), nil
+		case map[string]interface{}:
+			out, err := chartutil.Values(data).YAML()
+			if err != nil {
+				return "", fmt.Errorf("generating a valid YAML file from values picked in values file \"%s\": %w", v.source, err)
+			}
+			return strings.TrimSuffix(out, "\n"), nil
+		default:
+			out, err := yaml.Marshal(data)
+			if err != nil {
+				return "", fmt.Errorf("generating a valid YAML file from values picked in values file \"%s\": %w", v.source, err)
+			}
+			return strings.TrimSuffix(string(out), "\n"), nil
+		}
+	default:
+		return v.text, nil
+	}
+}
+
+// Get the element at the given path, made of keys separated by dots, each key being optionally followed by list indexes,
+// e.g. "servers[0].host"
+func pick(data interface{}, valuePath string) (interface{}, error) {
+	current := data
+	for _, segment := range strings.Split(valuePath, ".") {
+		match := pathSegmentExpression.FindStringSubmatch(segment)
+		if match == nil {
+			return nil, fmt.Errorf("invalid path element \"%s\"", segment)
+		}
+		if match[1] != "" {
+			table, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("\"%s\" is not a table", match[1])
+			}
+			if current, ok = table[match[1]]; !ok {
+				return nil, fmt.Errorf("no value found for \"%s\"", match[1])
+			}
+		}
+		if match[2] == "" {
+			continue
+		}
+		for _, index := range strings.Split(strings.Trim(match[2], "[]"), "][") {
+			i, _ := strconv.Atoi(index)
+			list, ok := current.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("\"%s\" is not a list", segment)
+			}
+			if i >= len(list) {
+				return nil, fmt.Errorf("index %d out of range in \"%s\" (list of %d items)", i, segment, len(list))
+			}
+			current = list[i]
+		}
+	}
+	return current, nil
+}
+
+func (s chartSource) glob(pattern string, from string) ([]includedFile, error) {
+	pattern = strings.TrimSpace(pattern)
+	files := make([]includedFile, 0)
+	for _, f := range s.chart.Files {
+		matched := f.Name == pattern
+		if !matched && strings.ContainsAny(pattern, "*?[") {
+			var err error
+			if matched, err = path.Match(pattern, f.Name); err != nil {
+				return nil, fmt.Errorf("invalid file pattern \"%s\": %w", pattern, err)
+			}
+		}
+		if matched {
+			files = append(files, includedFile{name: f.Name, data: f.Data})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+func (s fileSystemSource) glob(pattern string, from string) ([]includedFile, error) {
+	pattern = strings.TrimSpace(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(from), pattern)
+	}
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file pattern \"%s\": %w", pattern, err)
+	}
+	sort.Strings(names)
+	files := make([]includedFile, 0, len(names))
+	for _, name := range names {
+		if info, err := os.Stat(name); err != nil || info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("reading file \"%s\": %w", name, err)
+		}
+		files = append(files, includedFile{name: filepath.Clean(name), data: data})
+	}
+	return files, nil
+}
@@ -0,0 +1,233 @@
+package values
+
+import (
+	"flag"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the tests")
+
+// Compare the result of a test with its golden file, or update the golden file with the result
+func checkGolden(t *testing.T, golden string, actual string) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(golden, []byte(actual), 0644); err != nil {
+			t.Fatalf("updating golden file: %s", err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading golden file (run the tests with -update to create it): %s", err)
+	}
+	if string(expected) != actual {
+		t.Errorf("result differs from golden file \"%s\":\n--- got:\n%s\n--- expected:\n%s", golden, actual, string(expected))
+	}
+}
+
+// Result of a processing, as stored in the golden files: the processed values, or the error
+func goldenResult(output string, err error) string {
+	if err != nil {
+		return "error: " + err.Error() + "\n"
+	}
+	return output
+}
+
+func TestProcessIncludeInValuesFile(t *testing.T) {
+	// Each test processes the values file of the fixture umbrella chart "testdata/include/<name>", the expected result
+	// being in "testdata/include/<name>.golden"
+	tests := []struct {
+		name        string
+		description string
+	}{
+		{name: "include", description: "whole file"},
+		{name: "include-quoted", description: "quoted file name"},
+		{name: "include-legacy-file-get", description: "\".File.Get\" kept for backward compatibility"},
+		{name: "include-no-spaces", description: "no space around the clause"},
+		{name: "include-subdirectory", description: "file of a sub-directory of the chart"},
+		{name: "include-indent", description: "indented content"},
+		{name: "include-at-end-of-file", description: "clause without final newline"},
+		{name: "regular-comments", description: "comments which are not include clauses"},
+		{name: "pick-table", description: "table picked from a file"},
+		{name: "pick-nested-table-quoted", description: "quoted file name and path"},
+		{name: "pick-leaf", description: "leaf values picked as the value of keys"},
+		{name: "pick-list", description: "list, list items and leaves of list items"},
+		{name: "glob", description: "values of several files merged in lexical order"},
+		{name: "glob-pick", description: "table picked from merged files"},
+		{name: "nested", description: "included file including another file"},
+		{name: "multiline", description: "multiline strings, included and picked"},
+		{name: "include-special-names", description: "file names with spaces, '+' and '@'"},
+		{name: "pipeline", description: "pipelines of files, picked values, toYaml and nindent"},
+		{name: "quoted-strings", description: "escape sequences, raw strings and delimiters in strings"},
+		{name: "missing-file", description: "error: no matching file"},
+		{name: "missing-path", description: "error: no value at path"},
+		{name: "pick-not-a-table", description: "error: path going through a leaf"},
+		{name: "pick-index-out-of-range", description: "error: list index out of range"},
+		{name: "cycle", description: "error: include cycle"},
+		{name: "invalid-included-values", description: "error: included file not valid YAML"},
+		{name: "syntax-error", description: "error: missing function after '|'"},
+		{name: "unterminated-string", description: "error: unterminated quoted string"},
+		{name: "unknown-function", description: "error: unknown function"},
+		{name: "pipeline-misuse", description: "error: function only allowed at the beginning of a pipeline"},
+		{name: "indent-out-of-range", description: "error: negative indentation"},
+		{name: "chart-interpolation", description: "error: environment variable read by the values of a chart"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chart, err := loader.Load(filepath.Join("testdata", "include", test.name))
+			if err != nil {
+				t.Fatalf("loading chart: %s", err)
+			}
+			output, lines, err := processChartValuesFile(chart, nil, false)
+			if err == nil {
+				if _, err := chartutil.ReadValues([]byte(output)); err != nil {
+					t.Errorf("processed values are not valid (%s): %s\n%s", test.description, err, output)
+				}
+				if len(lines) != countLines(output) {
+					t.Errorf("got %d line origins for %d lines", len(lines), countLines(output))
+				}
+			}
+			checkGolden(t, filepath.Join("testdata", "include", test.name+".golden"), goldenResult(output, err))
+		})
+	}
+}
+
+func countLines(content string) int {
+	lines := strings.Count(content, "\n")
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		lines++
+	}
+	return lines
+}
+
+func TestProcessValuesFile(t *testing.T) {
+	// Each test processes the file "testdata/files/<name>/values.yaml", the expected result being in
+	// "testdata/files/<name>.golden"
+	tests := []struct {
+		name        string
+		env         map[string]string
+		interpolate bool
+		changed     bool
+	}{
+		{name: "include-relative", changed: true},
+		{name: "interpolation", env: map[string]string{"SPRAY_TEST_HOST": "", "SPRAY_TEST_USER": "admin", "SPRAY_TEST_PASSWORD": `p@ss "word"`}, interpolate: true, changed: true},
+		{name: "interpolation-required", interpolate: true},
+		{name: "interpolation-disabled"},
+		{name: "read-file-escape", interpolate: true},
+		{name: "read-file-absolute", interpolate: true},
+		{name: "no-directive"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			file := filepath.Join("testdata", "files", test.name, "values.yaml")
+			content, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("reading values file: %s", err)
+			}
+			output, lines, err := ProcessValuesFile(file, string(content), test.interpolate, true, nil, false)
+			if changed := lines != nil; err == nil && changed != test.changed {
+				t.Errorf("expected changed %t, got %t", test.changed, changed)
+			}
+			checkGolden(t, filepath.Join("testdata", "files", test.name+".golden"), goldenResult(output, err))
+		})
+	}
+}
+
+// Files of memory, for the fuzzing of the include processor
+type memorySource map[string]string
+
+func (s memorySource) glob(pattern string, from string) ([]includedFile, error) {
+	pattern = strings.TrimSpace(pattern)
+	names := make([]string, 0)
+	for name := range s {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	files := make([]includedFile, 0, len(names))
+	for _, name := range names {
+		files = append(files, includedFile{name: name, data: []byte(s[name])})
+	}
+	return files, nil
+}
+
+var fuzzSource = memorySource{
+	"ms1.yaml":         "ms1:\n  image: ms1\n  tags: [a, b]\n  script: |\n    line 1\n    line 2\n",
+	"values/1.yaml":    "a:\n  b: 1\n",
+	"values/2.yaml":    "a:\n  c: 2\n",
+	"nested.yaml":      "nested:\n  #! {{ .Files.Get ms1.yaml | indent 2 }}\n",
+	"self.yaml":        "#! {{ .Files.Get self.yaml }}\n",
+	"invalid.yaml":     "key: [unterminated\n",
+	"weird name.yaml":  "weird: true\n",
+	"values/[x].yaml":  "x: 1\n",
+	"empty.yaml":       "",
+	"no-newline.yaml":  "key: value",
+	"directives.yaml":  "#! {{ pick (.Files.Get values/*.yaml) a | indent 4 }}\n",
+	"deep/nested.yaml": "#! {{ .Files.Get nested.yaml }}\n",
+}
+
+func FuzzIncludeProcessor(f *testing.F) {
+	fixtures, _ := filepath.Glob(filepath.Join("testdata", "include", "*", "values.yaml"))
+	for _, fixture := range fixtures {
+		if content, err := os.ReadFile(fixture); err == nil {
+			f.Add(string(content))
+		}
+	}
+	f.Add("#! {{ .Files.Get ms1.yaml }}")
+	f.Add("key: #! {{ pick (.Files.Get ms1.yaml) ms1.tags[1] }}\n")
+	f.Add("#! {{ pick (.Files.Get \"values/*.yaml\") \"a\" | indent 99 }}\n")
+	f.Add("#! {{ .Files.Get self.yaml }}\n")
+	f.Add("#! {{ .Files.Get deep/nested.yaml | indent 2 }}\n")
+	f.Add("#! {{ .Files.Get [ }}\n")
+	f.Add("#! {{ pick (.Files.Get ms1.yaml) ms1.tags[99999999999999999999] }}\n")
+	f.Add("#!#!{{{{ .Files.Get ms1.yaml }}}}\r\n")
+
+	f.Fuzz(func(t *testing.T, content string) {
+		// The processing shall neither panic nor loop forever
+		var output string
+		var err error
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p := directiveProcessor{source: fuzzSource}
+			output, err = p.process("values.yaml", content)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("processing of %q did not terminate", content)
+		}
+		if !strings.Contains(content, "#!") && (err != nil || output != content) {
+			t.Errorf("content without clause changed by the processing: %q -> %q (%v)", content, output, err)
+		}
+	})
+}
+
+func FuzzPick(f *testing.F) {
+	for _, seed := range []string{"a", "a.b", "servers[0].host", "servers[1].ports[0]", "[0]", "a[0][1]", "a..b", "", ".", "a[", "a[-1]", "a[99999999999999999999]"} {
+		f.Add(seed)
+	}
+	data := map[string]interface{}{
+		"a":       map[string]interface{}{"b": "leaf", "": "empty key"},
+		"servers": []interface{}{map[string]interface{}{"host": "h", "ports": []interface{}{80, 443}}, []interface{}{"nested"}},
+	}
+	f.Fuzz(func(t *testing.T, valuePath string) {
+		_, _ = pick(data, valuePath)
+	})
+}
@@ -0,0 +1,93 @@
+package values
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Maximum indentation of the "indent" and "nindent" functions
+const maxIndentation = 1024
+
+// Evaluate the functions of the directives working on texts.
+// Allows:
+//   - Getting the value of an environment variable:
+//     host: #! {{ env "DB_HOST" }}
+//   - Reading the content of a file:
+//     #! {{ readFile "certs/ca.pem" }}
+//   - Providing a default value, used when the variable is not defined or empty (or the file is empty):
+//     host: #! {{ env "DB_HOST" | default "localhost" }}
+//   - Failing with a message when the variable is not defined or empty:
+//     password: #! {{ env "DB_PASSWORD" | required "DB_PASSWORD shall be set" }}
+//   - Quoting the value as a YAML string, or indenting it, optionally starting with a new line:
+//     password: #! {{ env "DB_PASSWORD" | quote }}
+//     #! {{ readFile "ca.pem" | indent 4 }}
+//     ca: #! {{ readFile "ca.pem" | nindent 4 }}
+//
+// "env" and "readFile" are only available when interpolation is enabled for a values file of the local filesystem, read
+// files being confined to the directory of the values file. When strictEnv is set, referencing an undefined environment
+// variable without a default value is an error.
+func (p *directiveProcessor) interpolate(c call, args []string) (string, error) {
+	if (c.function == "env" || c.function == "readFile") && !p.interpolation {
+		return "", fmt.Errorf("function \"%s\" is only available in the values files given through the command line, with '--interpolate'", c.function)
+	}
+	switch c.function {
+	case "env":
+		v, found := os.LookupEnv(args[0])
+		if !found && p.strictEnv && !handlesMissingValue(c.next) {
+			return "", fmt.Errorf("environment variable \"%s\" is not defined", args[0])
+		}
+		if !found && p.verbose {
+			p.log.Info(2, "warning: environment variable \"%s\" is not defined", args[0])
+		}
+		return v, nil
+	case "readFile":
+		if !filepath.IsLocal(args[0]) {
+			return "", fmt.Errorf("reading file \"%s\": only files under the directory of the values file can be read", args[0])
+		}
+		data, err := os.ReadFile(filepath.Join(p.baseDir, args[0]))
+		if err != nil {
+			return "", fmt.Errorf("reading file \"%s\": %w", args[0], err)
+		}
+		return strings.TrimSuffix(string(data), "\n"), nil
+	case "default":
+		if args[1] == "" {
+			return args[0], nil
+		}
+		return args[1], nil
+	case "required":
+		if args[1] == "" {
+			return "", fmt.Errorf("required value is missing: %s", args[0])
+		}
+		return args[1], nil
+	case "quote":
+		return strconv.Quote(args[0]), nil
+	case "indent", "nindent":
+		nbrOfSpaces, err := strconv.Atoi(args[0])
+		if err != nil {
+			return "", fmt.Errorf("computing indentation value in \"%s\": %w", c.directive.text, err)
+		}
+		if nbrOfSpaces < 0 || nbrOfSpaces > maxIndentation {
+			return "", fmt.Errorf("indentation value %d out of range [0, %d]", nbrOfSpaces, maxIndentation)
+		}
+		indentation := strings.Repeat(" ", nbrOfSpaces)
+		value := indentation + strings.Replace(args[1], "\n", "\n"+indentation, -1)
+		if c.function == "nindent" {
+			value = "\n" + value
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown function \"%s\"", c.function)
+}
+
+// Whether a "default" or "required" function handles the case of an undefined value in the rest of the pipeline
+func handlesMissingValue(commands []command) bool {
+	for _, c := range commands {
+		if c.function == "default" || c.function == "required" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package values
+
+import (
+	"fmt"
+	"go.yaml.in/yaml/v3"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"sort"
+	"strings"
+)
+
+// Layer of the values given to a release: the layers are merged in order, the values of a layer overriding the ones of
+// the previous layers
+type Layer struct {
+	// Origin of the values: a file, a flag...
+	Source string
+	Values map[string]interface{}
+	// Location of the values coming from a file, by path
+	Locations map[string]string
+}
+
+// Contribution of a layer to a value
+type Contribution struct {
+	// Path of the value in the layer, which is the path of the explained value, or the path of one of its parents given
+	// as a leaf by the layer
+	Path     string
+	Location string
+	Value    interface{}
+}
+
+// Provenance of a value of a release
+type Provenance struct {
+	Path  string
+	Value interface{}
+	// Layers having given the value, from the overridden ones to the winning one
+	Contributions []Contribution
+}
+
+// FileLayer reads the values of a values file, locating each of them by its line. The lines of a processed file are
+// located in the original file through the given origins (nil for an unprocessed file). The values are set under the
+// given scope (e.g. the key of a sub-chart), unless it is empty.
+func FileLayer(name string, content []byte, lines []LineOrigin, scope string) (Layer, error) {
+	values, err := chartutil.ReadValues(content)
+	if err != nil {
+		return Layer{}, fmt.Errorf("reading values from file \"%s\": %w", name, err)
+	}
+	layer := Layer{Source: name, Values: values, Locations: make(map[string]string)}
+
+	// The locations are given on a best effort basis: the file is valid, as its values have been read
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err == nil && len(document.Content) > 0 {
+		locateValues(document.Content[0], scope, func(path string, line int) {
+			location := fmt.Sprintf("%s:%d", name, line)
+			if line <= len(lines) {
+				origin := lines[line-1]
+				location = fmt.Sprintf("%s:%d", name, origin.Line)
+				if origin.Directive != "" {
+					location = fmt.Sprintf("%s (%s)", location, origin.Directive)
+				}
+			}
+			layer.Locations[path] = location
+		})
+	}
+
+	if scope != "" {
+		layer.Values = scoped(layer.Values, scope)
+	}
+	return layer, nil
+}
+
+// Call the given function with the path and the line of each key of a YAML mapping, recursively
+func locateValues(node *yaml.Node, path string, located func(path string, line int)) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		keyPath := joinPath(path, key.Value)
+		located(keyPath, key.Line)
+		locateValues(node.Content[i+1], keyPath, located)
+	}
+}
+
+// Set values under a key path, e.g. "backend" or "backend.config"
+func scoped(values map[string]interface{}, scope string) map[string]interface{} {
+	keys := strings.Split(scope, ".")
+	for i := len(keys) - 1; i >= 0; i-- {
+		values = map[string]interface{}{keys[i]: values}
+	}
+	return values
+}
+
+// Explain gives the provenance of each leaf value at or under the given path of the values merged from the layers. The
+// provenance holds the layers having given the value, including the overridden ones.
+func Explain(layers []Layer, valuePath string) ([]Provenance, error) {
+	merged := make(map[string]interface{})
+	for _, layer := range layers {
+		merged = mergeMaps(merged, layer.Values)
+	}
+
+	keys := strings.Split(valuePath, ".")
+	value, ok := lookup(merged, keys)
+	if !ok {
+		return nil, fmt.Errorf("no value found for \"%s\"", valuePath)
+	}
+
+	provenances := make([]Provenance, 0)
+	forEachLeaf(value, keys, func(leafKeys []string, leaf interface{}) {
+		provenance := Provenance{Path: strings.Join(leafKeys, "."), Value: leaf}
+		for _, layer := range layers {
+			// A layer contributes through the value itself, or through one of its parents set as a leaf
+			for i := 1; i <= len(leafKeys); i++ {
+				v, ok := lookup(layer.Values, leafKeys[:i])
+				if !ok {
+					break
+				}
+				if _, isTable := v.(map[string]interface{}); isTable && i < len(leafKeys) {
+					continue
+				}
+				path := strings.Join(leafKeys[:i], ".")
+				location, ok := layer.Locations[path]
+				if !ok {
+					location = layer.Source
+				}
+				provenance.Contributions = append(provenance.Contributions, Contribution{Path: path, Location: location, Value: v})
+				break
+			}
+		}
+		provenances = append(provenances, provenance)
+	})
+	return provenances, nil
+}
+
+// Get the value at a path of keys
+func lookup(values map[string]interface{}, keys []string) (interface{}, bool) {
+	var current interface{} = values
+	for _, key := range keys {
+		table, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = table[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// Call the given function for each leaf of a value, in the lexical order of the paths. Lists and empty tables are
+// leaves, as they are replaced as a whole when values are merged.
+func forEachLeaf(value interface{}, keys []string, leaf func(keys []string, value interface{})) {
+	table, ok := value.(map[string]interface{})
+	if !ok || len(table) == 0 {
+		leaf(keys, value)
+		return
+	}
+	names := make([]string, 0, len(table))
+	for name := range table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		forEachLeaf(table[name], append(keys[:len(keys):len(keys)], name), leaf)
+	}
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
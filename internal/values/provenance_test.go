@@ -0,0 +1,76 @@
+package values
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFileLayer(t *testing.T) {
+	content := "a:\n  b: 1\n  c:\n  - x\nd: 2\n"
+	// Lines 2 and 3 have been produced by a directive of line 2 of the original file
+	lines := []LineOrigin{{Line: 1}, {Line: 2, Directive: "#! {{ .Files.Get b.yaml | indent 2 }}"}, {Line: 2, Directive: "#! {{ .Files.Get b.yaml | indent 2 }}"}, {Line: 3}, {Line: 4}}
+	layer, err := FileLayer("values.yaml", []byte(content), lines, "sub.chart")
+	if err != nil {
+		t.Fatalf("reading layer: %s", err)
+	}
+	expectedValues := map[string]interface{}{"sub": map[string]interface{}{"chart": map[string]interface{}{
+		"a": map[string]interface{}{"b": float64(1), "c": []interface{}{"x"}},
+		"d": float64(2),
+	}}}
+	if !reflect.DeepEqual(layer.Values, expectedValues) {
+		t.Errorf("expected values %v, got %v", expectedValues, layer.Values)
+	}
+	expectedLocations := map[string]string{
+		"sub.chart.a":   "values.yaml:1",
+		"sub.chart.a.b": "values.yaml:2 (#! {{ .Files.Get b.yaml | indent 2 }})",
+		"sub.chart.a.c": "values.yaml:2 (#! {{ .Files.Get b.yaml | indent 2 }})",
+		"sub.chart.d":   "values.yaml:4",
+	}
+	if !reflect.DeepEqual(layer.Locations, expectedLocations) {
+		t.Errorf("expected locations %v, got %v", expectedLocations, layer.Locations)
+	}
+
+	if _, err := FileLayer("invalid.yaml", []byte("a: [b\n"), nil, ""); err == nil {
+		t.Errorf("expected an error for invalid values")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	layers := []Layer{
+		{
+			Source:    "charts/sub/values.yaml",
+			Values:    map[string]interface{}{"sub": map[string]interface{}{"image": "nginx", "config": map[string]interface{}{"level": "info", "format": "json"}}},
+			Locations: map[string]string{"sub.image": "charts/sub/values.yaml:1", "sub.config.level": "charts/sub/values.yaml:3"},
+		},
+		{
+			Source: "prod.yaml",
+			Values: map[string]interface{}{"sub": map[string]interface{}{"config": "disabled"}, "other": 1},
+		},
+		{
+			Source: "--set sub.config.level=debug",
+			Values: map[string]interface{}{"sub": map[string]interface{}{"config": map[string]interface{}{"level": "debug"}}},
+		},
+	}
+
+	provenances, err := Explain(layers, "sub")
+	if err != nil {
+		t.Fatalf("explaining values: %s", err)
+	}
+	expected := []Provenance{
+		{Path: "sub.config.level", Value: "debug", Contributions: []Contribution{
+			{Path: "sub.config.level", Location: "charts/sub/values.yaml:3", Value: "info"},
+			{Path: "sub.config", Location: "prod.yaml", Value: "disabled"},
+			{Path: "sub.config.level", Location: "--set sub.config.level=debug", Value: "debug"},
+		}},
+		{Path: "sub.image", Value: "nginx", Contributions: []Contribution{
+			{Path: "sub.image", Location: "charts/sub/values.yaml:1", Value: "nginx"},
+		}},
+	}
+	if !reflect.DeepEqual(provenances, expected) {
+		t.Errorf("expected %+v, got %+v", expected, provenances)
+	}
+
+	if _, err := Explain(layers, "sub.missing"); err == nil {
+		t.Errorf("expected an error for a missing path")
+	}
+}
@@ -0,0 +1,195 @@
+package values
+
+import (
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/internal/secrets"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Key listing the values files of a sub-chart in the values of the umbrella chart: "<chart name or alias>.valuesFiles"
+const valuesFilesKey = "valuesFiles"
+
+// SubChartFile is a values file of a sub-chart, whose values are set under the key of the sub-chart
+type SubChartFile struct {
+	// Name or alias of the sub-chart
+	SubChart string
+	Name     string
+	// Content of the file, after the processing of its directives, and origin of its lines
+	Content string
+	Lines   []LineOrigin
+	Values  map[string]interface{}
+	// Whether the file has been decrypted
+	Encrypted bool
+}
+
+// Scoped returns the values of the file set under the key of the sub-chart
+func (f SubChartFile) Scoped() map[string]interface{} {
+	return map[string]interface{}{f.SubChart: f.Values}
+}
+
+// Get the values files of the sub-charts, in their order of precedence:
+//   - the files of the umbrella chart listed by "<chart name or alias>.valuesFiles" in the given values of the umbrella
+//     chart, given as names or glob patterns (nil values when the values of the umbrella chart are reused),
+//   - the "<chart name or alias>.yaml" (or ".yml") files of the values directory, if any, decrypted with the given keys
+//     when encrypted, as the values files given through the command line.
+//
+// The directives of the files are processed, as for the values file of the umbrella chart: the "env" and "readFile"
+// functions are only available to the files of the values directory, when interpolate is set.
+func subChartFiles(chart *chart.Chart, chartValues map[string]interface{}, valuesDir string, secretsKeys util.SecretsKeys, interpolate bool, strictEnv bool, logger *log.Logger, verbose bool, debug bool) ([]SubChartFile, error) {
+	usedNames := make([]string, 0, len(chart.Metadata.Dependencies))
+	for _, dependency := range chart.Metadata.Dependencies {
+		if dependency.Alias != "" {
+			usedNames = append(usedNames, dependency.Alias)
+		} else {
+			usedNames = append(usedNames, dependency.Name)
+		}
+	}
+
+	files := make([]SubChartFile, 0)
+	for _, usedName := range usedNames {
+		patterns, err := valuesFilesOf(chartValues, usedName)
+		if err != nil {
+			return nil, err
+		}
+		for _, pattern := range patterns {
+			if verbose {
+				logger.Info(1, "found values file \"%s\" of sub-chart \"%s\"", pattern, usedName)
+			}
+			matching, err := chartSource{chart: chart}.glob(pattern, chartutil.ValuesfileName)
+			if err != nil {
+				return nil, err
+			}
+			if len(matching) == 0 {
+				return nil, fmt.Errorf("finding file \"%s\" referenced by \"%s.%s\"", pattern, usedName, valuesFilesKey)
+			}
+			for _, f := range matching {
+				p := directiveProcessor{source: chartSource{chart: chart}, log: logger, verbose: verbose}
+				content, err := p.process(f.name, string(f.data))
+				if err != nil {
+					return nil, fmt.Errorf("processing directives of values file \"%s\": %w", f.name, err)
+				}
+				file, err := newSubChartFile(usedName, f.name, content, p.lines)
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, file)
+			}
+		}
+	}
+
+	if valuesDir == "" {
+		return files, nil
+	}
+	dirFiles, err := valuesDirFiles(valuesDir, usedNames)
+	if err != nil {
+		return nil, err
+	}
+	for _, usedName := range usedNames {
+		name, found := dirFiles[usedName]
+		if !found {
+			continue
+		}
+		if verbose {
+			logger.Info(1, "found values file \"%s\" of sub-chart \"%s\"", name, usedName)
+		}
+		_, encrypted, err := secrets.IsEncrypted(name)
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		if encrypted {
+			if verbose {
+				logger.Info(1, "decrypting values file \"%s\"...", name)
+			}
+			data, err = secrets.Decrypt(name, secretsKeys, logger, debug)
+		} else {
+			data, err = os.ReadFile(name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading values file \"%s\": %w", name, err)
+		}
+		content, lines, err := ProcessValuesFile(name, string(data), interpolate, strictEnv, logger, verbose)
+		if err != nil {
+			return nil, fmt.Errorf("processing directives of values file \"%s\": %w", name, err)
+		}
+		file, err := newSubChartFile(usedName, name, content, lines)
+		if err != nil {
+			return nil, err
+		}
+		file.Encrypted = encrypted
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func newSubChartFile(usedName string, name string, content string, lines []LineOrigin) (SubChartFile, error) {
+	values, err := chartutil.ReadValues([]byte(content))
+	if err != nil {
+		return SubChartFile{}, fmt.Errorf("reading values from file \"%s\": %w", name, err)
+	}
+	return SubChartFile{SubChart: usedName, Name: name, Content: content, Lines: lines, Values: values}, nil
+}
+
+// Get the list of the values files of a sub-chart, given by "<chart name or alias>.valuesFiles"
+func valuesFilesOf(chartValues map[string]interface{}, usedName string) ([]string, error) {
+	subChartValues, ok := chartValues[usedName].(map[string]interface{})
+	if !ok || subChartValues[valuesFilesKey] == nil {
+		return nil, nil
+	}
+	list, ok := subChartValues[valuesFilesKey].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("\"%s.%s\" shall be a list of file names", usedName, valuesFilesKey)
+	}
+	patterns := make([]string, 0, len(list))
+	for _, item := range list {
+		pattern, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("\"%s.%s\" shall be a list of file names, got %v", usedName, valuesFilesKey, item)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// Get the values files of the values directory by name or alias of sub-chart, checking that the directory exists, and
+// that its values files are named after sub-charts, with a single file per sub-chart
+func valuesDirFiles(valuesDir string, usedNames []string) (map[string]string, error) {
+	entries, err := os.ReadDir(valuesDir)
+	if err != nil {
+		return nil, fmt.Errorf("reading values directory: %w", err)
+	}
+	files := make(map[string]string)
+	unknown := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		usedName := strings.TrimSuffix(name, ext)
+		found := false
+		for _, n := range usedNames {
+			found = found || n == usedName
+		}
+		if !found {
+			unknown = append(unknown, name)
+			continue
+		}
+		if other, duplicate := files[usedName]; duplicate {
+			return nil, fmt.Errorf("values files \"%s\" and \"%s\" of directory \"%s\" are both named after sub-chart \"%s\"", filepath.Base(other), name, valuesDir, usedName)
+		}
+		files[usedName] = filepath.Join(valuesDir, name)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("values files of directory \"%s\" not named \"<chart name or alias>.yaml\" (or \".yml\") after a sub-chart: %s", valuesDir, strings.Join(unknown, ", "))
+	}
+	return files, nil
+}
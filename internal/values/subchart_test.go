@@ -0,0 +1,150 @@
+package values
+
+import (
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli/values"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeSubChartFiles(t *testing.T) {
+	chart, err := loader.Load(filepath.Join("testdata", "subcharts", "umbrella"))
+	if err != nil {
+		t.Fatalf("loading chart: %s", err)
+	}
+	valuesDir := filepath.Join("testdata", "subcharts", "values-dir")
+	merged, err := Merge(chart, false, false, false, valuesDir, util.SecretsKeys{}, &values.Options{Values: []string{"backend.config.level=warn"}}, nil, nil, false, false)
+	if err != nil {
+		t.Fatalf("merging values: %s", err)
+	}
+
+	// Files of the "valuesFiles" lists in the order of the dependencies, then the files of the values directory
+	names := make([]string, 0)
+	for _, f := range merged.SubChartFiles {
+		names = append(names, f.SubChart+":"+f.Name)
+	}
+	expectedNames := []string{"backend:values/backend/1-common.yaml", "backend:values/backend/2-debug.yaml", "web:values/web.yaml", "backend:" + filepath.Join(valuesDir, "backend.yaml")}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("expected files %v, got %v", expectedNames, names)
+	}
+	if web := merged.SubChartFiles[2]; web.Content != "ingress:\n  host: web.example.com\n" || len(web.Lines) != 2 || web.Lines[1].Directive == "" {
+		t.Errorf("directives of sub-chart file not processed: %+v", web)
+	}
+
+	expectedValues := map[string]interface{}{
+		"backend": map[string]interface{}{
+			"weight":      float64(0),
+			"valuesFiles": []interface{}{"values/backend/*.yaml"},
+			"replicas":    float64(3),
+			"config":      map[string]interface{}{"level": "warn"},
+		},
+		"web": map[string]interface{}{
+			"weight":      float64(1),
+			"valuesFiles": []interface{}{"values/web.yaml"},
+			"ingress":     map[string]interface{}{"host": "web.example.com"},
+		},
+	}
+	if !reflect.DeepEqual(map[string]interface{}(merged.Values), expectedValues) {
+		t.Errorf("expected values %v, got %v", expectedValues, merged.Values)
+	}
+
+	// The "valuesFiles" lists are ignored when the values are reused
+	merged, err = Merge(chart, true, false, false, "", util.SecretsKeys{}, &values.Options{}, nil, nil, false, false)
+	if err != nil {
+		t.Fatalf("merging reused values: %s", err)
+	}
+	if len(merged.SubChartFiles) != 0 {
+		t.Errorf("expected no sub-chart files when values are reused, got %d", len(merged.SubChartFiles))
+	}
+}
+
+func TestSubChartFilesErrors(t *testing.T) {
+	chart, err := loader.Load(filepath.Join("testdata", "subcharts", "umbrella"))
+	if err != nil {
+		t.Fatalf("loading chart: %s", err)
+	}
+	tests := []struct {
+		name      string
+		values    map[string]interface{}
+		valuesDir string
+		expected  string
+	}{
+		{
+			name:     "not a list",
+			values:   map[string]interface{}{"backend": map[string]interface{}{"valuesFiles": "values/backend/1-common.yaml"}},
+			expected: "\"backend.valuesFiles\" shall be a list of file names",
+		},
+		{
+			name:     "not a file name",
+			values:   map[string]interface{}{"backend": map[string]interface{}{"valuesFiles": []interface{}{1}}},
+			expected: "\"backend.valuesFiles\" shall be a list of file names, got 1",
+		},
+		{
+			name:     "missing file",
+			values:   map[string]interface{}{"web": map[string]interface{}{"valuesFiles": []interface{}{"values/missing.yaml"}}},
+			expected: "finding file \"values/missing.yaml\" referenced by \"web.valuesFiles\"",
+		},
+		{
+			name:      "missing values directory",
+			valuesDir: filepath.Join("testdata", "subcharts", "missing"),
+			expected:  "reading values directory",
+		},
+		{
+			// Values files are named after the alias of the sub-charts
+			name:      "file not named after a sub-chart",
+			valuesDir: filepath.Join("testdata", "subcharts", "invalid-values-dir"),
+			expected:  "not named \"<chart name or alias>.yaml\" (or \".yml\") after a sub-chart: frontend.yaml",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := subChartFiles(chart, test.values, test.valuesDir, util.SecretsKeys{}, false, false, nil, false, false)
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("expected error containing %q, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestValuesDirFiles(t *testing.T) {
+	chart, err := loader.Load(filepath.Join("testdata", "subcharts", "umbrella"))
+	if err != nil {
+		t.Fatalf("loading chart: %s", err)
+	}
+	// sops is replaced by a script giving the decrypted values
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "sops"), []byte("#!/bin/sh\necho 'ingress: {host: secret.example.com}'\n"), 0755); err != nil {
+		t.Fatalf("writing sops script: %s", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	valuesDir := t.TempDir()
+	writeFile := func(name string, content string) {
+		if err := os.WriteFile(filepath.Join(valuesDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("writing values file: %s", err)
+		}
+	}
+	writeFile("backend.yml", "replicas: 2\n")
+	writeFile("web.yaml", "ingress:\n  host: ENC[AES256_GCM,data:abc]\nsops:\n  mac: ENC[AES256_GCM,data:def]\n")
+
+	// ".yml" files are named after sub-charts too, and the encrypted files are decrypted
+	files, err := subChartFiles(chart, nil, valuesDir, util.SecretsKeys{}, false, false, nil, false, false)
+	if err != nil {
+		t.Fatalf("getting values files: %s", err)
+	}
+	if len(files) != 2 || files[0].Name != filepath.Join(valuesDir, "backend.yml") || files[0].Encrypted || files[1].SubChart != "web" || !files[1].Encrypted {
+		t.Fatalf("unexpected values files %+v", files)
+	}
+	if host := files[1].Values["ingress"].(map[string]interface{})["host"]; host != "secret.example.com" {
+		t.Errorf("values file not decrypted, got host %v", host)
+	}
+
+	// A sub-chart has a single values file
+	writeFile("backend.yaml", "replicas: 3\n")
+	if _, err := subChartFiles(chart, nil, valuesDir, util.SecretsKeys{}, false, false, nil, false, false); err == nil || !strings.Contains(err.Error(), "are both named after sub-chart \"backend\"") {
+		t.Errorf("expected an error for the values files of the same sub-chart, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package values
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeMaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        map[string]interface{}
+		b        map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:     "empty",
+			a:        map[string]interface{}{},
+			b:        map[string]interface{}{},
+			expected: map[string]interface{}{},
+		},
+		{
+			name:     "nil maps",
+			a:        nil,
+			b:        map[string]interface{}{"a": 1},
+			expected: map[string]interface{}{"a": 1},
+		},
+		{
+			name:     "disjoint keys",
+			a:        map[string]interface{}{"a": 1},
+			b:        map[string]interface{}{"b": 2},
+			expected: map[string]interface{}{"a": 1, "b": 2},
+		},
+		{
+			name:     "leaf overridden",
+			a:        map[string]interface{}{"a": 1, "b": "kept"},
+			b:        map[string]interface{}{"a": 2},
+			expected: map[string]interface{}{"a": 2, "b": "kept"},
+		},
+		{
+			name:     "tables merged recursively",
+			a:        map[string]interface{}{"t": map[string]interface{}{"a": 1, "u": map[string]interface{}{"x": 1, "y": 1}}},
+			b:        map[string]interface{}{"t": map[string]interface{}{"b": 2, "u": map[string]interface{}{"y": 2}}},
+			expected: map[string]interface{}{"t": map[string]interface{}{"a": 1, "b": 2, "u": map[string]interface{}{"x": 1, "y": 2}}},
+		},
+		{
+			name:     "table replaced by leaf",
+			a:        map[string]interface{}{"t": map[string]interface{}{"a": 1}},
+			b:        map[string]interface{}{"t": "leaf"},
+			expected: map[string]interface{}{"t": "leaf"},
+		},
+		{
+			name:     "leaf replaced by table",
+			a:        map[string]interface{}{"t": "leaf"},
+			b:        map[string]interface{}{"t": map[string]interface{}{"a": 1}},
+			expected: map[string]interface{}{"t": map[string]interface{}{"a": 1}},
+		},
+		{
+			name:     "lists replaced, not merged",
+			a:        map[string]interface{}{"l": []interface{}{1, 2, 3}},
+			b:        map[string]interface{}{"l": []interface{}{4}},
+			expected: map[string]interface{}{"l": []interface{}{4}},
+		},
+		{
+			// Unlike helm, a null value does not remove the key, and is kept as is
+			name:     "null value",
+			a:        map[string]interface{}{"a": 1, "t": map[string]interface{}{"b": 2}},
+			b:        map[string]interface{}{"a": nil, "t": nil},
+			expected: map[string]interface{}{"a": nil, "t": nil},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := copyMap(test.a)
+			b := copyMap(test.b)
+			merged := mergeMaps(test.a, test.b)
+			if !reflect.DeepEqual(merged, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, merged)
+			}
+			// The merged maps are not modified
+			if !reflect.DeepEqual(test.a, a) || !reflect.DeepEqual(test.b, b) {
+				t.Errorf("merged maps modified: %v, %v", test.a, test.b)
+			}
+		})
+	}
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	copied := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if table, ok := v.(map[string]interface{}); ok {
+			v = copyMap(table)
+		}
+		copied[k] = v
+	}
+	return copied
+}
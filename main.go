@@ -1,13 +1,21 @@
 package main
 
 import (
+	"errors"
 	"github.com/gemalto/helm-spray/v4/cmd"
+	"github.com/gemalto/helm-spray/v4/pkg/helmspray"
 	"os"
 )
 
+// Exit code of a spray interrupted by SIGINT or SIGTERM
+const exitInterrupted = 130
+
 func main() {
 	rootCmd := cmd.NewRootCmd()
 	if err := rootCmd.Execute(); err != nil {
+		if errors.Is(err, helmspray.ErrInterrupted) {
+			os.Exit(exitInterrupted)
+		}
 		os.Exit(1)
 	}
 }
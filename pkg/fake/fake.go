@@ -0,0 +1,460 @@
+// Package fake provides an in-memory cluster implementing the helm and kubectl clients of a spray, so that a spray can
+// be run without any cluster: the releases and their revisions are simulated, as well as the progressive readiness of
+// the workloads and the failures of the upgrades and of the tests.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/pkg/helm"
+	"github.com/gemalto/helm-spray/v4/pkg/kubectl"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"helm.sh/helm/v3/pkg/chartutil"
+	cliValues "helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/getter"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Commands recorded by the cluster
+const (
+	CommandList      = "list"
+	CommandUpgrade   = "upgrade"
+	CommandRollback  = "rollback"
+	CommandUninstall = "uninstall"
+	CommandGetValues = "get-values"
+	CommandTest      = "test"
+	CommandReady     = "ready"
+	CommandCreate    = "create"
+	CommandDelete    = "delete"
+)
+
+// Cluster is an in-memory cluster. Its exported fields configure its behavior, and shall be set before the spray.
+type Cluster struct {
+	// Version of the cluster, v1.30.0 if not set
+	ServerVersion kubectl.ServerVersion
+	// API versions served by the cluster, the default ones of helm if not set
+	APIVersions []string
+	// Manifests returned by the upgrades, by release name; a Deployment named after the release if not set
+	Manifests map[string]string
+	// Number of readiness checks of a resource failing before it becomes ready, by resource name or name pattern (never
+	// ready if negative); the resources are ready at once if not set
+	ReadyAfter map[string]int
+	// Errors returned by the upgrades, by release name, leaving a failed revision of the release
+	UpgradeErrors map[string]error
+	// Statuses returned by the upgrades, by release name; "deployed" if not set
+	UpgradeStatuses map[string]string
+	// Durations of the upgrades, by release name; an upgrade whose context is done meanwhile is killed, leaving a
+	// pending revision of the release
+	UpgradeDurations map[string]time.Duration
+	// Errors returned by the tests, by release name
+	TestErrors map[string]error
+
+	mutex    sync.Mutex
+	releases map[string][]Release
+	checks   map[string]int
+	calls    []Call
+}
+
+// Release is a revision of a release of the cluster
+type Release struct {
+	Name      string
+	Namespace string
+	Revision  int
+	Status    string
+	Values    map[string]interface{}
+}
+
+// Call is a command run on the cluster
+type Call struct {
+	Command      string
+	Kube         util.KubeConfig
+	Namespace    string
+	Release      string
+	Revision     int
+	Kind         string
+	Names        []string
+	ValueFiles   []string
+	Values       []string
+	StringValues []string
+	FileValues   []string
+	ResetValues  bool
+	ReuseValues  bool
+	Force        bool
+	DryRun       bool
+	Timeout      int
+	Manifest     string
+}
+
+// NewCluster creates an empty cluster
+func NewCluster() *Cluster {
+	return &Cluster{
+		Manifests:        make(map[string]string),
+		ReadyAfter:       make(map[string]int),
+		UpgradeErrors:    make(map[string]error),
+		UpgradeStatuses:  make(map[string]string),
+		UpgradeDurations: make(map[string]time.Duration),
+		TestErrors:       make(map[string]error),
+		releases:         make(map[string][]Release),
+		checks:           make(map[string]int),
+	}
+}
+
+// AddRelease adds a revision to a release, as if it was deployed before the spray
+func (c *Cluster) AddRelease(release Release) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if release.Status == "" {
+		release.Status = "deployed"
+	}
+	release.Values = copyValues(release.Values)
+	key := releaseKey(release.Namespace, release.Name)
+	c.releases[key] = append(c.releases[key], release)
+}
+
+// Release returns the last revision of a release
+func (c *Cluster) Release(namespace string, name string) (Release, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	revisions := c.releases[releaseKey(namespace, name)]
+	if len(revisions) == 0 {
+		return Release{}, false
+	}
+	release := revisions[len(revisions)-1]
+	release.Values = copyValues(release.Values)
+	return release, true
+}
+
+// History returns the revisions of a release, from the first one to the last one
+func (c *Cluster) History(namespace string, name string) []Release {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	history := make([]Release, 0)
+	for _, release := range c.releases[releaseKey(namespace, name)] {
+		release.Values = copyValues(release.Values)
+		history = append(history, release)
+	}
+	return history
+}
+
+// Names returns the sorted names of the releases of a namespace
+func (c *Cluster) Names(namespace string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	names := make([]string, 0)
+	for _, revisions := range c.releases {
+		if revisions[0].Namespace == namespace {
+			names = append(names, revisions[0].Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Calls returns the commands run on the cluster, in their order of execution
+func (c *Cluster) Calls() []Call {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]Call(nil), c.calls...)
+}
+
+// Upgrades returns the names of the upgraded releases, in their order of upgrade
+func (c *Cluster) Upgrades() []string {
+	upgrades := make([]string, 0)
+	for _, call := range c.Calls() {
+		if call.Command == CommandUpgrade {
+			upgrades = append(upgrades, call.Release)
+		}
+	}
+	return upgrades
+}
+
+// List returns the last revisions of the releases of a namespace
+func (c *Cluster) List(level int, kube util.KubeConfig, namespace string, debug bool) (map[string]helm.Release, error) {
+	c.record(Call{Command: CommandList, Kube: kube, Namespace: namespace})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	releases := make(map[string]helm.Release)
+	for _, revisions := range c.releases {
+		release := revisions[len(revisions)-1]
+		if release.Namespace != namespace {
+			continue
+		}
+		releases[release.Name] = helm.Release{
+			Name:      release.Name,
+			Namespace: release.Namespace,
+			Revision:  strconv.Itoa(release.Revision),
+			Status:    release.Status,
+		}
+	}
+	return releases, nil
+}
+
+// UpgradeWithValues adds a revision to a release (unless in dry-run mode), holding the values supplied by the values
+// files and the '--set*' flags, merged with the values of the previous revision when reusing values
+func (c *Cluster) UpgradeWithValues(ctx context.Context, level int, kube util.KubeConfig, namespace string, createNamespace bool, releaseName string, chartPath string, resetValues bool, reuseValues bool, valueFiles []string, valuesSet []string, valuesSetString []string, valuesSetFile []string, force bool, timeout int, dryRun bool, hideOutput bool, debug bool) (helm.UpgradedRelease, error) {
+	c.record(Call{
+		Command:      CommandUpgrade,
+		Kube:         kube,
+		Namespace:    namespace,
+		Release:      releaseName,
+		ValueFiles:   append([]string(nil), valueFiles...),
+		Values:       append([]string(nil), valuesSet...),
+		StringValues: append([]string(nil), valuesSetString...),
+		FileValues:   append([]string(nil), valuesSetFile...),
+		ResetValues:  resetValues,
+		ReuseValues:  reuseValues,
+		Force:        force,
+		DryRun:       dryRun,
+		Timeout:      timeout,
+	})
+
+	// The values files are read at once, as they are removed at the end of the spray
+	options := cliValues.Options{ValueFiles: valueFiles, Values: valuesSet, StringValues: valuesSetString, FileValues: valuesSetFile}
+	values, err := options.MergeValues(getter.Providers{})
+	if err != nil {
+		return helm.UpgradedRelease{}, err
+	}
+
+	c.mutex.Lock()
+	duration := c.UpgradeDurations[releaseName]
+	c.mutex.Unlock()
+	killed := false
+	if duration > 0 {
+		timer := time.NewTimer(duration)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			killed = true
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := releaseKey(namespace, releaseName)
+	revisions := c.releases[key]
+	release := Release{Name: releaseName, Namespace: namespace, Revision: 1, Status: "deployed"}
+	if len(revisions) > 0 {
+		previous := revisions[len(revisions)-1]
+		release.Revision = previous.Revision + 1
+		if reuseValues && !resetValues {
+			values = chartutil.CoalesceTables(values, copyValues(previous.Values))
+		}
+	}
+	release.Values = values
+	if status, ok := c.UpgradeStatuses[releaseName]; ok {
+		release.Status = status
+	}
+
+	if killed || dryRun {
+		release.Status = "pending-install"
+		if len(revisions) > 0 {
+			release.Status = "pending-upgrade"
+		}
+	}
+	if killed {
+		c.releases[key] = append(revisions, release)
+		return helm.UpgradedRelease{}, fmt.Errorf("helm upgrade killed: %w", ctx.Err())
+	}
+	if dryRun {
+		return c.upgradedRelease(release), nil
+	}
+	if err := c.UpgradeErrors[releaseName]; err != nil {
+		release.Status = "failed"
+		c.releases[key] = append(revisions, release)
+		return helm.UpgradedRelease{}, err
+	}
+	c.releases[key] = append(revisions, release)
+	return c.upgradedRelease(release), nil
+}
+
+func (c *Cluster) upgradedRelease(release Release) helm.UpgradedRelease {
+	manifest, ok := c.Manifests[release.Name]
+	if !ok {
+		manifest = fmt.Sprintf("---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: %s\n  namespace: %s\n", release.Name, release.Namespace)
+	}
+	return helm.UpgradedRelease{
+		Version:  release.Revision,
+		Info:     map[string]interface{}{"status": release.Status},
+		Manifest: manifest,
+	}
+}
+
+// Rollback adds a revision to a release, with the values of the given revision
+func (c *Cluster) Rollback(level int, kube util.KubeConfig, namespace string, releaseName string, revision int, timeout int, debug bool) error {
+	c.record(Call{Command: CommandRollback, Namespace: namespace, Release: releaseName, Revision: revision, Timeout: timeout})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := releaseKey(namespace, releaseName)
+	revisions := c.releases[key]
+	for _, release := range revisions {
+		if release.Revision == revision {
+			release.Revision = revisions[len(revisions)-1].Revision + 1
+			release.Status = "deployed"
+			release.Values = copyValues(release.Values)
+			c.releases[key] = append(revisions, release)
+			return nil
+		}
+	}
+	return fmt.Errorf("release \"%s\" has no revision %d", releaseName, revision)
+}
+
+// Uninstall removes a release
+func (c *Cluster) Uninstall(level int, kube util.KubeConfig, namespace string, releaseName string, timeout int, debug bool) error {
+	c.record(Call{Command: CommandUninstall, Namespace: namespace, Release: releaseName, Timeout: timeout})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := releaseKey(namespace, releaseName)
+	if _, ok := c.releases[key]; !ok {
+		return fmt.Errorf("release \"%s\" not found", releaseName)
+	}
+	delete(c.releases, key)
+	return nil
+}
+
+// GetValues returns the values of the last revision of a release
+func (c *Cluster) GetValues(level int, kube util.KubeConfig, namespace string, releaseName string, debug bool) (map[string]interface{}, error) {
+	c.record(Call{Command: CommandGetValues, Namespace: namespace, Release: releaseName})
+	release, ok := c.Release(namespace, releaseName)
+	if !ok {
+		return nil, fmt.Errorf("release \"%s\" not found", releaseName)
+	}
+	if release.Values == nil {
+		return make(map[string]interface{}), nil
+	}
+	return release.Values, nil
+}
+
+// Test runs the tests of a release, which fail if an error is configured for the release
+func (c *Cluster) Test(level int, kube util.KubeConfig, namespace string, releaseName string, timeout int, stream bool, debug bool) (string, error) {
+	c.record(Call{Command: CommandTest, Namespace: namespace, Release: releaseName, Timeout: timeout})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.TestErrors[releaseName]; err != nil {
+		return fmt.Sprintf("tests of release \"%s\" failed: %s\n", releaseName, err), err
+	}
+	return fmt.Sprintf("tests of release \"%s\" succeeded\n", releaseName), nil
+}
+
+func (c *Cluster) AreDeploymentsReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areReady("deployment", names, namespace), nil
+}
+
+func (c *Cluster) AreStatefulSetsReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areReady("statefulset", names, namespace), nil
+}
+
+func (c *Cluster) AreJobsReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areReady("job", names, namespace), nil
+}
+
+func (c *Cluster) AreServicesReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areReady("service", names, namespace), nil
+}
+
+func (c *Cluster) AreIngressesReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areReady("ingress", names, namespace), nil
+}
+
+func (c *Cluster) ArePersistentVolumeClaimsBound(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areReady("persistentvolumeclaim", names, namespace), nil
+}
+
+// IsJobFailed returns whether a job is failed, which is never the case
+func (c *Cluster) IsJobFailed(name string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return false, nil
+}
+
+// GetJobLogs returns the logs of a job, which are empty
+func (c *Cluster) GetJobLogs(name string, kube util.KubeConfig, namespace string) (string, error) {
+	return "", nil
+}
+
+// Create records the creation of the objects of a manifest
+func (c *Cluster) Create(manifest []byte, kube util.KubeConfig, namespace string, debug bool) error {
+	c.record(Call{Command: CommandCreate, Namespace: namespace, Manifest: string(manifest)})
+	return nil
+}
+
+// DeleteJob records the deletion of a job
+func (c *Cluster) DeleteJob(name string, kube util.KubeConfig, namespace string, debug bool) error {
+	c.record(Call{Command: CommandDelete, Namespace: namespace, Kind: "job", Names: []string{name}})
+	return nil
+}
+
+// GetAPIVersions returns the API versions served by the cluster
+func (c *Cluster) GetAPIVersions(kube util.KubeConfig, debug bool) ([]string, error) {
+	if len(c.APIVersions) > 0 {
+		return c.APIVersions, nil
+	}
+	return chartutil.DefaultVersionSet, nil
+}
+
+// GetServerVersion returns the version of the cluster
+func (c *Cluster) GetServerVersion(kube util.KubeConfig, debug bool) (kubectl.ServerVersion, error) {
+	if c.ServerVersion.GitVersion != "" {
+		return c.ServerVersion, nil
+	}
+	return kubectl.ServerVersion{Major: "1", Minor: "30", GitVersion: "v1.30.0"}, nil
+}
+
+// Resources are ready once they have been checked more than the number of times configured for them
+func (c *Cluster) areReady(kind string, names []string, namespace string) bool {
+	c.record(Call{Command: CommandReady, Namespace: namespace, Kind: kind, Names: append([]string(nil), names...)})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ready := true
+	for _, name := range names {
+		c.checks[name]++
+		for pattern, after := range c.ReadyAfter {
+			if matched, _ := path.Match(pattern, name); matched && (after < 0 || c.checks[name] <= after) {
+				ready = false
+			}
+		}
+	}
+	return ready
+}
+
+func (c *Cluster) record(call Call) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+func releaseKey(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// Deep copy of values, so that the revisions of the releases are not modified by their users
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	copied := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		copied[k] = copyValue(v)
+	}
+	return copied
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyValues(v)
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i := range v {
+			copied[i] = copyValue(v[i])
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+var _ helm.Client = &Cluster{}
+var _ kubectl.Client = &Cluster{}
@@ -0,0 +1,23 @@
+package helm
+
+import (
+	"context"
+	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+)
+
+// Client runs the helm commands of a spray. CLI runs the helm binary, other implementations (like the in-memory cluster
+// of package fake) allow a spray to be run without any cluster.
+type Client interface {
+	List(level int, kube util.KubeConfig, namespace string, debug bool) (map[string]Release, error)
+	UpgradeWithValues(ctx context.Context, level int, kube util.KubeConfig, namespace string, createNamespace bool, releaseName string, chartPath string, resetValues bool, reuseValues bool, valueFiles []string, valuesSet []string, valuesSetString []string, valuesSetFile []string, force bool, timeout int, dryRun bool, hideOutput bool, debug bool) (UpgradedRelease, error)
+	Rollback(level int, kube util.KubeConfig, namespace string, releaseName string, revision int, timeout int, debug bool) error
+	Uninstall(level int, kube util.KubeConfig, namespace string, releaseName string, timeout int, debug bool) error
+	GetValues(level int, kube util.KubeConfig, namespace string, releaseName string, debug bool) (map[string]interface{}, error)
+	Test(level int, kube util.KubeConfig, namespace string, releaseName string, timeout int, stream bool, debug bool) (string, error)
+}
+
+// CLI is the Client running the helm binary, logging through Log (to stdout and stderr when nil)
+type CLI struct {
+	Log *log.Logger
+}
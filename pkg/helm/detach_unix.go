@@ -0,0 +1,14 @@
+//go:build !windows
+
+package helm
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Run a command in its own process group, so that it does not receive the signals sent to the process group of spray
+// by the terminal (Ctrl-C)
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
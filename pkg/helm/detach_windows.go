@@ -0,0 +1,11 @@
+package helm
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Run a command in its own process group, so that it does not receive the Ctrl-C events sent to the console of spray
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
@@ -0,0 +1,397 @@
+package helm
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"golang.org/x/crypto/openpgp"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/registry"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FetchOptions ...
+type FetchOptions struct {
+	// Directory of the chart cache, defaults to the "spray/charts" directory of the helm cache
+	CacheDir string
+	// Only use the charts of the cache, without accessing the repositories
+	Offline bool
+	// Verify the provenance file of the chart against the keyring, defaults to the default GnuPG keyring
+	Verify  bool
+	Keyring string
+	// Expected digest of the chart archive, as "sha256:<hex>"
+	Digest string
+	// Location, credentials and TLS options of the repository or registry
+	Repository util.RepositoryConfig
+	// Logger of the fetch, stdout and stderr when nil
+	Log *log.Logger
+}
+
+// FetchedChart ...
+type FetchedChart struct {
+	// Path of the chart archive in the cache
+	Path string
+	// Digest of the chart archive, as "sha256:<hex>"
+	Digest    string
+	FromCache bool
+	// Identity of the signer of the chart, when its provenance has been verified
+	Signer string
+	// URL of the repository, of the chart or of the OCI registry the chart is fetched from
+	URL string
+}
+
+const digestDirPrefix = "sha256-"
+
+var invalidCacheKeyCharacters = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// Fetch fetches a chart from a repository, a URL or an OCI registry into the chart cache, and returns the chart archive.
+// Archives are stored in the cache by chart reference, version and digest: "<cache>/<reference>/<version>/sha256-<digest>/".
+// A given version of a chart (or a given digest) is taken from the cache when present, while the latest version is
+// always fetched, unless in offline mode, in which the most recent matching version of the cache is used.
+// The archive is refused if its digest does not match the expected one, or if the verification of its provenance fails.
+func Fetch(chart string, version string, options FetchOptions, debug bool) (FetchedChart, error) {
+	cacheDir := options.CacheDir
+	if cacheDir == "" {
+		cacheDir = helmpath.CachePath("spray", "charts")
+	}
+	reference := chart
+	if options.Repository.URL != "" {
+		reference = strings.TrimSuffix(options.Repository.URL, "/") + "/" + chart
+	}
+	referenceDir := filepath.Join(cacheDir, cacheKey(reference))
+	chartURL := ""
+	if strings.Contains(reference, "://") {
+		chartURL = reference
+	}
+	if options.Digest != "" && !strings.HasPrefix(options.Digest, "sha256:") {
+		return FetchedChart{}, fmt.Errorf("invalid chart digest \"%s\", expected format is \"sha256:<hex>\"", options.Digest)
+	}
+	if options.Verify && options.Keyring == "" {
+		options.Keyring = defaultKeyring()
+	}
+
+	if _, err := semver.StrictNewVersion(version); err == nil || options.Offline || options.Digest != "" {
+		cached, found, err := cachedChart(referenceDir, version, strings.ToLower(strings.TrimPrefix(options.Digest, "sha256:")))
+		if err != nil {
+			return FetchedChart{}, err
+		}
+		// Charts fetched without their provenance file are fetched again when it is needed
+		if found && (!options.Verify || hasProvenance(cached.Path) || options.Offline) {
+			if debug {
+				options.Log.Info(2, "using chart \"%s\" from cache \"%s\"", chart, cached.Path)
+			}
+			cached.URL = chartURL
+			return checkChart(cached, options)
+		}
+	}
+	if options.Offline {
+		return FetchedChart{}, fmt.Errorf("no version of chart matching \"%s\" in cache \"%s\" (offline mode)", version, cacheDir)
+	}
+
+	// The chart is fetched into a temporary directory of the cache, so that it can be moved into its final location
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return FetchedChart{}, fmt.Errorf("creating chart cache: %w", err)
+	}
+	tempDir, err := os.MkdirTemp(cacheDir, ".fetch-")
+	if err != nil {
+		return FetchedChart{}, fmt.Errorf("creating temporary directory: %w", err)
+	}
+	defer removeTempDir(tempDir, options.Log)
+
+	if err := pull(chart, version, tempDir, options, debug); err != nil {
+		return FetchedChart{}, err
+	}
+
+	archive, err := fetchedArchive(tempDir)
+	if err != nil {
+		return FetchedChart{}, err
+	}
+	digest, err := fileDigest(filepath.Join(tempDir, archive))
+	if err != nil {
+		return FetchedChart{}, err
+	}
+	// An archive not matching the expected digest is not stored into the cache; hex digits may be given in upper case
+	if options.Digest != "" && strings.ToLower(options.Digest) != strings.ToLower("sha256:"+digest) {
+		return FetchedChart{}, fmt.Errorf("digest of the fetched chart archive is \"sha256:%s\", expected \"%s\"", digest, options.Digest)
+	}
+	fetchedChart, err := loader.Load(filepath.Join(tempDir, archive))
+	if err != nil {
+		return FetchedChart{}, fmt.Errorf("loading fetched chart: %w", err)
+	}
+
+	targetDir := filepath.Join(referenceDir, fetchedChart.Metadata.Version, digestDirPrefix+digest)
+	target := filepath.Join(targetDir, archive)
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return FetchedChart{}, fmt.Errorf("creating chart cache: %w", err)
+	}
+	for _, file := range []string{archive, archive + ".prov"} {
+		if _, err := os.Stat(filepath.Join(tempDir, file)); err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(targetDir, file)); err == nil {
+			continue
+		}
+		if err := os.Rename(filepath.Join(tempDir, file), filepath.Join(targetDir, file)); err != nil {
+			return FetchedChart{}, fmt.Errorf("storing chart into cache: %w", err)
+		}
+	}
+	return checkChart(FetchedChart{Path: target, Digest: "sha256:" + digest, URL: chartURL}, options)
+}
+
+// Pull a chart into a directory as 'helm pull' does, the credentials being given in-process to the getters and to the
+// registry client
+func pull(chart string, version string, destDir string, options FetchOptions, debug bool) error {
+	settings := cli.New()
+	settings.Debug = debug
+	stderr := options.Log.Stderr()
+	defer stderr.Close()
+	registryClient, err := newRegistryClient(options.Repository, settings.RegistryConfig, stderr, debug)
+	if err != nil {
+		return fmt.Errorf("creating registry client: %w", err)
+	}
+	p := action.NewPullWithOpts(action.WithConfig(&action.Configuration{RegistryClient: registryClient}))
+	p.Settings = settings
+	p.DestDir = destDir
+	p.Version = version
+	p.Verify = options.Verify
+	p.Keyring = options.Keyring
+	p.RepoURL = options.Repository.URL
+	p.Username = options.Repository.Username
+	p.Password = options.Repository.Password
+	p.CaFile = options.Repository.CAFile
+	p.CertFile = options.Repository.CertFile
+	p.KeyFile = options.Repository.KeyFile
+	p.InsecureSkipTLSverify = options.Repository.InsecureSkipTLSVerify
+	p.PassCredentialsAll = options.Repository.PassCredentialsAll
+	if debug {
+		options.Log.Info(2, "pulling chart \"%s\" with repository options %s", chart, options.Repository)
+	}
+	out, err := p.Run(chart)
+	if debug && out != "" {
+		options.Log.Info(2, "%s", strings.TrimSpace(out))
+	}
+	return err
+}
+
+// Client of the OCI registries, using the credentials and the TLS options of the repository, or the credentials of the
+// registry configuration of helm
+func newRegistryClient(repository util.RepositoryConfig, registryConfig string, out io.Writer, debug bool) (*registry.Client, error) {
+	opts := []registry.ClientOption{
+		registry.ClientOptDebug(debug),
+		registry.ClientOptEnableCache(true),
+		registry.ClientOptWriter(out),
+		registry.ClientOptCredentialsFile(registryConfig),
+		registry.ClientOptBasicAuth(repository.Username, repository.Password),
+	}
+	if (repository.CertFile != "" && repository.KeyFile != "") || repository.CAFile != "" || repository.InsecureSkipTLSVerify {
+		tlsConfig, err := newTLSConfig(repository)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, registry.ClientOptHTTPClient(&http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		}))
+	}
+	return registry.NewClient(opts...)
+}
+
+// TLS configuration of the client certificate, the CA bundle and the verification of the certificates of the repository
+func newTLSConfig(repository util.RepositoryConfig) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: repository.InsecureSkipTLSVerify}
+	if repository.CertFile != "" && repository.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(repository.CertFile, repository.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if repository.CAFile != "" {
+		data, err := os.ReadFile(repository.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in CA file \"%s\"", repository.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// Check the digest of a chart archive, and verify its provenance file against the keyring
+func checkChart(chart FetchedChart, options FetchOptions) (FetchedChart, error) {
+	if options.Digest != "" && strings.ToLower(options.Digest) != strings.ToLower(chart.Digest) {
+		return FetchedChart{}, fmt.Errorf("digest of chart archive \"%s\" is \"%s\", expected \"%s\"", chart.Path, chart.Digest, options.Digest)
+	}
+	if !options.Verify {
+		return chart, nil
+	}
+	verification, err := downloader.VerifyChart(chart.Path, options.Keyring)
+	if err != nil {
+		return FetchedChart{}, fmt.Errorf("verifying provenance of chart archive \"%s\": %w", chart.Path, err)
+	}
+	chart.Signer = signerIdentity(verification.SignedBy)
+	return chart, nil
+}
+
+// Identities of a signing key, along with its fingerprint
+func signerIdentity(entity *openpgp.Entity) string {
+	if entity == nil {
+		return ""
+	}
+	names := make([]string, 0, len(entity.Identities))
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%s (%X)", strings.Join(names, ", "), entity.PrimaryKey.Fingerprint)
+}
+
+func hasProvenance(archive string) bool {
+	_, err := os.Stat(archive + ".prov")
+	return err == nil
+}
+
+// Default keyring used by helm for verifying charts
+func defaultKeyring() string {
+	if v, ok := os.LookupEnv("GNUPGHOME"); ok {
+		return filepath.Join(v, "pubring.gpg")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".gnupg", "pubring.gpg")
+	}
+	return filepath.Join(home, ".gnupg", "pubring.gpg")
+}
+
+// Path of the cache directory of a chart reference: a repository and a chart name, a URL or an OCI reference
+func cacheKey(chart string) string {
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(strings.Replace(chart, "://", "/", 1), "/") {
+		segment = invalidCacheKeyCharacters.ReplaceAllString(segment, "_")
+		if segment != "" && segment != "." && segment != ".." {
+			segments = append(segments, segment)
+		}
+	}
+	return filepath.Join(segments...)
+}
+
+// Find in the cache of a chart reference the most recent version matching the given version or constraint (any version
+// if empty), and the most recently fetched archive of this version, or the archive of the given digest
+func cachedChart(referenceDir string, version string, digest string) (FetchedChart, bool, error) {
+	var constraint *semver.Constraints
+	if version != "" {
+		var err error
+		if constraint, err = semver.NewConstraint(version); err != nil {
+			return FetchedChart{}, false, fmt.Errorf("invalid chart version \"%s\": %w", version, err)
+		}
+	}
+	versionDirs, err := os.ReadDir(referenceDir)
+	if os.IsNotExist(err) {
+		return FetchedChart{}, false, nil
+	} else if err != nil {
+		return FetchedChart{}, false, fmt.Errorf("reading chart cache: %w", err)
+	}
+
+	var bestVersion *semver.Version
+	var best FetchedChart
+	for _, versionDir := range versionDirs {
+		v, err := semver.NewVersion(versionDir.Name())
+		if err != nil || !versionDir.IsDir() || (constraint != nil && !constraint.Check(v) && versionDir.Name() != version) {
+			continue
+		}
+		if bestVersion != nil && !v.GreaterThan(bestVersion) {
+			continue
+		}
+		cached, found, err := latestArchive(filepath.Join(referenceDir, versionDir.Name()), digest)
+		if err != nil {
+			return FetchedChart{}, false, err
+		}
+		if found {
+			bestVersion = v
+			best = cached
+		}
+	}
+	return best, bestVersion != nil, nil
+}
+
+func latestArchive(versionDir string, digest string) (FetchedChart, bool, error) {
+	digestDirs, err := os.ReadDir(versionDir)
+	if err != nil {
+		return FetchedChart{}, false, fmt.Errorf("reading chart cache: %w", err)
+	}
+	var latest FetchedChart
+	var latestTime int64
+	for _, digestDir := range digestDirs {
+		if !digestDir.IsDir() || !strings.HasPrefix(digestDir.Name(), digestDirPrefix) || (digest != "" && digestDir.Name() != digestDirPrefix+digest) {
+			continue
+		}
+		archive, err := fetchedArchive(filepath.Join(versionDir, digestDir.Name()))
+		if err != nil {
+			continue
+		}
+		info, err := digestDir.Info()
+		if err != nil {
+			continue
+		}
+		if latest.Path == "" || info.ModTime().UnixNano() > latestTime {
+			latestTime = info.ModTime().UnixNano()
+			latest = FetchedChart{
+				Path:      filepath.Join(versionDir, digestDir.Name(), archive),
+				Digest:    "sha256:" + strings.TrimPrefix(digestDir.Name(), digestDirPrefix),
+				FromCache: true,
+			}
+		}
+	}
+	return latest, latest.Path != "", nil
+}
+
+// Name of the chart archive of a directory
+func fetchedArchive(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("reading fetched chart: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".tgz") {
+			return entry.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("no chart archive found in \"%s\"", dir)
+}
+
+// Hex encoded SHA-256 digest of a file
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("computing digest of \"%s\": %w", file, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("computing digest of \"%s\": %w", file, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func removeTempDir(tempDir string, logger *log.Logger) {
+	if err := os.RemoveAll(tempDir); err != nil {
+		logger.Error("Unable to remove temporary directory: %s", err)
+	}
+}
@@ -0,0 +1,103 @@
+package helm
+
+import (
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/repo"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Chart repository serving an "umbrella" chart, protected by basic authentication
+func newRepository(t *testing.T) (*httptest.Server, *[]string) {
+	t.Helper()
+	dir := t.TempDir()
+	archive, err := chartutil.Save(&chart.Chart{Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "umbrella", Version: "1.2.0"}}, dir)
+	if err != nil {
+		t.Fatalf("saving chart: %s", err)
+	}
+	digest, err := provenance.DigestFile(archive)
+	if err != nil {
+		t.Fatalf("computing digest: %s", err)
+	}
+	index := repo.NewIndexFile()
+	if err := index.MustAdd(&chart.Metadata{APIVersion: chart.APIVersionV2, Name: "umbrella", Version: "1.2.0"}, filepath.Base(archive), "", digest); err != nil {
+		t.Fatalf("indexing chart: %s", err)
+	}
+	if err := index.WriteFile(filepath.Join(dir, "index.yaml"), 0644); err != nil {
+		t.Fatalf("writing index: %s", err)
+	}
+
+	var mutex sync.Mutex
+	requests := make([]string, 0)
+	files := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests = append(requests, r.URL.Path)
+		mutex.Unlock()
+		if username, password, ok := r.BasicAuth(); !ok || username != "spray" || password != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestFetch(t *testing.T) {
+	// The configuration of helm is not used
+	helmHome := t.TempDir()
+	t.Setenv("HELM_REPOSITORY_CONFIG", filepath.Join(helmHome, "repositories.yaml"))
+	t.Setenv("HELM_REPOSITORY_CACHE", filepath.Join(helmHome, "repository"))
+	t.Setenv("HELM_REGISTRY_CONFIG", filepath.Join(helmHome, "registry.json"))
+
+	server, requests := newRepository(t)
+	options := FetchOptions{
+		CacheDir:   t.TempDir(),
+		Repository: util.RepositoryConfig{URL: server.URL, Username: "spray", Password: "s3cr3t"},
+	}
+	fetched, err := Fetch("umbrella", "1.2.0", options, false)
+	if err != nil {
+		t.Fatalf("fetching chart: %s", err)
+	}
+	if fetched.FromCache || !strings.HasSuffix(fetched.Path, filepath.Join("1.2.0", strings.Replace(fetched.Digest, "sha256:", digestDirPrefix, 1), "umbrella-1.2.0.tgz")) {
+		t.Errorf("unexpected fetched chart %+v", fetched)
+	}
+	if len(*requests) != 2 {
+		t.Errorf("expected the index and the archive to be requested, got %v", *requests)
+	}
+
+	// A given version is then taken from the cache
+	cached, err := Fetch("umbrella", "1.2.0", options, false)
+	if err != nil {
+		t.Fatalf("fetching cached chart: %s", err)
+	}
+	if !cached.FromCache || cached.Path != fetched.Path || len(*requests) != 2 {
+		t.Errorf("chart not taken from cache: %+v, requests %v", cached, *requests)
+	}
+
+	// The expected digest may be given with upper case hex digits, both for a cached chart and a fetched one
+	options.Digest = "sha256:" + strings.ToUpper(strings.TrimPrefix(fetched.Digest, "sha256:"))
+	if cached, err := Fetch("umbrella", "1.2.0", options, false); err != nil || !cached.FromCache {
+		t.Errorf("expected the chart of the upper case digest to be taken from cache, got %+v, %v", cached, err)
+	}
+	options.CacheDir = t.TempDir()
+	if _, err := Fetch("umbrella", "1.2.0", options, false); err != nil {
+		t.Errorf("fetching chart of upper case digest: %s", err)
+	}
+	options.Digest = ""
+
+	// The credentials are required by the repository
+	options.CacheDir = t.TempDir()
+	options.Repository.Password = "wrong"
+	if _, err := Fetch("umbrella", "1.2.0", options, false); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected an authentication error, got %v", err)
+	}
+}
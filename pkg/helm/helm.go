@@ -15,14 +15,15 @@ package helm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"github.com/gemalto/helm-spray/v4/internal/log"
-	"io/ioutil"
-	"os"
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"io"
 	"os/exec"
-	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Status struct {
@@ -31,6 +32,7 @@ type Status struct {
 }
 
 type UpgradedRelease struct {
+	Version  int                    `json:"version"`
 	Info     map[string]interface{} `json:"info"`
 	Manifest string                 `json:"manifest"`
 }
@@ -46,22 +48,26 @@ type Release struct {
 }
 
 // List ...
-func List(level int, namespace string, debug bool) (map[string]Release, error) {
+func (c CLI) List(level int, kube util.KubeConfig, namespace string, debug bool) (map[string]Release, error) {
 	// Prepare parameters...
 	var myargs = []string{"list", "--namespace", namespace, "-o", "json"}
+	myargs = append(myargs, kube.HelmArgs()...)
 
 	// Run the list command
 	if debug {
-		log.Info(level, "running helm command : %v", myargs)
+		c.Log.Info(level, "running helm command : %v", util.RedactArgs(myargs))
 	}
 	cmd := exec.Command("helm", myargs...)
+	cmd.Env = kube.HelmEnv()
 	cmdOutput := &bytes.Buffer{}
 	cmd.Stdout = cmdOutput
-	cmd.Stderr = os.Stderr
+	stderr := c.Log.Stderr()
+	cmd.Stderr = stderr
 	err := cmd.Run()
+	_ = stderr.Close()
 	output := cmdOutput.Bytes()
 	if debug {
-		log.Info(level, "helm command returned:\n%s", string(output))
+		c.Log.Info(level, "helm command returned:\n%s", string(output))
 	}
 	if err != nil {
 		return nil, err
@@ -81,10 +87,15 @@ func List(level int, namespace string, debug bool) (map[string]Release, error) {
 	return releasesMap, nil
 }
 
-// UpgradeWithValues ...
-func UpgradeWithValues(level int, namespace string, createNamespace bool, releaseName string, chartPath string, resetValues bool, reuseValues bool, valueFiles []string, valuesSet []string, valuesSetString []string, valuesSetFile []string, force bool, timeout int, dryRun bool, debug bool) (UpgradedRelease, error) {
+// Time given to a killed command to release its output
+const killDelay = 5 * time.Second
+
+// UpgradeWithValues runs helm upgrade, which is killed when the context is done. Helm does not receive the signals sent
+// to the process group of spray (like Ctrl-C), so that the upgrade is not interrupted by them.
+func (c CLI) UpgradeWithValues(ctx context.Context, level int, kube util.KubeConfig, namespace string, createNamespace bool, releaseName string, chartPath string, resetValues bool, reuseValues bool, valueFiles []string, valuesSet []string, valuesSetString []string, valuesSetFile []string, force bool, timeout int, dryRun bool, hideOutput bool, debug bool) (UpgradedRelease, error) {
 	// Prepare parameters...
 	var myargs = []string{"upgrade", "--install", releaseName, chartPath, "--namespace", namespace, "--timeout", strconv.Itoa(timeout) + "s", "-o", "json"}
+	myargs = append(myargs, kube.HelmArgs()...)
 	for _, v := range valuesSet {
 		myargs = append(myargs, "--set")
 		myargs = append(myargs, v)
@@ -119,16 +130,26 @@ func UpgradeWithValues(level int, namespace string, createNamespace bool, releas
 
 	// Run the upgrade command
 	if debug {
-		log.Info(level, "running helm command for \"%s\": %v", releaseName, myargs)
+		c.Log.Info(level, "running helm command for \"%s\": %v", releaseName, util.RedactArgs(myargs))
 	}
-	cmd := exec.Command("helm", myargs...)
+	cmd := exec.CommandContext(ctx, "helm", myargs...)
+	cmd.Env = kube.HelmEnv()
+	cmd.WaitDelay = killDelay
+	detach(cmd)
 	cmdOutput := &bytes.Buffer{}
-	cmd.Stderr = os.Stderr
+	stderr := c.Log.Stderr()
+	cmd.Stderr = stderr
 	cmd.Stdout = cmdOutput
 	err := cmd.Run()
+	_ = stderr.Close()
 	output := cmdOutput.Bytes()
 	if debug {
-		log.Info(level, "helm command for \"%s\" returned:\n%s", releaseName, string(output))
+		// The output holds the values of the release, which shall not be displayed when coming from decrypted values files
+		if hideOutput {
+			c.Log.Info(level, "helm command for \"%s\" returned (output hidden as the release holds decrypted values)", releaseName)
+		} else {
+			c.Log.Info(level, "helm command for \"%s\" returned:\n%s", releaseName, string(output))
+		}
 	}
 	if err != nil {
 		return UpgradedRelease{}, err
@@ -143,53 +164,93 @@ func UpgradeWithValues(level int, namespace string, createNamespace bool, releas
 	return upgradedRelease, nil
 }
 
-// Fetch ...
-func Fetch(chart string, version string) (string, error) {
-	tempDir, err := ioutil.TempDir("", "spray-")
-	if err != nil {
-		return "", err
-	}
-	defer removeTempDir(tempDir)
+// Rollback rolls a release back to the given revision
+func (c CLI) Rollback(level int, kube util.KubeConfig, namespace string, releaseName string, revision int, timeout int, debug bool) error {
+	var myargs = []string{"rollback", releaseName, strconv.Itoa(revision), "--namespace", namespace, "--timeout", strconv.Itoa(timeout) + "s"}
+	myargs = append(myargs, kube.HelmArgs()...)
+	return c.run(level, kube, releaseName, myargs, debug)
+}
 
-	var cmd *exec.Cmd
+// Uninstall uninstalls a release
+func (c CLI) Uninstall(level int, kube util.KubeConfig, namespace string, releaseName string, timeout int, debug bool) error {
+	var myargs = []string{"uninstall", releaseName, "--namespace", namespace, "--timeout", strconv.Itoa(timeout) + "s"}
+	myargs = append(myargs, kube.HelmArgs()...)
+	return c.run(level, kube, releaseName, myargs, debug)
+}
 
-	var args = []string{"fetch", chart, "--destination", tempDir}
-	if version != "" {
-		args = append(args, "--version", version)
+// Run a helm command on a release, which is not interrupted by the signals sent to spray
+func (c CLI) run(level int, kube util.KubeConfig, releaseName string, myargs []string, debug bool) error {
+	if debug {
+		c.Log.Info(level, "running helm command for \"%s\": %v", releaseName, util.RedactArgs(myargs))
 	}
-	cmd = exec.Command("helm", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return "", err
+	cmd := exec.Command("helm", myargs...)
+	cmd.Env = kube.HelmEnv()
+	detach(cmd)
+	cmdOutput := &bytes.Buffer{}
+	cmd.Stdout = cmdOutput
+	cmd.Stderr = cmdOutput
+	err := cmd.Run()
+	if debug {
+		c.Log.Info(level, "helm command for \"%s\" returned:\n%s", releaseName, cmdOutput.String())
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(cmdOutput.String()))
 	}
+	return nil
+}
 
-	var command string
-	var endOfLine string
-	if runtime.GOOS == "windows" {
-		command = "dir /b " + tempDir + " && copy " + tempDir + "\\* ."
-		cmd = exec.Command("cmd", "/C", command)
-		endOfLine = "\r\n"
-	} else {
-		command = "ls " + tempDir + " && cp " + tempDir + "/* ."
-		cmd = exec.Command("sh", "-c", command)
-		endOfLine = "\n"
+// GetValues returns the values supplied by the user to the current revision of a release
+func (c CLI) GetValues(level int, kube util.KubeConfig, namespace string, releaseName string, debug bool) (map[string]interface{}, error) {
+	// Prepare parameters...
+	var myargs = []string{"get", "values", releaseName, "--namespace", namespace, "-o", "json"}
+	myargs = append(myargs, kube.HelmArgs()...)
+
+	// Run the get command; the output is not logged as it may hold secrets
+	if debug {
+		c.Log.Info(level, "running helm command for \"%s\": %v", releaseName, util.RedactArgs(myargs))
 	}
+	cmd := exec.Command("helm", myargs...)
+	cmd.Env = kube.HelmEnv()
 	cmdOutput := &bytes.Buffer{}
 	cmd.Stdout = cmdOutput
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return "", err
+	stderr := c.Log.Stderr()
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	_ = stderr.Close()
+	if err != nil {
+		return nil, err
 	}
 
-	output := cmdOutput.Bytes()
-	var outputStr = string(output)
-	var result = strings.Split(outputStr, endOfLine)
-	return result[0], nil
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(cmdOutput.Bytes(), &values); err != nil {
+		return nil, err
+	}
+	return values, nil
 }
 
-func removeTempDir(tempDir string) {
-	if err := os.RemoveAll(tempDir); err != nil {
-		log.Error("Unable to remove temporary directory: %s", err)
+// Test ...
+func (c CLI) Test(level int, kube util.KubeConfig, namespace string, releaseName string, timeout int, stream bool, debug bool) (string, error) {
+	// Prepare parameters...
+	var myargs = []string{"test", releaseName, "--namespace", namespace, "--timeout", strconv.Itoa(timeout) + "s", "--logs"}
+	myargs = append(myargs, kube.HelmArgs()...)
+
+	// Run the test command, collecting its output (including the logs of the test pods) and optionally streaming it
+	if debug {
+		c.Log.Info(level, "running helm command for \"%s\": %v", releaseName, util.RedactArgs(myargs))
+	}
+	cmd := exec.Command("helm", myargs...)
+	cmd.Env = kube.HelmEnv()
+	cmdOutput := &bytes.Buffer{}
+	if stream {
+		stdout, stderr := c.Log.Stdout(), c.Log.Stderr()
+		defer stdout.Close()
+		defer stderr.Close()
+		cmd.Stdout = io.MultiWriter(stdout, cmdOutput)
+		cmd.Stderr = io.MultiWriter(stderr, cmdOutput)
+	} else {
+		cmd.Stdout = cmdOutput
+		cmd.Stderr = cmdOutput
 	}
+	err := cmd.Run()
+	return cmdOutput.String(), err
 }
@@ -0,0 +1,275 @@
+package helmspray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"os"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Policies for spraying several clusters
+const (
+	// Clusters are sprayed one after the other
+	PolicySequential = "sequential"
+	// Canary clusters are sprayed one after the other, then the other clusters are sprayed in parallel
+	PolicyRolling = "rolling"
+)
+
+// Cluster ...
+type Cluster struct {
+	Name       string   `json:"name,omitempty"`
+	Context    string   `json:"context"`
+	Kubeconfig string   `json:"kubeconfig,omitempty"`
+	Namespace  string   `json:"namespace,omitempty"`
+	Values     []string `json:"values,omitempty"`
+	Canary     bool     `json:"canary,omitempty"`
+}
+
+// ClustersConfig is the content of the file given through '--clusters-file'
+type ClustersConfig struct {
+	Policy        string    `json:"policy,omitempty"`
+	HaltOnFailure *bool     `json:"haltOnFailure,omitempty"`
+	Clusters      []Cluster `json:"clusters"`
+}
+
+// ClusterResult ...
+type ClusterResult struct {
+	Cluster  string        `json:"cluster"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	Report   *Report       `json:"report,omitempty"`
+	// Error of the spray of the cluster, kept for errors.Is (e.g. ErrInterrupted)
+	Err error `json:"-"`
+}
+
+// StatusSkipped is the status of the clusters not sprayed because of the failure of another cluster
+const StatusSkipped = "skipped"
+
+// ErrHalted is wrapped by the error of the spray of a cluster interrupted by the failure of another cluster
+var ErrHalted = errors.New("halted after the failure of another cluster")
+
+// LoadClustersConfig reads a clusters file
+func LoadClustersConfig(file string) (ClustersConfig, error) {
+	var config ClustersConfig
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return config, fmt.Errorf("reading clusters file \"%s\": %w", file, err)
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("parsing clusters file \"%s\": %w", file, err)
+	}
+	return config, nil
+}
+
+// SprayClusters sprays the umbrella chart into each of the clusters, according to the clusters policy.
+// When halting on cluster failure, the first failure of a cluster sprayed in parallel interrupts the others.
+// A combined report of all the clusters is logged at the end.
+func (s *Spray) SprayClusters() ([]ClusterResult, error) {
+	if len(s.Clusters) == 0 {
+		return nil, errors.New("no cluster to spray")
+	}
+	// Each cluster is reached through its own kube context: the options targeting a single API server cannot be shared
+	if s.Kube.APIServer != "" || s.Kube.Token != "" || s.Kube.AsUser != "" {
+		return nil, errors.New("cannot use --kube-apiserver, --kube-token or --kube-as-user (or the HELM_KUBEAPISERVER, HELM_KUBETOKEN and HELM_KUBEASUSER envvars) together with several clusters")
+	}
+	for i := range s.Clusters {
+		if s.Clusters[i].Context == "" {
+			return nil, fmt.Errorf("cluster #%d has no kube context", i)
+		}
+		if s.Clusters[i].Name == "" {
+			s.Clusters[i].Name = s.Clusters[i].Context
+		}
+	}
+	switch s.ClustersPolicy {
+	case "":
+		s.ClustersPolicy = PolicySequential
+	case PolicySequential, PolicyRolling:
+	default:
+		return nil, fmt.Errorf("invalid clusters policy \"%s\", allowed policies are \"%s\" and \"%s\"", s.ClustersPolicy, PolicySequential, PolicyRolling)
+	}
+
+	startTime := time.Now()
+	results := make([]ClusterResult, len(s.Clusters))
+	for i := range s.Clusters {
+		results[i] = ClusterResult{Cluster: s.Clusters[i].Name, Status: StatusSkipped}
+	}
+
+	// Canary clusters (all clusters for the sequential policy) are sprayed one after the other
+	// The first cluster is the canary one if none is specified with the rolling policy
+	var parallel []int
+	hasCanary := false
+	for i := range s.Clusters {
+		hasCanary = hasCanary || s.Clusters[i].Canary
+	}
+	failed := false
+	for i := range s.Clusters {
+		canary := s.Clusters[i].Canary || (!hasCanary && i == 0)
+		if s.ClustersPolicy == PolicyRolling && !canary {
+			parallel = append(parallel, i)
+			continue
+		}
+		if failed && s.HaltOnClusterFailure {
+			continue
+		}
+		results[i] = s.sprayCluster(s.ctx, s.Clusters[i])
+		failed = failed || results[i].Status == StatusFailed
+	}
+
+	// Remaining clusters are sprayed in parallel, the first failure interrupting the other clusters when halting on
+	// cluster failure
+	if len(parallel) > 0 && !(failed && s.HaltOnClusterFailure) {
+		s.logger().Info(1, "spraying clusters %v in parallel...", clusterNames(s.Clusters, parallel))
+		parent := s.ctx
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, cancel := context.WithCancel(parent)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, i := range parallel {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = s.sprayCluster(ctx, s.Clusters[i])
+				if results[i].Status == StatusFailed && s.HaltOnClusterFailure {
+					cancel()
+				}
+			}(i)
+		}
+		wg.Wait()
+		if parent.Err() == nil {
+			for _, i := range parallel {
+				if results[i].Status == StatusFailed && errors.Is(results[i].Err, ErrInterrupted) {
+					results[i] = haltedResult(results[i])
+				}
+			}
+		}
+	}
+
+	logClusterResults(s.logger(), results)
+
+	var errs []error
+	for _, result := range results {
+		if result.Status == StatusFailed {
+			errs = append(errs, fmt.Errorf("cluster \"%s\": %w", result.Cluster, result.Err))
+		}
+	}
+	if len(errs) > 0 {
+		return results, fmt.Errorf("spray failed on %d cluster(s): %w", len(errs), errors.Join(errs...))
+	}
+	s.logger().Info(1, "upgrade of solution chart \"%s\" completed on %d cluster(s) in %s", s.ChartName, len(results), util.Duration(time.Since(startTime)))
+	return results, nil
+}
+
+// Spray a cluster, its spray being interrupted when the given context is done
+func (s *Spray) sprayCluster(ctx context.Context, cluster Cluster) ClusterResult {
+	s.logger().Info(1, "spraying cluster \"%s\" (context \"%s\")...", cluster.Name, cluster.Context)
+
+	// Each cluster is processed by its own copy of the spray, targeting the cluster and using its values
+	c := *s
+	c.Clusters = nil
+	c.Kube = util.KubeConfig{Context: cluster.Context, Kubeconfig: s.Kube.Kubeconfig}
+	if cluster.Kubeconfig != "" {
+		c.Kube.Kubeconfig = cluster.Kubeconfig
+	}
+	if cluster.Namespace != "" {
+		c.Namespace = cluster.Namespace
+	}
+	c.ValuesOpts.ValueFiles = append(append([]string{}, s.ValuesOpts.ValueFiles...), cluster.Values...)
+	c.cluster = cluster.Name
+	c.ctx = ctx
+
+	startTime := time.Now()
+	err := c.Spray()
+	result := ClusterResult{
+		Cluster:  cluster.Name,
+		Status:   StatusSucceeded,
+		Duration: time.Since(startTime),
+		Report:   &c.report,
+	}
+	if err != nil {
+		s.logger().Error("Error: cluster \"%s\": %s", cluster.Name, err)
+		result.Status = StatusFailed
+		result.Error = err.Error()
+		result.Err = err
+	}
+	return result
+}
+
+// Result of a cluster whose spray has been interrupted by the failure of another cluster: skipped if none of its
+// releases has been changed, interrupted otherwise
+func haltedResult(result ClusterResult) ClusterResult {
+	result.Status = StatusSkipped
+	if result.Report != nil {
+		for _, release := range result.Report.Releases {
+			if release.Status != "pending" {
+				result.Status = StatusInterrupted
+			}
+		}
+		result.Report.Status = result.Status
+	}
+	result.Err = fmt.Errorf("%w: %w", ErrHalted, result.Err)
+	result.Error = result.Err.Error()
+	return result
+}
+
+func clusterNames(clusters []Cluster, indexes []int) []string {
+	names := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		names = append(names, clusters[i].Name)
+	}
+	return names
+}
+
+func logClusterResults(logger *log.Logger, results []ClusterResult) {
+	out := logger.Stdout()
+	defer out.Close()
+	w := tabwriter.NewWriter(out, 0, 0, 1, ' ', tabwriter.Debug)
+	_, _ = fmt.Fprintln(w, "[spray]  \t cluster\t status\t duration\t releases\t error\t")
+	_, _ = fmt.Fprintln(w, "[spray]  \t -------\t ------\t --------\t --------\t -----\t")
+	for _, result := range results {
+		duration := "-"
+		releases := "-"
+		if result.Status != StatusSkipped {
+			duration = util.Duration(result.Duration)
+		}
+		if result.Report != nil {
+			releases = fmt.Sprint(len(result.Report.Releases))
+		}
+		errorMessage := "-"
+		if result.Error != "" {
+			errorMessage = result.Error
+		}
+		_, _ = fmt.Fprintf(w, "[spray]  \t %s\t %s\t %s\t %s\t %s\t\n", result.Cluster, result.Status, duration, releases, errorMessage)
+	}
+	_ = w.Flush()
+}
+
+// ValuesForClusters parses "<cluster>=<file>" specifications of values files per cluster
+func ValuesForClusters(clusters []Cluster, specs []string) ([]Cluster, error) {
+	for _, spec := range specs {
+		name, file, found := strings.Cut(spec, "=")
+		if !found || name == "" || file == "" {
+			return nil, fmt.Errorf("invalid cluster values \"%s\", expected format is \"<cluster>=<values file>\"", spec)
+		}
+		matched := false
+		for i := range clusters {
+			if clusters[i].Name == name || clusters[i].Context == name {
+				clusters[i].Values = append(clusters[i].Values, file)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("invalid cluster values \"%s\", unknown cluster \"%s\"", spec, name)
+		}
+	}
+	return clusters, nil
+}
@@ -0,0 +1,215 @@
+package helmspray
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/dependencies"
+	"github.com/gemalto/helm-spray/v4/internal/values"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	cliValues "helm.sh/helm/v3/pkg/cli/values"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ExplainValues writes the provenance of the values given to the release of a sub-chart, at or under the given path of
+// the values of the sub-chart (all the values of the sub-chart if the path is empty). For each leaf value, the winning
+// source (file and line, '#!' directive, flag...) is given, followed by the overridden ones.
+// The values are computed as for a spray: default values of the sub-chart, processed values of the umbrella chart,
+// values of the current revision of the release with '--reuse-values', values files of the sub-charts, values files and
+// '--set*' flags.
+func (s *Spray) ExplainValues(w io.Writer, subChart string, valuePath string) error {
+	defer s.removeTempDir()
+
+	_, deps, _, err := s.prepare()
+	if err != nil {
+		return err
+	}
+	for _, file := range s.valuesOpts.ValueFiles {
+		if file == "-" {
+			return errors.New("values cannot be read from stdin when explaining the values")
+		}
+	}
+	var dependency *dependencies.Dependency
+	usedNames := make([]string, 0, len(deps))
+	for i := range deps {
+		if deps[i].UsedName == subChart {
+			dependency = &deps[i]
+		}
+		usedNames = append(usedNames, deps[i].UsedName)
+	}
+	if dependency == nil {
+		return fmt.Errorf("unknown sub-chart \"%s\", the sub-charts of the umbrella chart are: %s", subChart, strings.Join(usedNames, ", "))
+	}
+
+	layers, err := s.valuesLayers(*dependency, deps)
+	if err != nil {
+		return err
+	}
+
+	explainedPath := dependency.UsedName
+	if valuePath != "" {
+		explainedPath = explainedPath + "." + valuePath
+	}
+	provenances, err := values.Explain(layers, explainedPath)
+	if err != nil {
+		return fmt.Errorf("explaining values of release \"%s\": %w", dependency.CorrespondingReleaseName, err)
+	}
+
+	var sb strings.Builder
+	for _, provenance := range provenances {
+		sb.WriteString(fmt.Sprintf("%s: %s\n", provenance.Path, formatValue(provenance.Value)))
+		for i := len(provenance.Contributions) - 1; i >= 0; i-- {
+			contribution := provenance.Contributions[i]
+			if i == len(provenance.Contributions)-1 {
+				sb.WriteString(fmt.Sprintf("  from       %s\n", contribution.Location))
+				continue
+			}
+			overridden := formatValue(contribution.Value)
+			if contribution.Path != provenance.Path {
+				overridden = fmt.Sprintf("%s: %s", contribution.Path, overridden)
+			}
+			sb.WriteString(fmt.Sprintf("  overrides  %s: %s\n", contribution.Location, overridden))
+		}
+	}
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// Compute the layers of the values given to the release of a dependency, in the order they are merged by helm
+func (s *Spray) valuesLayers(dependency dependencies.Dependency, deps []dependencies.Dependency) ([]values.Layer, error) {
+	umbrella, err := loader.Load(s.ChartName)
+	if err != nil {
+		return nil, fmt.Errorf("loading chart \"%s\": %w", s.ChartName, err)
+	}
+	layers := make([]values.Layer, 0)
+
+	// Default values of the sub-chart, and of the umbrella chart when its values are not processed (with '--reuse-values')
+	for _, subChart := range umbrella.Dependencies() {
+		if subChart.Name() != dependency.Name {
+			continue
+		}
+		if data := valuesFileOf(subChart); data != nil {
+			layer, err := values.FileLayer(path.Join("charts", dependency.Name, chartutil.ValuesfileName), data, nil, dependency.UsedName)
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, layer)
+		}
+	}
+	if data := valuesFileOf(umbrella); data != nil && s.ReuseValues {
+		layer, err := values.FileLayer(chartutil.ValuesfileName, data, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+
+	// Values of the current revision of the release
+	if s.ReuseValues && !s.ResetValues {
+		releases, err := s.helmClient().List(1, s.Kube, s.Namespace, s.Debug)
+		if err != nil {
+			s.logger().Info(1, "warning: cannot list the releases, the values of their current revision are not given: %s", err)
+		}
+		if _, ok := releases[dependency.CorrespondingReleaseName]; ok {
+			currentValues, err := s.helmClient().GetValues(1, s.Kube, s.Namespace, dependency.CorrespondingReleaseName, s.Debug)
+			if err != nil {
+				return nil, fmt.Errorf("getting values of the current revision of release \"%s\": %w", dependency.CorrespondingReleaseName, err)
+			}
+			layers = append(layers, values.Layer{Source: fmt.Sprintf("current revision of release \"%s\"", dependency.CorrespondingReleaseName), Values: currentValues})
+		}
+	}
+
+	// Values files, including the processed values of the umbrella chart and the values files of the sub-charts
+	for _, file := range s.valuesOpts.ValueFiles {
+		processed, ok := s.processedValuesFiles[file]
+		if !ok {
+			processed = processedValuesFile{name: file}
+		}
+		if processed.subChart != "" {
+			layer, err := values.FileLayer(processed.name, []byte(processed.content), processed.lines, processed.subChart)
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, layer)
+			continue
+		}
+		if strings.Contains(file, "://") {
+			layer, err := s.flagLayer(processed.name, cliValues.Options{ValueFiles: []string{file}})
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, layer)
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading values file \"%s\": %w", processed.name, err)
+		}
+		layer, err := values.FileLayer(processed.name, data, processed.lines, "")
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+
+	// Flags, the last '--set' being the "<dependency>.enabled" flags of the spray
+	valuesSet := s.valuesSet(dependency, deps)
+	for i, value := range valuesSet {
+		source := "--set " + value
+		if i == len(valuesSet)-1 {
+			source = "\"<chart name or alias>.enabled\" flags of the spray"
+		}
+		layer, err := s.flagLayer(source, cliValues.Options{Values: []string{value}})
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	for _, value := range s.valuesOpts.StringValues {
+		layer, err := s.flagLayer("--set-string "+value, cliValues.Options{StringValues: []string{value}})
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	for _, value := range s.valuesOpts.FileValues {
+		layer, err := s.flagLayer("--set-file "+value, cliValues.Options{FileValues: []string{value}})
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// Layer of the values given by a flag, read as helm does
+func (s *Spray) flagLayer(source string, opts cliValues.Options) (values.Layer, error) {
+	flagValues, err := values.Provided(&opts, s.getterOptions())
+	if err != nil {
+		return values.Layer{}, fmt.Errorf("reading values of %s: %w", source, err)
+	}
+	return values.Layer{Source: source, Values: flagValues}, nil
+}
+
+// Content of the default values file of a chart, or nil
+func valuesFileOf(c *chart.Chart) []byte {
+	for _, f := range c.Raw {
+		if f.Name == chartutil.ValuesfileName {
+			return f.Data
+		}
+	}
+	return nil
+}
+
+func formatValue(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
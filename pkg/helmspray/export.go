@@ -0,0 +1,205 @@
+package helmspray
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/dependencies"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"strconv"
+)
+
+// Formats of the GitOps manifests generated by the export command
+const (
+	ExportArgoCD = "argocd"
+	ExportFlux   = "flux"
+)
+
+// ExportOptions describe how the releases are deployed by the GitOps tool
+type ExportOptions struct {
+	Format string
+	// Location of the umbrella chart: a Helm repository URL and a chart name, or a Git repository URL and a path
+	RepoURL  string
+	Chart    string
+	Path     string
+	Revision string
+	// Argo CD specific options
+	Project           string
+	ArgoCDNamespace   string
+	DestinationServer string
+	// Flux specific options
+	SourceKind string
+	SourceName string
+	Interval   string
+}
+
+// Export generates, for each targeted release, the GitOps object deploying it with the values that a spray would give
+// it: an Argo CD Application whose sync-wave is the weight of the release, or a Flux HelmRelease depending on the
+// releases of the previous weight. The objects are written into the output directory, one file per release.
+func (s *Spray) Export() ([]string, error) {
+	defer s.removeTempDir()
+
+	switch s.GitOps.Format {
+	case ExportArgoCD, ExportFlux:
+	default:
+		return nil, fmt.Errorf("invalid export format \"%s\", allowed formats are \"%s\" and \"%s\"", s.GitOps.Format, ExportArgoCD, ExportFlux)
+	}
+
+	if s.GitOps.Format == ExportArgoCD && s.GitOps.RepoURL == "" {
+		return nil, errors.New("the URL of the repository of the chart is required by Argo CD applications")
+	}
+	if s.GitOps.Format == ExportFlux && s.GitOps.SourceName == "" {
+		return nil, errors.New("the name of the source of the chart is required by Flux helm releases")
+	}
+
+	chart, err := loader.Load(s.ChartName)
+	if err != nil {
+		return nil, fmt.Errorf("loading chart \"%s\": %w", s.ChartName, err)
+	}
+	if s.GitOps.Chart == "" && s.GitOps.Path == "" {
+		s.GitOps.Chart = chart.Metadata.Name
+	}
+	if s.GitOps.Revision == "" && s.GitOps.Path == "" {
+		s.GitOps.Revision = chart.Metadata.Version
+	}
+
+	_, deps, _, err := s.prepare()
+	if err != nil {
+		return nil, err
+	}
+	err = checkTargetsAndExcludes(deps, s.Targets, s.Excludes)
+	if err != nil {
+		return nil, fmt.Errorf("checking targets and excludes: %w", err)
+	}
+	for _, file := range s.valuesOpts.ValueFiles {
+		if file == "-" {
+			return nil, errors.New("values cannot be read from stdin when exporting the releases")
+		}
+	}
+	// The values are written in clear into the exported objects
+	if s.hasDecryptedValues {
+		return nil, errors.New("values of encrypted values files cannot be exported")
+	}
+
+	s.logger().Info(1, "exporting solution chart \"%s\" as %s objects into directory \"%s\"...", s.ChartName, s.GitOps.Format, s.OutputDir)
+	if err := os.MkdirAll(s.OutputDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating output directory: %w", err)
+	}
+
+	files := make([]string, 0)
+	var previousWeight []string
+	var currentWeight []string
+	weight := -1
+	for _, dependency := range targetedInOrder(deps) {
+		if dependency.Weight != weight {
+			weight = dependency.Weight
+			if len(currentWeight) > 0 {
+				previousWeight = currentWeight
+			}
+			currentWeight = nil
+		}
+		currentWeight = append(currentWeight, dependency.CorrespondingReleaseName)
+
+		releaseValues, err := s.releaseValues(nil, dependency, deps)
+		if err != nil {
+			return files, fmt.Errorf("computing values of release \"%s\": %w", dependency.CorrespondingReleaseName, err)
+		}
+		var object map[string]interface{}
+		if s.GitOps.Format == ExportArgoCD {
+			object = s.argoCDApplication(dependency, releaseValues)
+		} else {
+			object = s.fluxHelmRelease(dependency, releaseValues, previousWeight)
+		}
+		data, err := yaml.Marshal(object)
+		if err != nil {
+			return files, fmt.Errorf("generating object of release \"%s\": %w", dependency.CorrespondingReleaseName, err)
+		}
+		file := filepath.Join(s.OutputDir, dependency.CorrespondingReleaseName+".yaml")
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			return files, fmt.Errorf("writing object of release \"%s\": %w", dependency.CorrespondingReleaseName, err)
+		}
+		if s.Verbose {
+			s.logger().Info(2, "release \"%s\" (weight %d) exported into \"%s\"", dependency.CorrespondingReleaseName, dependency.Weight, file)
+		}
+		files = append(files, file)
+	}
+
+	s.logger().Info(1, "%d release(s) of solution chart \"%s\" exported", len(files), s.ChartName)
+	return files, nil
+}
+
+func (s *Spray) argoCDApplication(dependency dependencies.Dependency, releaseValues map[string]interface{}) map[string]interface{} {
+	source := map[string]interface{}{
+		"repoURL":        s.GitOps.RepoURL,
+		"targetRevision": s.GitOps.Revision,
+		"helm": map[string]interface{}{
+			"releaseName":  dependency.CorrespondingReleaseName,
+			"valuesObject": releaseValues,
+		},
+	}
+	if s.GitOps.Path != "" {
+		source["path"] = s.GitOps.Path
+	} else {
+		source["chart"] = s.GitOps.Chart
+	}
+	return map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Application",
+		"metadata": map[string]interface{}{
+			"name":      dependency.CorrespondingReleaseName,
+			"namespace": s.GitOps.ArgoCDNamespace,
+			"annotations": map[string]interface{}{
+				"argocd.argoproj.io/sync-wave": strconv.Itoa(dependency.Weight),
+			},
+		},
+		"spec": map[string]interface{}{
+			"project": s.GitOps.Project,
+			"source":  source,
+			"destination": map[string]interface{}{
+				"server":    s.GitOps.DestinationServer,
+				"namespace": s.Namespace,
+			},
+		},
+	}
+}
+
+func (s *Spray) fluxHelmRelease(dependency dependencies.Dependency, releaseValues map[string]interface{}, dependsOn []string) map[string]interface{} {
+	chartSpec := map[string]interface{}{
+		"sourceRef": map[string]interface{}{
+			"kind": s.GitOps.SourceKind,
+			"name": s.GitOps.SourceName,
+		},
+	}
+	if s.GitOps.Path != "" {
+		chartSpec["chart"] = s.GitOps.Path
+	} else {
+		chartSpec["chart"] = s.GitOps.Chart
+		chartSpec["version"] = s.GitOps.Revision
+	}
+	spec := map[string]interface{}{
+		"interval":    s.GitOps.Interval,
+		"releaseName": dependency.CorrespondingReleaseName,
+		"chart": map[string]interface{}{
+			"spec": chartSpec,
+		},
+		"values": releaseValues,
+	}
+	if len(dependsOn) > 0 {
+		references := make([]map[string]interface{}, 0, len(dependsOn))
+		for _, name := range dependsOn {
+			references = append(references, map[string]interface{}{"name": name})
+		}
+		spec["dependsOn"] = references
+	}
+	return map[string]interface{}{
+		"apiVersion": "helm.toolkit.fluxcd.io/v2",
+		"kind":       "HelmRelease",
+		"metadata": map[string]interface{}{
+			"name":      dependency.CorrespondingReleaseName,
+			"namespace": s.Namespace,
+		},
+		"spec": spec,
+	}
+}
@@ -0,0 +1,186 @@
+package helmspray
+
+import (
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/dependencies"
+	"github.com/gemalto/helm-spray/v4/pkg/helm"
+	"io"
+	"strings"
+)
+
+// Formats of the dependency graph generated by the graph command
+const (
+	GraphDOT     = "dot"
+	GraphMermaid = "mermaid"
+	GraphASCII   = "ascii"
+)
+
+type graphNode struct {
+	dependency dependencies.Dependency
+	details    []string
+}
+
+type graphLayer struct {
+	weight int
+	nodes  []graphNode
+}
+
+// Graph writes the deployment order of the sub-charts of the umbrella chart: the sub-charts are grouped into layers
+// by weight, each layer being deployed after the previous one. Each sub-chart is annotated with its alias, tags,
+// targeted state, app version and corresponding release, plus the status of the release if the cluster is reachable.
+func (s *Spray) Graph(w io.Writer) error {
+	defer s.removeTempDir()
+
+	var printer func(w io.Writer, chart string, layers []graphLayer) error
+	switch s.GraphFormat {
+	case GraphDOT:
+		printer = printDOT
+	case GraphMermaid:
+		printer = printMermaid
+	case GraphASCII:
+		printer = printASCII
+	default:
+		return fmt.Errorf("invalid graph format \"%s\", allowed formats are \"%s\", \"%s\" and \"%s\"", s.GraphFormat, GraphDOT, GraphMermaid, GraphASCII)
+	}
+
+	_, deps, _, err := s.prepare()
+	if err != nil {
+		return err
+	}
+	err = checkTargetsAndExcludes(deps, s.Targets, s.Excludes)
+	if err != nil {
+		return fmt.Errorf("checking targets and excludes: %w", err)
+	}
+
+	// The status of the releases is only given when the cluster is reachable
+	releases, err := s.helmClient().List(1, s.Kube, s.Namespace, s.Debug)
+	if err != nil {
+		s.logger().Info(1, "warning: cannot list the releases, their status is not given: %s", err)
+		releases = nil
+	}
+
+	layers := make([]graphLayer, 0)
+	for weight := 0; weight <= maxWeight(deps); weight++ {
+		layer := graphLayer{weight: weight}
+		for _, dependency := range deps {
+			if dependency.Weight == weight {
+				layer.nodes = append(layer.nodes, graphNode{dependency: dependency, details: nodeDetails(dependency, releases)})
+			}
+		}
+		if len(layer.nodes) > 0 {
+			layers = append(layers, layer)
+		}
+	}
+	return printer(w, s.ChartName, layers)
+}
+
+func nodeDetails(dependency dependencies.Dependency, releases map[string]helm.Release) []string {
+	details := make([]string, 0)
+	if dependency.Alias != "" {
+		details = append(details, "alias of "+dependency.Name)
+	}
+	if dependency.HasTags {
+		match := "no tag match"
+		if dependency.AllowedByTags {
+			match = "tag match"
+		}
+		details = append(details, fmt.Sprintf("tags: %s (%s)", strings.Join(dependency.Tags, ", "), match))
+	}
+	if isTargeted(dependency) {
+		details = append(details, "targeted")
+	} else {
+		details = append(details, "not targeted")
+	}
+	if dependency.AppVersion != "" {
+		details = append(details, "appVersion: "+dependency.AppVersion)
+	}
+	details = append(details, "release: "+dependency.CorrespondingReleaseName)
+	if releases != nil {
+		if release, ok := releases[dependency.CorrespondingReleaseName]; ok {
+			details = append(details, fmt.Sprintf("status: %s (revision %s)", release.Status, release.Revision))
+		} else {
+			details = append(details, "status: not deployed")
+		}
+	}
+	return details
+}
+
+func isTargeted(dependency dependencies.Dependency) bool {
+	return dependency.Targeted && dependency.AllowedByTags
+}
+
+func printDOT(w io.Writer, chart string, layers []graphLayer) error {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("digraph %q {\n", chart))
+	sb.WriteString("  rankdir=LR;\n  compound=true;\n  node [shape=box];\n")
+	for _, layer := range layers {
+		sb.WriteString(fmt.Sprintf("  subgraph \"cluster_weight_%d\" {\n", layer.weight))
+		sb.WriteString(fmt.Sprintf("    label=\"weight %d\";\n", layer.weight))
+		for _, node := range layer.nodes {
+			style := ""
+			if !isTargeted(node.dependency) {
+				style = ", style=dashed"
+			}
+			label := strings.Join(append([]string{node.dependency.UsedName}, node.details...), "\n")
+			sb.WriteString(fmt.Sprintf("    %q [label=%q%s];\n", node.dependency.UsedName, label, style))
+		}
+		sb.WriteString("  }\n")
+	}
+	// Layers are linked through their first node
+	for i := 1; i < len(layers); i++ {
+		sb.WriteString(fmt.Sprintf("  %q -> %q [ltail=\"cluster_weight_%d\", lhead=\"cluster_weight_%d\"];\n",
+			layers[i-1].nodes[0].dependency.UsedName, layers[i].nodes[0].dependency.UsedName, layers[i-1].weight, layers[i].weight))
+	}
+	sb.WriteString("}\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func printMermaid(w io.Writer, chart string, layers []graphLayer) error {
+	var sb strings.Builder
+	sb.WriteString("flowchart LR\n")
+	untargeted := make([]string, 0)
+	id := 0
+	for _, layer := range layers {
+		sb.WriteString(fmt.Sprintf("  subgraph weight_%d[\"weight %d\"]\n", layer.weight, layer.weight))
+		for _, node := range layer.nodes {
+			nodeID := fmt.Sprintf("n%d", id)
+			id++
+			label := strings.Join(append([]string{"<b>" + node.dependency.UsedName + "</b>"}, node.details...), "<br/>")
+			sb.WriteString(fmt.Sprintf("    %s[\"%s\"]\n", nodeID, strings.ReplaceAll(label, "\"", "#quot;")))
+			if !isTargeted(node.dependency) {
+				untargeted = append(untargeted, nodeID)
+			}
+		}
+		sb.WriteString("  end\n")
+	}
+	for i := 1; i < len(layers); i++ {
+		sb.WriteString(fmt.Sprintf("  weight_%d --> weight_%d\n", layers[i-1].weight, layers[i].weight))
+	}
+	if len(untargeted) > 0 {
+		sb.WriteString("  classDef untargeted stroke-dasharray: 5 5\n")
+		sb.WriteString(fmt.Sprintf("  class %s untargeted\n", strings.Join(untargeted, ",")))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func printASCII(w io.Writer, chart string, layers []graphLayer) error {
+	var sb strings.Builder
+	sb.WriteString(chart + "\n")
+	for i, layer := range layers {
+		if i > 0 {
+			sb.WriteString("  |\n  v\n")
+		}
+		sb.WriteString(fmt.Sprintf("weight %d\n", layer.weight))
+		for j, node := range layer.nodes {
+			branch := "├─"
+			if j == len(layer.nodes)-1 {
+				branch = "└─"
+			}
+			sb.WriteString(fmt.Sprintf("  %s %s (%s)\n", branch, node.dependency.UsedName, strings.Join(node.details, ", ")))
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -1,21 +1,29 @@
 package helmspray
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/gemalto/helm-spray/v4/internal/dependencies"
+	"github.com/gemalto/helm-spray/v4/internal/hooks"
 	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/internal/secrets"
 	"github.com/gemalto/helm-spray/v4/internal/values"
 	"github.com/gemalto/helm-spray/v4/pkg/helm"
 	"github.com/gemalto/helm-spray/v4/pkg/kubectl"
+	"github.com/gemalto/helm-spray/v4/pkg/notify"
 	"github.com/gemalto/helm-spray/v4/pkg/util"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 	cliValues "helm.sh/helm/v3/pkg/cli/values"
-	"io/ioutil"
+	"helm.sh/helm/v3/pkg/getter"
 	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 	"os"
+	"sigs.k8s.io/yaml"
 	"strconv"
 	"strings"
 	"text/tabwriter"
@@ -25,67 +33,322 @@ import (
 type Spray struct {
 	ChartName                   string
 	ChartVersion                string
+	ChartFetch                  helm.FetchOptions
+	FetchedChart                helm.FetchedChart
 	Targets                     []string
 	Excludes                    []string
 	Namespace                   string
+	Kube                        util.KubeConfig
 	CreateNamespace             bool
 	PrefixReleases              string
 	PrefixReleasesWithNamespace bool
 	ResetValues                 bool
 	ReuseValues                 bool
 	ValuesOpts                  cliValues.Options
+	ValuesDir                   string
+	Interpolate                 bool
+	StrictEnv                   bool
+	SecretsKeys                 util.SecretsKeys
 	Force                       bool
+	SkipPreflight               bool
+	SkipSchemaValidation        bool
+	KnownKinds                  []string
 	Timeout                     int
+	GracePeriod                 int
+	WaitFor                     []string
+	RunTests                    bool
+	HooksFile                   string
+	NotifyWebhooks              []string
+	NotifyTemplate              string
+	NotifyRetries               int
+	NotifyTimeout               int
+	Clusters                    []Cluster
+	ClustersPolicy              string
+	HaltOnClusterFailure        bool
 	DryRun                      bool
+	OutputDir                   string
+	KubeVersion                 string
+	APIVersions                 []string
+	GitOps                      ExportOptions
+	GraphFormat                 string
+	EventSink                   EventSink
+	Helm                        helm.Client
+	Kubectl                     kubectl.Client
+	Logger                      Logger
 	Verbose                     bool
 	Debug                       bool
+	ctx                         context.Context
+	sleepFunc                   func(duration time.Duration)
 	deployments                 []string
 	statefulSets                []string
 	jobs                        []string
+	services                    []string
+	ingresses                   []string
+	persistentVolumeClaims      []string
+	releasesToTest              []string
+	hooks                       []hooks.Hook
+	notifier                    *notify.Webhook
+	report                      Report
+	cluster                     string
+	tempDir                     string
+	hasDecryptedValues          bool
+	// Values options given to helm, with the values files processed by the spray in place of the original ones: the
+	// options of the caller are left untouched, so that the spray can be run again
+	valuesOpts           cliValues.Options
+	processedValuesFiles map[string]processedValuesFile
+}
+
+// Values file written into the temporary directory of the spray in place of an original values file (processed,
+// decrypted or downloaded), or holding the processed values of the umbrella chart
+type processedValuesFile struct {
+	// Name of the original file
+	name string
+	// Origin of the lines of the file, in the original file, if its directives have been processed
+	lines []values.LineOrigin
+	// For the values files of the sub-charts: the sub-chart under which the values are set, and the original values
+	subChart string
+	content  string
+}
+
+// Kinds of resources, in addition to Deployments, StatefulSets and Jobs, that can be waited for using '--wait-for'
+const (
+	WaitForServices               = "service"
+	WaitForIngresses              = "ingress"
+	WaitForPersistentVolumeClaims = "pvc"
+)
+
+var waitForAliases = map[string]string{
+	"service":                WaitForServices,
+	"services":               WaitForServices,
+	"svc":                    WaitForServices,
+	"ingress":                WaitForIngresses,
+	"ingresses":              WaitForIngresses,
+	"ing":                    WaitForIngresses,
+	"pvc":                    WaitForPersistentVolumeClaims,
+	"pvcs":                   WaitForPersistentVolumeClaims,
+	"persistentvolumeclaim":  WaitForPersistentVolumeClaims,
+	"persistentvolumeclaims": WaitForPersistentVolumeClaims,
 }
 
 // Spray ...
 func (s *Spray) Spray() error {
 
 	if s.Debug {
-		log.Info(1, "starting spray with flags: %+v", s)
+		s.logger().Info(1, "starting spray with flags: %+v", s)
 	}
 
 	startTime := time.Now()
 
+	waitFor, err := normalizeWaitFor(s.WaitFor)
+	if err != nil {
+		return err
+	}
+	s.WaitFor = waitFor
+
+	defer s.removeTempDir()
+
+	if err := s.interrupted(); err != nil {
+		return err
+	}
+
+	mergedValues, deps, releasePrefix, err := s.prepare()
+	if err != nil {
+		return err
+	}
+
+	// Starting the processing...
+	if len(releasePrefix) > 0 {
+		s.logger().Info(1, "deploying solution chart \"%s\" in namespace \"%s\", with releases releasePrefix \"%s-\"", s.ChartName, s.Namespace, releasePrefix)
+	} else {
+		s.logger().Info(1, "deploying solution chart \"%s\" in namespace \"%s\"", s.ChartName, s.Namespace)
+	}
+
+	releases, err := s.helmClient().List(1, s.Kube, s.Namespace, s.Debug)
+	if err != nil {
+		return fmt.Errorf("listing releases: %w", err)
+	}
+
+	if s.Verbose {
+		logRelease(s.logger(), releases, deps)
+	}
+
+	err = checkTargetsAndExcludes(deps, s.Targets, s.Excludes)
+	if err != nil {
+		return fmt.Errorf("checking targets and excludes: %w", err)
+	}
+
+	hooksList, err := hooks.Get(mergedValues, s.HooksFile, s.Timeout)
+	if err != nil {
+		return fmt.Errorf("analyzing hooks: %w", err)
+	}
+	s.hooks = hooksList
+
+	if len(s.NotifyWebhooks) > 0 {
+		s.notifier, err = notify.NewWebhook(s.NotifyWebhooks, s.NotifyTemplate, s.NotifyRetries, s.NotifyTimeout)
+		if err != nil {
+			return fmt.Errorf("configuring notifications: %w", err)
+		}
+	}
+
+	s.report = Report{
+		Cluster:     s.cluster,
+		Chart:       s.ChartName,
+		ChartDigest: s.FetchedChart.Digest,
+		ChartSigner: s.FetchedChart.Signer,
+		Namespace:   s.Namespace,
+		StartTime:   startTime,
+		Status:      StatusInProgress,
+		Releases:    make([]ReleaseResult, 0),
+	}
+	for _, dependency := range deps {
+		if dependency.Targeted && dependency.AllowedByTags {
+			s.report.Releases = append(s.report.Releases, ReleaseResult{
+				Name:       dependency.CorrespondingReleaseName,
+				SubChart:   dependency.UsedName,
+				Weight:     dependency.Weight,
+				AppVersion: dependency.AppVersion,
+				Status:     "pending",
+			})
+		}
+	}
+	s.notify(notify.SprayStarted, nil)
+
+	// Nothing is changed in the cluster if the pre-flight checks fail
+	err = s.preflight(releases, deps)
+	if err == nil {
+		err = s.runHooks(hooks.PreSpray, 0, releasesOfWeight(deps, -1), nil)
+	}
+	if err == nil {
+		err = s.processWeights(releases, deps)
+	}
+
+	// Post-spray hooks are run whatever the result of the spray
+	hooksErr := s.runHooks(hooks.PostSpray, 0, releasesOfWeight(deps, -1), err)
+	if err == nil {
+		err = hooksErr
+	}
+
+	s.report.Duration = time.Since(startTime)
+	if err != nil {
+		s.report.Status = StatusFailed
+		if errors.Is(err, ErrInterrupted) {
+			s.report.Status = StatusInterrupted
+			s.logProgress()
+		}
+		s.report.Error = err.Error()
+		s.notify(notify.SprayFailed, nil)
+		return err
+	}
+	s.report.Status = StatusSucceeded
+	s.notify(notify.SprayCompleted, nil)
+
+	s.logger().Info(1, "upgrade of solution chart \"%s\" completed in %s", s.ChartName, util.Duration(time.Since(startTime)))
+
+	return nil
+}
+
+// Load the umbrella chart, process the values files and analyze the dependencies. Returns the merged values, the
+// dependencies and the prefix of the releases.
+// The processed values files are written into the temporary directory of the spray, which shall be removed by the caller.
+func (s *Spray) prepare() (chartutil.Values, []dependencies.Dependency, string, error) {
 	// Load and validate the umbrella chart...
 	chart, err := loader.Load(s.ChartName)
 	if err != nil {
-		return fmt.Errorf("loading chart \"%s\": %w", s.ChartName, err)
+		return nil, nil, "", fmt.Errorf("loading chart \"%s\": %w", s.ChartName, err)
+	}
+
+	s.valuesOpts = s.ValuesOpts
+	s.valuesOpts.ValueFiles = append([]string(nil), s.ValuesOpts.ValueFiles...)
+	s.processedValuesFiles = make(map[string]processedValuesFile)
+
+	// Decrypt the encrypted values files and process the '#!' clauses of the local values files given through '--values'/'-f'
+	for i, file := range s.valuesOpts.ValueFiles {
+		if strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://") {
+			// Remote values files are downloaded once, with the credentials and TLS options of the repository
+			if s.Verbose {
+				s.logger().Info(1, "downloading values file \"%s\"...", file)
+			}
+			content, err := values.Download(file, s.getterOptions())
+			if err != nil {
+				return nil, nil, "", fmt.Errorf("downloading values file \"%s\": %w", file, err)
+			}
+			tempFile, err := s.writeTempFile("remoteValues-*.yaml", string(content))
+			if err != nil {
+				return nil, nil, "", fmt.Errorf("writing values file \"%s\": %w", file, err)
+			}
+			s.valuesOpts.ValueFiles[i] = tempFile
+			s.processedValuesFiles[tempFile] = processedValuesFile{name: file}
+			continue
+		}
+		if file == "-" || (strings.Contains(file, "://") && !strings.HasPrefix(file, secrets.Prefix)) {
+			continue
+		}
+		file, encrypted, err := secrets.IsEncrypted(file)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		var content []byte
+		if encrypted {
+			if s.Verbose {
+				s.logger().Info(1, "decrypting values file \"%s\"...", file)
+			}
+			content, err = secrets.Decrypt(file, s.SecretsKeys, s.logger(), s.Debug)
+			s.hasDecryptedValues = true
+		} else {
+			content, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return nil, nil, "", err
+		}
+		updatedValues, lines, err := values.ProcessValuesFile(file, string(content), s.Interpolate, s.StrictEnv, s.logger(), s.Verbose)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("processing directives of values file \"%s\": %w", file, err)
+		}
+		if lines != nil || encrypted {
+			// Write the updated (or decrypted) values to a private temporary file replacing the original one, for later
+			// usage during the calls to helm
+			tempFile, err := s.writeTempFile("updatedValues-*.yaml", updatedValues)
+			if err != nil {
+				return nil, nil, "", fmt.Errorf("writing updated values file \"%s\": %w", file, err)
+			}
+			s.valuesOpts.ValueFiles[i] = tempFile
+			s.processedValuesFiles[tempFile] = processedValuesFile{name: file, lines: lines}
+		}
 	}
 
-	mergedValues, updatedChartValuesAsString, err := values.Merge(chart, s.ReuseValues, &s.ValuesOpts, s.Verbose)
+	merged, err := values.Merge(chart, s.ReuseValues, s.Interpolate, s.StrictEnv, s.ValuesDir, s.SecretsKeys, &s.valuesOpts, s.getterOptions(), s.logger(), s.Verbose, s.Debug)
 	if err != nil {
-		return fmt.Errorf("merging values: %w", err)
+		return nil, nil, "", fmt.Errorf("merging values: %w", err)
 	}
-	if len(updatedChartValuesAsString) > 0 {
+	mergedValues := merged.Values
+	prependArray := make([]string, 0)
+	if len(merged.ChartValues) > 0 {
 		// Write default values to a temporary file and add it to the list of values files,
 		// for later usage during the calls to helm
-		tempDir, err := ioutil.TempDir("", "spray-")
+		tempFile, err := s.writeTempFile("updatedDefaultValues-*.yaml", merged.ChartValues)
 		if err != nil {
-			return fmt.Errorf("creating temporary directory to write updated default values file for umbrella chart: %w", err)
+			return nil, nil, "", fmt.Errorf("writing updated default values file for umbrella chart: %w", err)
 		}
-		defer removeTempDir(tempDir)
-		tempFile, err := ioutil.TempFile(tempDir, "updatedDefaultValues-*.yaml")
-		if err != nil {
-			return fmt.Errorf("creating temporary file to write updated default values file for umbrella chart: %w", err)
+		s.processedValuesFiles[tempFile] = processedValuesFile{name: chartutil.ValuesfileName, lines: merged.ChartValuesLines}
+		prependArray = append(prependArray, tempFile)
+	}
+	for _, f := range merged.SubChartFiles {
+		if f.Encrypted {
+			s.hasDecryptedValues = true
 		}
-		defer removeTempFile(tempFile.Name())
-		if _, err = tempFile.Write([]byte(updatedChartValuesAsString)); err != nil {
-			return fmt.Errorf("writing updated default values file for umbrella chart into temporary file: %w", err)
+		// The values of the sub-chart files are given to helm under the key of their sub-chart, after the default values
+		content, err := yaml.Marshal(f.Scoped())
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("generating values file of sub-chart \"%s\" from \"%s\": %w", f.SubChart, f.Name, err)
 		}
-		err = tempFile.Close()
+		tempFile, err := s.writeTempFile("subChartValues-*.yaml", string(content))
 		if err != nil {
-			return fmt.Errorf("closing temporary file to write updated default values file for umbrella chart: %w", err)
+			return nil, nil, "", fmt.Errorf("writing values file of sub-chart \"%s\": %w", f.SubChart, err)
 		}
-		prependArray := []string{tempFile.Name()}
-		s.ValuesOpts.ValueFiles = append(prependArray, s.ValuesOpts.ValueFiles...)
+		s.processedValuesFiles[tempFile] = processedValuesFile{name: f.Name, lines: f.Lines, subChart: f.SubChart, content: f.Content}
+		prependArray = append(prependArray, tempFile)
 	}
+	s.valuesOpts.ValueFiles = append(prependArray, s.valuesOpts.ValueFiles...)
 
 	releasePrefix := ""
 	if s.PrefixReleasesWithNamespace && len(s.Namespace) > 0 {
@@ -93,34 +356,26 @@ func (s *Spray) Spray() error {
 	} else if len(s.PrefixReleases) > 0 {
 		releasePrefix = s.PrefixReleases + "-"
 	}
-	deps, err := dependencies.Get(chart, &mergedValues, s.Targets, s.Excludes, releasePrefix, s.Verbose)
+	deps, err := dependencies.Get(chart, &mergedValues, s.Targets, s.Excludes, releasePrefix, s.logger(), s.Verbose)
 	if err != nil {
-		return fmt.Errorf("analyzing dependencies: %w", err)
-	}
-
-	// Starting the processing...
-	if len(releasePrefix) > 0 {
-		log.Info(1, "deploying solution chart \"%s\" in namespace \"%s\", with releases releasePrefix \"%s-\"", s.ChartName, s.Namespace, releasePrefix)
-	} else {
-		log.Info(1, "deploying solution chart \"%s\" in namespace \"%s\"", s.ChartName, s.Namespace)
-	}
-
-	releases, err := helm.List(1, s.Namespace, s.Debug)
-	if err != nil {
-		return fmt.Errorf("listing releases: %w", err)
-	}
-
-	if s.Verbose {
-		logRelease(releases, deps)
-	}
-
-	err = checkTargetsAndExcludes(deps, s.Targets, s.Excludes)
-	if err != nil {
-		return fmt.Errorf("checking targets and excludes: %w", err)
+		return nil, nil, "", fmt.Errorf("analyzing dependencies: %w", err)
 	}
+	return mergedValues, deps, releasePrefix, nil
+}
 
+func (s *Spray) processWeights(releases map[string]helm.Release, deps []dependencies.Dependency) error {
 	// Loop on the increasing weight
 	for i := 0; i <= maxWeight(deps); i++ {
+		if err := s.interrupted(); err != nil {
+			return err
+		}
+		weightReleases := releasesOfWeight(deps, i)
+		if len(weightReleases) > 0 {
+			err := s.runHooks(hooks.PreWeight, i, weightReleases, nil)
+			if err != nil {
+				return err
+			}
+		}
 		shouldWait, err := s.upgrade(releases, deps, i)
 		if err != nil {
 			return err
@@ -131,14 +386,67 @@ func (s *Spray) Spray() error {
 			if err != nil {
 				return err
 			}
+			// Run the tests of the just upgraded Releases before going to the next weight
+			if s.RunTests {
+				err = s.test()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if len(weightReleases) > 0 {
+			err = s.runHooks(hooks.PostWeight, i, weightReleases, nil)
+			if err != nil {
+				return err
+			}
+			weight := i
+			s.notify(notify.WeightCompleted, &weight)
 		}
 	}
-
-	log.Info(1, "upgrade of solution chart \"%s\" completed in %s", s.ChartName, util.Duration(time.Since(startTime)))
-
 	return nil
 }
 
+func (s *Spray) runHooks(event string, weight int, releases []string, sprayErr error) error {
+	if len(s.hooks) == 0 {
+		return nil
+	}
+	if s.DryRun {
+		if s.Verbose {
+			s.logger().Info(1, "skipping %s hooks (dry-run)", event)
+		}
+		return nil
+	}
+	hookContext := hooks.Context{
+		Kube:      s.Kube,
+		Kubectl:   s.Kubectl,
+		Log:       s.logger(),
+		Chart:     s.ChartName,
+		Namespace: s.Namespace,
+		Event:     event,
+		Weight:    weight,
+		Releases:  releases,
+		Status:    "succeeded",
+	}
+	if event == hooks.PreSpray || event == hooks.PreWeight {
+		hookContext.Status = "pending"
+	}
+	if sprayErr != nil {
+		hookContext.Status = "failed"
+		hookContext.Error = sprayErr.Error()
+	}
+	// Hooks are interrupted along with the spray, except the post-spray ones, which report the end of the spray,
+	// including its interruption
+	ctx := s.ctx
+	if ctx == nil || event == hooks.PostSpray {
+		ctx = context.Background()
+	}
+	err := hooks.Run(ctx, s.hooks, hookContext, s.Verbose, s.Debug)
+	if err != nil && s.interrupted() != nil && event != hooks.PostSpray {
+		return fmt.Errorf("%w: %w", ErrInterrupted, err)
+	}
+	return err
+}
+
 func (s *Spray) upgrade(releases map[string]helm.Release, deps []dependencies.Dependency, currentWeight int) (bool, error) {
 	shouldWait := false
 	firstInWeight := true
@@ -147,61 +455,74 @@ func (s *Spray) upgrade(releases map[string]helm.Release, deps []dependencies.De
 		if dependency.Targeted && dependency.AllowedByTags == true {
 			if dependency.Weight == currentWeight {
 				if firstInWeight {
-					log.Info(1, "processing sub-charts of weight %d", dependency.Weight)
+					s.logger().Info(1, "processing sub-charts of weight %d", dependency.Weight)
 					firstInWeight = false
 					s.deployments = make([]string, 0)
 					s.statefulSets = make([]string, 0)
 					s.jobs = make([]string, 0)
+					s.services = make([]string, 0)
+					s.ingresses = make([]string, 0)
+					s.persistentVolumeClaims = make([]string, 0)
+					s.releasesToTest = make([]string, 0)
+				}
+
+				// No release is upgraded once the spray is interrupted
+				if err := s.interrupted(); err != nil {
+					return false, err
 				}
 
 				if release, ok := releases[dependency.CorrespondingReleaseName]; ok {
 					oldRevision, _ := strconv.Atoi(release.Revision)
-					log.Info(2, "upgrading release \"%s\": going from revision %d (status %s) to %d (appVersion %s)...", dependency.CorrespondingReleaseName, oldRevision, release.Status, oldRevision+1, dependency.AppVersion)
+					s.logger().Info(2, "upgrading release \"%s\": going from revision %d (status %s) to %d (appVersion %s)...", dependency.CorrespondingReleaseName, oldRevision, release.Status, oldRevision+1, dependency.AppVersion)
 
 				} else {
-					log.Info(2, "upgrading release \"%s\": deploying first revision (appVersion %s)...", dependency.CorrespondingReleaseName, dependency.AppVersion)
+					s.logger().Info(2, "upgrading release \"%s\": deploying first revision (appVersion %s)...", dependency.CorrespondingReleaseName, dependency.AppVersion)
 				}
 
 				shouldWait = true
 
-				// Add the "<dependency>.enabled" flags to ensure that only the current chart is to be executed
-				depValuesSet := ""
-				for _, dep := range deps {
-					if dep.UsedName == dependency.UsedName {
-						depValuesSet = depValuesSet + dep.UsedName + ".enabled=true,"
-					} else {
-						depValuesSet = depValuesSet + dep.UsedName + ".enabled=false,"
-					}
-				}
-				var valuesSet []string
-				valuesSet = append(valuesSet, s.ValuesOpts.Values...)
-				valuesSet = append(valuesSet, depValuesSet)
-
 				// Upgrade the Deployment
-				upgradedRelease, err := helm.UpgradeWithValues(3,
+				upgradeStartTime := time.Now()
+				// Once the spray is interrupted, the in-flight upgrade is given a grace period to complete
+				operationCtx, cancel := s.operationContext()
+				upgradedRelease, err := s.helmClient().UpgradeWithValues(operationCtx, 3,
+					s.Kube,
 					s.Namespace,
 					s.CreateNamespace,
 					dependency.CorrespondingReleaseName,
 					s.ChartName,
 					s.ResetValues,
 					s.ReuseValues,
-					s.ValuesOpts.ValueFiles,
-					valuesSet,
-					s.ValuesOpts.StringValues,
-					s.ValuesOpts.FileValues,
+					s.valuesOpts.ValueFiles,
+					s.valuesSet(dependency, deps),
+					s.valuesOpts.StringValues,
+					s.valuesOpts.FileValues,
 					s.Force,
 					s.Timeout,
 					s.DryRun,
+					s.hasDecryptedValues,
 					s.Debug,
 				)
+				killed := operationCtx.Err() != nil
+				cancel()
+				if err != nil && killed {
+					s.rollback(releases, dependency, upgradeStartTime)
+					return false, s.interrupted()
+				}
 				if err != nil {
+					s.setReleaseResult(dependency.CorrespondingReleaseName, 0, "failed", time.Since(upgradeStartTime), err)
 					return false, fmt.Errorf("calling helm upgrade: %w", err)
 				}
+				s.setReleaseResult(dependency.CorrespondingReleaseName, upgradedRelease.Version, fmt.Sprint(upgradedRelease.Info["status"]), time.Since(upgradeStartTime), nil)
+
+				s.logger().Info(3, "release: \"%s\" upgraded", dependency.CorrespondingReleaseName)
 
-				log.Info(3, "release: \"%s\" upgraded", dependency.CorrespondingReleaseName)
+				if dependency.RunTests {
+					s.releasesToTest = append(s.releasesToTest, dependency.CorrespondingReleaseName)
+				}
 
 				if s.Verbose {
-					log.Info(3, "helm status: %s", upgradedRelease.Info["status"])
+					s.logger().Info(3, "helm status: %s", upgradedRelease.Info["status"])
 				}
 				if !s.DryRun && upgradedRelease.Info["status"] != "deployed" {
 					return false, errors.New("status returned by helm differs from \"deployed\", spray interrupted")
@@ -225,23 +546,44 @@ func (s *Spray) upgrade(releases map[string]helm.Release, deps []dependencies.De
 					if ok {
 						s.jobs = append(s.jobs, job.Name)
 					}
+					service, ok := manifest.(*corev1.Service)
+					if ok && service.Spec.Type == corev1.ServiceTypeLoadBalancer && s.waitsFor(WaitForServices) {
+						s.services = append(s.services, service.Name)
+					}
+					ingress, ok := manifest.(*networkingv1.Ingress)
+					if ok && s.waitsFor(WaitForIngresses) {
+						s.ingresses = append(s.ingresses, ingress.Name)
+					}
+					pvc, ok := manifest.(*corev1.PersistentVolumeClaim)
+					if ok && s.waitsFor(WaitForPersistentVolumeClaims) {
+						s.persistentVolumeClaims = append(s.persistentVolumeClaims, pvc.Name)
+					}
 				}
 
 				if s.Verbose {
 					if len(ignoredParts) > 0 {
-						log.Info(3, "warning: ignored part(s) of helm upgrade output")
+						s.logger().Info(3, "warning: ignored part(s) of helm upgrade output")
 						if s.Debug {
-							log.Info(3, "warning: ignored '%v'", ignoredParts)
+							s.logger().Info(3, "warning: ignored '%v'", ignoredParts)
 						}
 					}
 					if len(s.deployments) > 0 {
-						log.Info(3, "release deployments: %v", s.deployments)
+						s.logger().Info(3, "release deployments: %v", s.deployments)
 					}
 					if len(s.statefulSets) > 0 {
-						log.Info(3, "release statefulsets: %v", s.statefulSets)
+						s.logger().Info(3, "release statefulsets: %v", s.statefulSets)
 					}
 					if len(s.jobs) > 0 {
-						log.Info(3, "release jobs: %v", s.jobs)
+						s.logger().Info(3, "release jobs: %v", s.jobs)
+					}
+					if len(s.services) > 0 {
+						s.logger().Info(3, "release load balancer services: %v", s.services)
+					}
+					if len(s.ingresses) > 0 {
+						s.logger().Info(3, "release ingresses: %v", s.ingresses)
+					}
+					if len(s.persistentVolumeClaims) > 0 {
+						s.logger().Info(3, "release persistent volume claims: %v", s.persistentVolumeClaims)
 					}
 				}
 			}
@@ -250,66 +592,170 @@ func (s *Spray) upgrade(releases map[string]helm.Release, deps []dependencies.De
 	return shouldWait, nil
 }
 
+// Values given through '--set' for the release of a dependency: the values of the command line, plus the
+// "<dependency>.enabled" flags ensuring that only the sub-chart of the dependency is to be executed
+func (s *Spray) valuesSet(dependency dependencies.Dependency, deps []dependencies.Dependency) []string {
+	depValuesSet := ""
+	for _, dep := range deps {
+		if dep.UsedName == dependency.UsedName {
+			depValuesSet = depValuesSet + dep.UsedName + ".enabled=true,"
+		} else {
+			depValuesSet = depValuesSet + dep.UsedName + ".enabled=false,"
+		}
+	}
+	var valuesSet []string
+	valuesSet = append(valuesSet, s.valuesOpts.Values...)
+	valuesSet = append(valuesSet, depValuesSet)
+	return valuesSet
+}
+
 func (s *Spray) wait() error {
-	log.Info(2, "waiting for liveness and readiness...")
+	s.logger().Info(2, "waiting for liveness and readiness...")
 
 	sleepTime := 5
-	doneDeployments := false
-	doneStatefulSets := false
-	doneJobs := false
+	k := s.kubectlClient()
+	checks := []readinessCheck{
+		{description: "deployments", names: s.deployments, isReady: k.AreDeploymentsReady},
+		{description: "statefulsets", names: s.statefulSets, isReady: k.AreStatefulSetsReady},
+		{description: "jobs", names: s.jobs, isReady: k.AreJobsReady},
+		{description: "load balancer services", names: s.services, isReady: k.AreServicesReady},
+		{description: "ingresses", names: s.ingresses, isReady: k.AreIngressesReady},
+		{description: "persistent volume claims", names: s.persistentVolumeClaims, isReady: k.ArePersistentVolumeClaimsBound},
+	}
 
-	// Wait for completion of the Deployments/StatefulSets/Jobs
+	// Wait for completion of the Deployments/StatefulSets/Jobs, and of the additional resources requested through '--wait-for'
+	done := false
 	for i := 0; i < s.Timeout; {
-		if len(s.deployments) > 0 && !doneDeployments {
-			if s.Verbose {
-				log.Info(3, "waiting for deployments %v", s.deployments)
+		done = true
+		for c := range checks {
+			if len(checks[c].names) == 0 || checks[c].done {
+				continue
 			}
-			var err error
-			doneDeployments, err = kubectl.AreDeploymentsReady(s.deployments, s.Namespace, s.Debug)
-			if err != nil {
-				return fmt.Errorf("cannot check readiness of %v: %w", s.deployments, err)
-			}
-		} else {
-			doneDeployments = true
-		}
-		if len(s.statefulSets) > 0 && !doneStatefulSets {
 			if s.Verbose {
-				log.Info(3, "waiting for statefulsets %v", s.statefulSets)
+				s.logger().Info(3, "waiting for %s %v", checks[c].description, checks[c].names)
 			}
 			var err error
-			doneStatefulSets, err = kubectl.AreStatefulSetsReady(s.statefulSets, s.Namespace, s.Debug)
+			checks[c].done, err = checks[c].isReady(checks[c].names, s.Kube, s.Namespace, s.Debug)
 			if err != nil {
-				return fmt.Errorf("cannot check readiness of %v: %w", s.statefulSets, err)
+				return fmt.Errorf("cannot check readiness of %v: %w", checks[c].names, err)
 			}
-		} else {
-			doneStatefulSets = true
-		}
-		if len(s.jobs) > 0 && !doneJobs {
-			if s.Verbose {
-				log.Info(3, "waiting for jobs %v", s.jobs)
-			}
-			var err error
-			doneJobs, err = kubectl.AreJobsReady(s.jobs, s.Namespace, s.Debug)
-			if err != nil {
-				return fmt.Errorf("cannot check readiness of %v: %w", s.jobs, err)
-			}
-		} else {
-			doneJobs = true
+			done = done && checks[c].done
 		}
-		if doneDeployments && doneStatefulSets && doneJobs {
+		if done {
 			break
 		}
-		time.Sleep(time.Duration(sleepTime) * time.Second)
+		if err := s.sleep(time.Duration(sleepTime) * time.Second); err != nil {
+			return err
+		}
 		i = i + sleepTime
 	}
 
-	if !doneDeployments || !doneStatefulSets || !doneJobs {
+	if !done {
+		for _, check := range checks {
+			if len(check.names) > 0 && !check.done {
+				s.report.Diagnostics = append(s.report.Diagnostics, fmt.Sprintf("%s %v not ready after %ds", check.description, check.names, s.Timeout))
+			}
+		}
 		return errors.New("timed out waiting for liveness and readiness")
 	}
 
 	return nil
 }
 
+func (s *Spray) test() error {
+	if len(s.releasesToTest) == 0 {
+		return nil
+	}
+	s.logger().Info(2, "running tests...")
+
+	for _, releaseName := range s.releasesToTest {
+		s.logger().Info(3, "testing release \"%s\"...", releaseName)
+		output, err := s.helmClient().Test(3, s.Kube, s.Namespace, releaseName, s.Timeout, s.Verbose, s.Debug)
+		if err != nil {
+			if !s.Verbose {
+				s.logger().WithNumberedLines(4, output)
+			}
+			s.report.Diagnostics = append(s.report.Diagnostics, fmt.Sprintf("tests of release \"%s\" failed: %s", releaseName, lastLines(output, 10)))
+			return fmt.Errorf("tests of release \"%s\" failed, spray interrupted: %w", releaseName, err)
+		}
+		s.logger().Info(3, "release: \"%s\" tested", releaseName)
+	}
+	return nil
+}
+
+type readinessCheck struct {
+	description string
+	names       []string
+	isReady     func(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error)
+	done        bool
+}
+
+func (s *Spray) waitsFor(kind string) bool {
+	for _, k := range s.WaitFor {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeWaitFor(kinds []string) ([]string, error) {
+	normalized := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		k, ok := waitForAliases[strings.ToLower(strings.TrimSpace(kind))]
+		if !ok {
+			return nil, fmt.Errorf("invalid kind \"%s\" in --wait-for, allowed kinds are \"%s\", \"%s\" and \"%s\"", kind, WaitForServices, WaitForIngresses, WaitForPersistentVolumeClaims)
+		}
+		normalized = append(normalized, k)
+	}
+	return normalized, nil
+}
+
+func (s *Spray) setReleaseResult(releaseName string, revision int, status string, duration time.Duration, err error) {
+	for i := range s.report.Releases {
+		if s.report.Releases[i].Name == releaseName {
+			s.report.Releases[i].Revision = revision
+			s.report.Releases[i].Status = status
+			s.report.Releases[i].Duration = duration
+			if err != nil {
+				s.report.Releases[i].Error = err.Error()
+			}
+		}
+	}
+}
+
+func lastLines(str string, count int) string {
+	lines := strings.Split(strings.TrimRight(str, "\n"), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Retrieve the names of the releases of the targeted dependencies having the given weight (all weights if negative)
+func releasesOfWeight(deps []dependencies.Dependency, weight int) []string {
+	releases := make([]string, 0)
+	for _, dependency := range deps {
+		if dependency.Targeted && dependency.AllowedByTags && (weight < 0 || dependency.Weight == weight) {
+			releases = append(releases, dependency.CorrespondingReleaseName)
+		}
+	}
+	return releases
+}
+
+// Retrieve the targeted dependencies, in their order of deployment
+func targetedInOrder(deps []dependencies.Dependency) []dependencies.Dependency {
+	targeted := make([]dependencies.Dependency, 0)
+	for weight := 0; weight <= maxWeight(deps); weight++ {
+		for _, dependency := range deps {
+			if dependency.Targeted && dependency.AllowedByTags && dependency.Weight == weight {
+				targeted = append(targeted, dependency)
+			}
+		}
+	}
+	return targeted
+}
+
 // Retrieve the highest chart.weight in values.yaml
 func maxWeight(deps []dependencies.Dependency) (m int) {
 	if len(deps) > 0 {
@@ -355,8 +801,10 @@ func checkTargetsAndExcludes(deps []dependencies.Dependency, targets []string, e
 	return nil
 }
 
-func logRelease(releases map[string]helm.Release, deps []dependencies.Dependency) {
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.Debug)
+func logRelease(logger *log.Logger, releases map[string]helm.Release, deps []dependencies.Dependency) {
+	out := logger.Stdout()
+	defer out.Close()
+	w := tabwriter.NewWriter(out, 0, 0, 1, ' ', tabwriter.Debug)
 	_, _ = fmt.Fprintln(w, "[spray]  \t subchart\t is alias of\t targeted\t weight\t| corresponding release\t revision\t status\t")
 	_, _ = fmt.Fprintln(w, "[spray]  \t --------\t -----------\t --------\t ------\t| ---------------------\t --------\t ------\t")
 
@@ -387,14 +835,153 @@ func logRelease(releases map[string]helm.Release, deps []dependencies.Dependency
 	_ = w.Flush()
 }
 
-func removeTempDir(tempDir string) {
-	if err := os.RemoveAll(tempDir); err != nil {
-		log.Error("Error: removing temporary directory: %s", err)
+// Write the content into a new file of the temporary directory of the spray, which is created if needed
+func (s *Spray) writeTempFile(pattern string, content string) (string, error) {
+	if s.tempDir == "" {
+		tempDir, err := os.MkdirTemp("", "spray-")
+		if err != nil {
+			return "", fmt.Errorf("creating temporary directory: %w", err)
+		}
+		s.tempDir = tempDir
+	}
+	tempFile, err := os.CreateTemp(s.tempDir, pattern)
+	if err != nil {
+		return "", fmt.Errorf("creating temporary file: %w", err)
 	}
+	if _, err = tempFile.Write([]byte(content)); err != nil {
+		_ = tempFile.Close()
+		return "", fmt.Errorf("writing temporary file: %w", err)
+	}
+	if err = tempFile.Close(); err != nil {
+		return "", fmt.Errorf("closing temporary file: %w", err)
+	}
+	return tempFile.Name(), nil
 }
 
-func removeTempFile(tempFile string) {
-	if err := os.Remove(tempFile); err != nil {
-		log.Error("Error: removing temporary file: %s", err)
+// ErrInterrupted is wrapped by the error returned by a spray interrupted by the cancellation of its context
+var ErrInterrupted = errors.New("spray interrupted")
+
+// Error returned once the context of the spray is cancelled or its deadline is exceeded
+func (s *Spray) interrupted() error {
+	if s.ctx == nil {
+		return nil
+	}
+	if err := s.ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInterrupted, err)
+	}
+	return nil
+}
+
+// Context of the helm operations, which is cancelled once the grace period following the interruption of the spray
+// is elapsed
+func (s *Spray) operationContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if s.ctx == nil {
+		return ctx, cancel
+	}
+	sprayCtx, gracePeriod := s.ctx, s.GracePeriod
+	go func() {
+		select {
+		case <-sprayCtx.Done():
+		case <-ctx.Done():
+			return
+		}
+		s.logger().Info(2, "waiting up to %ds for the in-flight helm operation to complete...", gracePeriod)
+		timer := time.NewTimer(time.Duration(gracePeriod) * time.Second)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Roll back a release whose upgrade has not completed within the grace period, so that it is not left pending: the
+// previous revision is restored, or the release is uninstalled if it was the first revision
+func (s *Spray) rollback(releases map[string]helm.Release, dependency dependencies.Dependency, upgradeStartTime time.Time) {
+	name := dependency.CorrespondingReleaseName
+	upgradeErr := fmt.Errorf("upgrade interrupted after the grace period of %ds", s.GracePeriod)
+	if s.DryRun {
+		s.setReleaseResult(name, 0, "failed", time.Since(upgradeStartTime), upgradeErr)
+		return
+	}
+	var err error
+	status := "rolled-back"
+	if release, ok := releases[name]; ok {
+		revision, _ := strconv.Atoi(release.Revision)
+		s.logger().Info(2, "rolling back release \"%s\" to revision %d...", name, revision)
+		err = s.helmClient().Rollback(3, s.Kube, s.Namespace, name, revision, s.Timeout, s.Debug)
+	} else {
+		s.logger().Info(2, "uninstalling release \"%s\", whose first revision has not completed...", name)
+		status = "uninstalled"
+		err = s.helmClient().Uninstall(3, s.Kube, s.Namespace, name, s.Timeout, s.Debug)
+	}
+	if err != nil {
+		s.logger().Error("Error: cannot roll back release \"%s\": %s", name, err)
+		status = "failed"
+	}
+	s.setReleaseResult(name, 0, status, time.Since(upgradeStartTime), upgradeErr)
+}
+
+// Sleep, unless the spray is interrupted meanwhile
+func (s *Spray) sleep(duration time.Duration) error {
+	if s.sleepFunc != nil {
+		s.sleepFunc(duration)
+		return s.interrupted()
+	}
+	if s.ctx == nil {
+		time.Sleep(duration)
+		return nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-s.ctx.Done():
+		return s.interrupted()
+	}
+}
+
+// Client running the helm commands: the helm binary unless another client is injected
+func (s *Spray) helmClient() helm.Client {
+	if s.Helm == nil {
+		return helm.CLI{Log: s.logger()}
+	}
+	return s.Helm
+}
+
+// Logger of the spray: its Logger, or stdout and stderr if nil. The messages of the spray of a cluster are prefixed by the
+// name of the cluster.
+func (s *Spray) logger() *log.Logger {
+	logger := log.New(s.Logger)
+	if s.cluster != "" {
+		return logger.WithPrefix("[" + s.cluster + "] ")
+	}
+	return logger
+}
+
+// Client running the kubectl commands: the kubectl binary unless another client is injected
+func (s *Spray) kubectlClient() kubectl.Client {
+	if s.Kubectl == nil {
+		return kubectl.CLI{Log: s.logger()}
+	}
+	return s.Kubectl
+}
+
+// Options of the getters of the remote values files: the credentials of the repository are only given to its host
+func (s *Spray) getterOptions() []getter.Option {
+	return s.ChartFetch.Repository.GetterOptions(s.FetchedChart.URL)
+}
+
+func (s *Spray) removeTempDir() {
+	if s.tempDir == "" {
+		return
+	}
+	if err := os.RemoveAll(s.tempDir); err != nil {
+		s.logger().Error("Error: removing temporary directory: %s", err)
 	}
+	s.tempDir = ""
 }
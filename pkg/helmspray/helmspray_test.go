@@ -0,0 +1,834 @@
+package helmspray
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/render"
+	"github.com/gemalto/helm-spray/v4/pkg/fake"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Spray of the umbrella chart of the test data into the given in-memory cluster, without waiting between the readiness
+// checks
+func newTestSpray(t *testing.T, cluster *fake.Cluster, options ...Option) *Spray {
+	t.Helper()
+	options = append([]Option{WithHelmClient(cluster), WithKubectlClient(cluster)}, options...)
+	s, err := New("testdata/umbrella", options...)
+	if err != nil {
+		t.Fatalf("creating spray: %s", err)
+	}
+	s.sleepFunc = func(time.Duration) {}
+	return s
+}
+
+func runTestSpray(t *testing.T, cluster *fake.Cluster, options ...Option) (*Report, error) {
+	t.Helper()
+	return newTestSpray(t, cluster, options...).Run(context.Background())
+}
+
+func releaseResult(t *testing.T, report *Report, name string) ReleaseResult {
+	t.Helper()
+	if report == nil {
+		t.Fatalf("no report")
+	}
+	for _, release := range report.Releases {
+		if release.Name == name {
+			return release
+		}
+	}
+	t.Fatalf("release \"%s\" not found in report %+v", name, report.Releases)
+	return ReleaseResult{}
+}
+
+// Index of the first call matching the given command and release (or resource name for the readiness checks)
+func callIndex(calls []fake.Call, command string, name string) int {
+	for i, call := range calls {
+		if call.Command != command {
+			continue
+		}
+		if call.Release == name {
+			return i
+		}
+		for _, n := range call.Names {
+			if n == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func TestWeightOrdering(t *testing.T) {
+	cluster := fake.NewCluster()
+	report, err := runTestSpray(t, cluster)
+	if err != nil {
+		t.Fatalf("spray failed: %s", err)
+	}
+	if report.Status != StatusSucceeded {
+		t.Errorf("expected status %s, got %s", StatusSucceeded, report.Status)
+	}
+
+	expected := []string{"database", "backend", "web"}
+	if upgrades := cluster.Upgrades(); !reflect.DeepEqual(upgrades, expected) {
+		t.Errorf("expected upgrades %v, got %v", expected, upgrades)
+	}
+
+	// Each weight is ready before the next one is upgraded
+	calls := cluster.Calls()
+	if callIndex(calls, fake.CommandReady, "database") > callIndex(calls, fake.CommandUpgrade, "backend") {
+		t.Errorf("release \"backend\" upgraded before release \"database\" is ready")
+	}
+	if callIndex(calls, fake.CommandReady, "backend") > callIndex(calls, fake.CommandUpgrade, "web") {
+		t.Errorf("release \"web\" upgraded before release \"backend\" is ready")
+	}
+
+	// Only the sub-chart of each release is enabled
+	upgrade := calls[callIndex(calls, fake.CommandUpgrade, "backend")]
+	enabled := upgrade.Values[len(upgrade.Values)-1]
+	if !strings.Contains(enabled, "backend.enabled=true") || !strings.Contains(enabled, "database.enabled=false") || !strings.Contains(enabled, "web.enabled=false") {
+		t.Errorf("unexpected enabled flags for release \"backend\": %s", enabled)
+	}
+
+	for _, name := range expected {
+		release, ok := cluster.Release("default", name)
+		if !ok || release.Revision != 1 || release.Status != "deployed" {
+			t.Errorf("unexpected release \"%s\": %+v", name, release)
+		}
+		result := releaseResult(t, report, name)
+		if result.Status != "deployed" || result.Revision != 1 {
+			t.Errorf("unexpected result of release \"%s\": %+v", name, result)
+		}
+	}
+	if result := releaseResult(t, report, "web"); result.SubChart != "web" || result.Weight != 2 || result.AppVersion != "3.2" {
+		t.Errorf("unexpected result of release \"web\": %+v", result)
+	}
+}
+
+func TestTargetsAndExcludes(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []Option
+		expected []string
+		err      string
+	}{
+		{name: "target", options: []Option{WithTargets("backend")}, expected: []string{"backend"}},
+		{name: "targets", options: []Option{WithTargets("web", "database")}, expected: []string{"database", "web"}},
+		{name: "exclude", options: []Option{WithExcludes("backend")}, expected: []string{"database", "web"}},
+		{name: "unknown target", options: []Option{WithTargets("frontend")}, err: "invalid targetted sub-chart name/alias \"frontend\""},
+		{name: "unknown exclude", options: []Option{WithExcludes("unknown")}, err: "invalid excluded sub-chart name/alias \"unknown\""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := fake.NewCluster()
+			_, err := runTestSpray(t, cluster, test.options...)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error \"%s\", got %v", test.err, err)
+				}
+				if upgrades := cluster.Upgrades(); len(upgrades) > 0 {
+					t.Errorf("expected no upgrade, got %v", upgrades)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("spray failed: %s", err)
+			}
+			if upgrades := cluster.Upgrades(); !reflect.DeepEqual(upgrades, test.expected) {
+				t.Errorf("expected upgrades %v, got %v", test.expected, upgrades)
+			}
+		})
+	}
+
+	if _, err := New("testdata/umbrella", WithTargets("backend"), WithExcludes("web")); err == nil {
+		t.Errorf("expected an error when using both targets and excludes")
+	}
+}
+
+func TestTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []Option
+		expected []string
+	}{
+		{name: "no tag", expected: []string{"database", "backend", "web"}},
+		{name: "tag enabled", options: []Option{WithValues("tags.monitoring=true")}, expected: []string{"database", "backend", "monitoring", "web"}},
+		{name: "tag disabled", options: []Option{WithValues("tags.monitoring=false")}, expected: []string{"database", "backend", "web"}},
+		{name: "tag enabled but not targeted", options: []Option{WithValues("tags.monitoring=true"), WithExcludes("monitoring")}, expected: []string{"database", "backend", "web"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := fake.NewCluster()
+			report, err := runTestSpray(t, cluster, test.options...)
+			if err != nil {
+				t.Fatalf("spray failed: %s", err)
+			}
+			if upgrades := cluster.Upgrades(); !reflect.DeepEqual(upgrades, test.expected) {
+				t.Errorf("expected upgrades %v, got %v", test.expected, upgrades)
+			}
+			if len(report.Releases) != len(test.expected) {
+				t.Errorf("expected %d releases in report, got %+v", len(test.expected), report.Releases)
+			}
+		})
+	}
+}
+
+func TestReleasePrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []Option
+		expected []string
+	}{
+		{name: "prefix", options: []Option{WithReleasesPrefix("demo")}, expected: []string{"demo-database", "demo-backend", "demo-web"}},
+		{name: "namespace prefix", options: []Option{WithNamespace("team"), WithReleasesPrefixedWithNamespace()}, expected: []string{"team-database", "team-backend", "team-web"}},
+		{name: "no prefix", options: []Option{WithNamespace("team")}, expected: []string{"database", "backend", "web"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := fake.NewCluster()
+			s := newTestSpray(t, cluster, test.options...)
+			if _, err := s.Run(context.Background()); err != nil {
+				t.Fatalf("spray failed: %s", err)
+			}
+			if upgrades := cluster.Upgrades(); !reflect.DeepEqual(upgrades, test.expected) {
+				t.Errorf("expected upgrades %v, got %v", test.expected, upgrades)
+			}
+			for _, name := range test.expected {
+				if _, ok := cluster.Release(s.Namespace, name); !ok {
+					t.Errorf("release \"%s\" not found in namespace \"%s\"", name, s.Namespace)
+				}
+			}
+		})
+	}
+
+	if _, err := New("testdata/umbrella", WithReleasesPrefix("demo"), WithReleasesPrefixedWithNamespace()); err == nil {
+		t.Errorf("expected an error when using both prefixes")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	cluster := fake.NewCluster()
+	cluster.AddRelease(fake.Release{Name: "database", Namespace: "default", Revision: 4})
+	report, err := runTestSpray(t, cluster, WithDryRun())
+	if err != nil {
+		t.Fatalf("spray failed: %s", err)
+	}
+
+	for _, call := range cluster.Calls() {
+		if call.Command == fake.CommandUpgrade && !call.DryRun {
+			t.Errorf("release \"%s\" upgraded without dry-run", call.Release)
+		}
+		if call.Command == fake.CommandReady {
+			t.Errorf("readiness of %v checked in dry-run", call.Names)
+		}
+	}
+	if names := cluster.Names("default"); !reflect.DeepEqual(names, []string{"database"}) {
+		t.Errorf("expected only the existing release, got %v", names)
+	}
+	if release, _ := cluster.Release("default", "database"); release.Revision != 4 {
+		t.Errorf("existing release upgraded in dry-run: %+v", release)
+	}
+	if result := releaseResult(t, report, "database"); result.Status != "pending-upgrade" || result.Revision != 5 {
+		t.Errorf("unexpected result of release \"database\": %+v", result)
+	}
+	if result := releaseResult(t, report, "backend"); result.Status != "pending-install" || result.Revision != 1 {
+		t.Errorf("unexpected result of release \"backend\": %+v", result)
+	}
+}
+
+func TestReuseAndResetValues(t *testing.T) {
+	tests := []struct {
+		name              string
+		options           []Option
+		reuse             bool
+		reset             bool
+		expectedGetValues bool
+		expectedReplicas  interface{}
+	}{
+		{name: "default", expectedReplicas: nil},
+		{name: "reuse", options: []Option{WithReuseValues()}, reuse: true, expectedGetValues: true, expectedReplicas: float64(3)},
+		{name: "reset", options: []Option{WithResetValues()}, reset: true, expectedReplicas: nil},
+		{name: "reuse and reset", options: []Option{WithReuseValues(), WithResetValues()}, reuse: true, reset: true, expectedReplicas: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := fake.NewCluster()
+			cluster.AddRelease(fake.Release{Name: "database", Namespace: "default", Revision: 1, Values: map[string]interface{}{
+				"database": map[string]interface{}{"replicas": float64(3)},
+			}})
+			options := append([]Option{WithTargets("database"), WithValues("database.image=postgres")}, test.options...)
+			if _, err := runTestSpray(t, cluster, options...); err != nil {
+				t.Fatalf("spray failed: %s", err)
+			}
+
+			calls := cluster.Calls()
+			upgrade := calls[callIndex(calls, fake.CommandUpgrade, "database")]
+			if upgrade.ReuseValues != test.reuse || upgrade.ResetValues != test.reset {
+				t.Errorf("unexpected upgrade flags: reuse %t, reset %t", upgrade.ReuseValues, upgrade.ResetValues)
+			}
+			// The pre-flight checks get the current values only when they are reused
+			if getValues := callIndex(calls, fake.CommandGetValues, "database") >= 0; getValues != test.expectedGetValues {
+				t.Errorf("expected values of current revision got: %t, got %t", test.expectedGetValues, getValues)
+			}
+
+			release, _ := cluster.Release("default", "database")
+			database, _ := release.Values["database"].(map[string]interface{})
+			if release.Revision != 2 || database["image"] != "postgres" || database["replicas"] != test.expectedReplicas {
+				t.Errorf("unexpected release: %+v", release)
+			}
+		})
+	}
+}
+
+func TestReadinessProgress(t *testing.T) {
+	cluster := fake.NewCluster()
+	cluster.ReadyAfter["database"] = 2
+	s := newTestSpray(t, cluster, WithTimeout(30*time.Second))
+	sleeps := 0
+	s.sleepFunc = func(time.Duration) { sleeps++ }
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatalf("spray failed: %s", err)
+	}
+	if sleeps != 2 {
+		t.Errorf("expected 2 waits, got %d", sleeps)
+	}
+	checks := 0
+	for _, call := range cluster.Calls() {
+		if call.Command == fake.CommandReady && callIndex([]fake.Call{call}, fake.CommandReady, "database") == 0 {
+			checks++
+		}
+	}
+	if checks != 3 {
+		t.Errorf("expected 3 readiness checks of \"database\", got %d", checks)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	cluster := fake.NewCluster()
+	cluster.ReadyAfter["backend"] = -1
+	report, err := runTestSpray(t, cluster, WithTimeout(10*time.Second))
+	if err == nil || !strings.Contains(err.Error(), "timed out waiting for liveness and readiness") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if report.Status != StatusFailed {
+		t.Errorf("expected status %s, got %s", StatusFailed, report.Status)
+	}
+	expected := "deployments [backend] not ready after 10s"
+	if !reflect.DeepEqual(report.Diagnostics, []string{expected}) {
+		t.Errorf("expected diagnostics [%s], got %v", expected, report.Diagnostics)
+	}
+	if upgrades := cluster.Upgrades(); !reflect.DeepEqual(upgrades, []string{"database", "backend"}) {
+		t.Errorf("expected upgrades [database backend], got %v", upgrades)
+	}
+	if result := releaseResult(t, report, "web"); result.Status != "pending" {
+		t.Errorf("unexpected result of release \"web\": %+v", result)
+	}
+}
+
+func TestUpgradeFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(cluster *fake.Cluster)
+		err       string
+		status    string
+	}{
+		{
+			name: "error",
+			configure: func(cluster *fake.Cluster) {
+				cluster.UpgradeErrors["backend"] = errors.New("context deadline exceeded")
+			},
+			err:    "calling helm upgrade: context deadline exceeded",
+			status: "failed",
+		},
+		{
+			name:      "status",
+			configure: func(cluster *fake.Cluster) { cluster.UpgradeStatuses["backend"] = "pending-upgrade" },
+			err:       "status returned by helm differs from \"deployed\"",
+			status:    "pending-upgrade",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := fake.NewCluster()
+			test.configure(cluster)
+			report, err := runTestSpray(t, cluster)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error \"%s\", got %v", test.err, err)
+			}
+			if report.Status != StatusFailed {
+				t.Errorf("expected status %s, got %s", StatusFailed, report.Status)
+			}
+			if result := releaseResult(t, report, "backend"); result.Status != test.status {
+				t.Errorf("unexpected result of release \"backend\": %+v", result)
+			}
+			if release, _ := cluster.Release("default", "backend"); release.Status != test.status {
+				t.Errorf("unexpected release \"backend\": %+v", release)
+			}
+			if _, ok := cluster.Release("default", "web"); ok {
+				t.Errorf("release \"web\" upgraded after a failure")
+			}
+		})
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	cluster := fake.NewCluster()
+	cluster.TestErrors["backend"] = errors.New("1 test failed")
+	report, err := runTestSpray(t, cluster, WithRunTests())
+	if err == nil || !strings.Contains(err.Error(), "tests of release \"backend\" failed") {
+		t.Fatalf("expected failed tests, got %v", err)
+	}
+	calls := cluster.Calls()
+	if callIndex(calls, fake.CommandTest, "database") < callIndex(calls, fake.CommandReady, "database") {
+		t.Errorf("release \"database\" tested before being ready")
+	}
+	if callIndex(calls, fake.CommandTest, "database") > callIndex(calls, fake.CommandUpgrade, "backend") {
+		t.Errorf("release \"backend\" upgraded before release \"database\" is tested")
+	}
+	if callIndex(calls, fake.CommandUpgrade, "web") >= 0 {
+		t.Errorf("release \"web\" upgraded after failed tests")
+	}
+	if len(report.Diagnostics) != 1 || !strings.Contains(report.Diagnostics[0], "1 test failed") {
+		t.Errorf("unexpected diagnostics %v", report.Diagnostics)
+	}
+}
+
+func TestInterruptedDuringWait(t *testing.T) {
+	cluster := fake.NewCluster()
+	cluster.ReadyAfter["database"] = -1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSpray(t, cluster)
+	s.sleepFunc = func(time.Duration) { cancel() }
+	report, err := s.Run(ctx)
+	if !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected an interruption, got %v", err)
+	}
+	if report.Status != StatusInterrupted {
+		t.Errorf("expected status %s, got %s", StatusInterrupted, report.Status)
+	}
+	if upgrades := cluster.Upgrades(); !reflect.DeepEqual(upgrades, []string{"database"}) {
+		t.Errorf("expected upgrades [database], got %v", upgrades)
+	}
+}
+
+func TestInterruptedUpgrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		status   string
+		history  []string
+	}{
+		{name: "rollback", existing: true, status: "rolled-back", history: []string{"deployed", "pending-upgrade", "deployed"}},
+		{name: "uninstall", status: "uninstalled", history: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := fake.NewCluster()
+			if test.existing {
+				cluster.AddRelease(fake.Release{Name: "backend", Namespace: "default", Revision: 1})
+			}
+			cluster.UpgradeDurations["backend"] = time.Hour
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := newTestSpray(t, cluster, WithGracePeriod(0))
+
+			// The spray is interrupted during the upgrade of "backend", which is killed at once
+			go func() {
+				for callIndex(cluster.Calls(), fake.CommandUpgrade, "backend") < 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+				cancel()
+			}()
+			report, err := s.Run(ctx)
+			if !errors.Is(err, ErrInterrupted) {
+				t.Fatalf("expected an interruption, got %v", err)
+			}
+			if report.Status != StatusInterrupted {
+				t.Errorf("expected status %s, got %s", StatusInterrupted, report.Status)
+			}
+			if result := releaseResult(t, report, "backend"); result.Status != test.status {
+				t.Errorf("unexpected result of release \"backend\": %+v", result)
+			}
+			history := make([]string, 0)
+			for _, release := range cluster.History("default", "backend") {
+				history = append(history, release.Status)
+			}
+			if !reflect.DeepEqual(history, test.history) {
+				t.Errorf("expected history %v, got %v", test.history, history)
+			}
+			if callIndex(cluster.Calls(), fake.CommandUpgrade, "web") >= 0 {
+				t.Errorf("release \"web\" upgraded after the interruption")
+			}
+		})
+	}
+}
+
+func TestExplainValues(t *testing.T) {
+	valuesFile := filepath.Join(t.TempDir(), "prod.yaml")
+	if err := os.WriteFile(valuesFile, []byte("backend:\n  replicas: 3\n  image: backend:1.0\n"), 0644); err != nil {
+		t.Fatalf("writing values file: %s", err)
+	}
+	cluster := fake.NewCluster()
+	cluster.AddRelease(fake.Release{Name: "backend", Namespace: "default", Revision: 1, Values: map[string]interface{}{
+		"backend": map[string]interface{}{"replicas": float64(2), "debug": true},
+	}})
+	s := newTestSpray(t, cluster, WithReuseValues(), WithValuesFiles(valuesFile), WithValues("backend.image=backend:2.0"))
+
+	var sb strings.Builder
+	if err := s.ExplainValues(&sb, "backend", ""); err != nil {
+		t.Fatalf("explaining values failed: %s", err)
+	}
+	expected := `backend.debug: true
+  from       current revision of release "backend"
+backend.enabled: true
+  from       "<chart name or alias>.enabled" flags of the spray
+backend.image: "backend:2.0"
+  from       --set backend.image=backend:2.0
+  overrides  ` + valuesFile + `:3: "backend:1.0"
+  overrides  charts/backend/values.yaml:2: "nginx"
+backend.replicas: 3
+  from       ` + valuesFile + `:2
+  overrides  current revision of release "backend": 2
+  overrides  charts/backend/values.yaml:1: 1
+backend.weight: 1
+  from       values.yaml:4
+`
+	if sb.String() != expected {
+		t.Errorf("unexpected explanation:\n%s\nexpected:\n%s", sb.String(), expected)
+	}
+
+	if err := newTestSpray(t, fake.NewCluster()).ExplainValues(&sb, "unknown", ""); err == nil {
+		t.Errorf("expected an error for an unknown sub-chart")
+	}
+}
+
+func TestValuesDir(t *testing.T) {
+	valuesDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(valuesDir, "web.yaml"), []byte("replicas: 2\nimage: frontend:3.2\n"), 0644); err != nil {
+		t.Fatalf("writing values file: %s", err)
+	}
+	cluster := fake.NewCluster()
+	if _, err := runTestSpray(t, cluster, WithTargets("web"), WithValuesDir(valuesDir), WithValues("web.replicas=4")); err != nil {
+		t.Fatalf("spray failed: %s", err)
+	}
+
+	// The values of the file are given under the key of the sub-chart, and overridden by the flags
+	release, _ := cluster.Release("default", "web")
+	web, _ := release.Values["web"].(map[string]interface{})
+	if web["image"] != "frontend:3.2" || fmt.Sprint(web["replicas"]) != "4" {
+		t.Errorf("unexpected values of release: %+v", release.Values)
+	}
+}
+
+func TestPreflightCustomResourceDefinitions(t *testing.T) {
+	// The templates of the chart hold a CustomResourceDefinition, an APIService and a custom resource of the defined kind
+	cluster := fake.NewCluster()
+	cluster.APIVersions = append([]string{"apiregistration.k8s.io/v1"}, chartutil.DefaultVersionSet...)
+	s, err := New("testdata/crds", WithHelmClient(cluster), WithKubectlClient(cluster))
+	if err != nil {
+		t.Fatalf("creating spray: %s", err)
+	}
+	s.sleepFunc = func(time.Duration) {}
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatalf("spray failed: %s", err)
+	}
+	if upgrades := cluster.Upgrades(); !reflect.DeepEqual(upgrades, []string{"operator"}) {
+		t.Errorf("expected upgrades [operator], got %v", upgrades)
+	}
+
+	// Custom resources of kinds unknown to the chart are accepted when their API version is served by the cluster, and
+	// only result in warnings otherwise
+	manifests := []render.Manifest{{Template: "operator/templates/gadget.yaml", APIVersion: "example.com/v1", Kind: "Gadget", Name: "gadget", Content: "apiVersion: example.com/v1\nkind: Gadget\nmetadata:\n  name: gadget\n"}}
+	if warnings, err := checkManifests(manifests, []string{"Widget"}, nil); err != nil || len(warnings) != 1 || !strings.Contains(warnings[0], "Gadget") {
+		t.Errorf("expected a warning for an unknown kind, got %v, %v", warnings, err)
+	}
+	for _, test := range []struct {
+		knownKinds     []string
+		servedVersions chartutil.VersionSet
+	}{
+		{knownKinds: []string{"example.com/v1/Gadget"}},
+		{servedVersions: chartutil.VersionSet{"example.com/v1"}},
+	} {
+		if warnings, err := checkManifests(manifests, test.knownKinds, test.servedVersions); err != nil || len(warnings) != 0 {
+			t.Errorf("expected no warning and no error for a known or served kind, got %v, %v", warnings, err)
+		}
+	}
+
+	// Unknown kinds of the built-in groups are still rejected
+	manifests = []render.Manifest{{Template: "operator/templates/gadget.yaml", APIVersion: "apps/v1", Kind: "Gadget", Name: "gadget", Content: "apiVersion: apps/v1\nkind: Gadget\nmetadata:\n  name: gadget\n"}}
+	if _, err := checkManifests(manifests, nil, chartutil.VersionSet{"apps/v1"}); err == nil || !strings.Contains(err.Error(), "Gadget") {
+		t.Errorf("expected an error for an unknown built-in kind, got %v", err)
+	}
+}
+
+func TestClustersKubeConfig(t *testing.T) {
+	cluster := fake.NewCluster()
+	clusters := []Cluster{{Name: "eu", Context: "eu-context"}, {Name: "us", Context: "us-context", Kubeconfig: "us.kubeconfig", Namespace: "us"}}
+	s := newTestSpray(t, cluster, WithKube(util.KubeConfig{Kubeconfig: "global.kubeconfig"}), WithClusters(PolicySequential, clusters...))
+	if _, err := s.RunClusters(context.Background()); err != nil {
+		t.Fatalf("spray failed: %s", err)
+	}
+
+	// Each cluster is reached through its own kube context and kubeconfig, the global kubeconfig by default
+	expected := map[string]util.KubeConfig{
+		"default": {Context: "eu-context", Kubeconfig: "global.kubeconfig"},
+		"us":      {Context: "us-context", Kubeconfig: "us.kubeconfig"},
+	}
+	upgraded := make(map[string]bool)
+	for _, call := range cluster.Calls() {
+		if call.Command != fake.CommandUpgrade {
+			continue
+		}
+		upgraded[call.Namespace] = true
+		if call.Kube != expected[call.Namespace] {
+			t.Errorf("release \"%s\" of namespace \"%s\" upgraded with kube config %+v, expected %+v", call.Release, call.Namespace, call.Kube, expected[call.Namespace])
+		}
+	}
+	if len(upgraded) != len(expected) {
+		t.Errorf("expected upgrades in namespaces %v, got %v", expected, upgraded)
+	}
+
+	// The options targeting a single API server are rejected
+	for _, kube := range []util.KubeConfig{{APIServer: "https://10.0.0.1:6443"}, {Token: "token"}, {AsUser: "admin"}} {
+		s := newTestSpray(t, fake.NewCluster(), WithKube(kube), WithClusters(PolicySequential, clusters...))
+		if _, err := s.RunClusters(context.Background()); err == nil || !strings.Contains(err.Error(), "together with several clusters") {
+			t.Errorf("expected an error for kube config %+v, got %v", kube, err)
+		}
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	valuesFile := filepath.Join(t.TempDir(), "prod.yaml")
+	if err := os.WriteFile(valuesFile, []byte("backend:\n  image: #! {{ env \"BACKEND_IMAGE\" | quote }}\n"), 0644); err != nil {
+		t.Fatalf("writing values file: %s", err)
+	}
+	t.Setenv("BACKEND_IMAGE", "backend:1.0")
+	cluster := fake.NewCluster()
+	s := newTestSpray(t, cluster, WithTargets("backend"), WithValuesFiles(valuesFile), WithInterpolation())
+
+	// The processed values files of the first spray are not given to the second one
+	for _, image := range []string{"backend:1.0", "backend:2.0"} {
+		t.Setenv("BACKEND_IMAGE", image)
+		if _, err := s.Run(context.Background()); err != nil {
+			t.Fatalf("spray with image %s failed: %s", image, err)
+		}
+		release, _ := cluster.Release("default", "backend")
+		backend, _ := release.Values["backend"].(map[string]interface{})
+		if backend["image"] != image {
+			t.Errorf("expected image %s, got values %+v", image, release.Values)
+		}
+	}
+	if !reflect.DeepEqual(s.ValuesOpts.ValueFiles, []string{valuesFile}) {
+		t.Errorf("values files of the spray changed to %v", s.ValuesOpts.ValueFiles)
+	}
+}
+
+func TestClustersInterrupted(t *testing.T) {
+	cluster := fake.NewCluster()
+	cluster.ReadyAfter["database"] = -1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSpray(t, cluster, WithClusters(PolicySequential, Cluster{Name: "eu", Context: "eu-context"}, Cluster{Name: "us", Context: "us-context"}))
+	s.sleepFunc = func(time.Duration) { cancel() }
+	results, err := s.RunClusters(ctx)
+	if !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected an interruption, got %v", err)
+	}
+	if len(results) != 2 || results[0].Status != StatusFailed || !errors.Is(results[0].Err, ErrInterrupted) || results[1].Status != StatusSkipped {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
+
+func TestClustersHaltedInParallel(t *testing.T) {
+	// The pre-spray hook fails in the "us" namespace, and lasts in the "ap" namespace
+	hooksFile := writeHooksFile(t, "hooks:\n- name: check\n  event: pre-spray\n  command: [\"sh\", \"-c\", \"[ $SPRAY_NAMESPACE != us ] || exit 1; [ $SPRAY_NAMESPACE != ap ] || exec sleep 30\"]\n")
+	clusters := []Cluster{
+		{Name: "eu", Context: "eu-context", Namespace: "eu", Canary: true},
+		{Name: "us", Context: "us-context", Namespace: "us"},
+		{Name: "ap", Context: "ap-context", Namespace: "ap"},
+	}
+	s := newTestSpray(t, fake.NewCluster(), WithHooksFile(hooksFile), WithClusters(PolicyRolling, clusters...))
+	startTime := time.Now()
+	results, err := s.RunClusters(context.Background())
+	if err == nil || errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected a failure, got %v", err)
+	}
+	if duration := time.Since(startTime); duration > 20*time.Second {
+		t.Errorf("parallel cluster not halted after %s", duration)
+	}
+
+	// The failure of a parallel cluster halts the others, reported as skipped as long as none of their releases has
+	// been upgraded
+	expected := []string{StatusSucceeded, StatusFailed, StatusSkipped}
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Errorf("expected status %s for cluster \"%s\", got %s (%s)", expected[i], result.Cluster, result.Status, result.Error)
+		}
+	}
+	if len(results) != 3 || !errors.Is(results[2].Err, ErrHalted) {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
+
+// Logger recording the messages
+type recordingLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Info(level int, message string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages = append(l.messages, message)
+}
+
+func (l *recordingLogger) Error(message string) {
+	l.Info(0, message)
+}
+
+func (l *recordingLogger) contains(message string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, m := range l.messages {
+		if m == message {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoggers(t *testing.T) {
+	// Each spray logs through its own logger
+	eu, us := &recordingLogger{}, &recordingLogger{}
+	if _, err := runTestSpray(t, fake.NewCluster(), WithLogger(eu), WithNamespace("eu")); err != nil {
+		t.Fatalf("spray failed: %s", err)
+	}
+	if _, err := runTestSpray(t, fake.NewCluster(), WithLogger(us), WithNamespace("us")); err != nil {
+		t.Fatalf("spray failed: %s", err)
+	}
+	euMessage := `deploying solution chart "testdata/umbrella" in namespace "eu"`
+	usMessage := `deploying solution chart "testdata/umbrella" in namespace "us"`
+	if !eu.contains(euMessage) || eu.contains(usMessage) || !us.contains(usMessage) || us.contains(euMessage) {
+		t.Errorf("messages not sent to the logger of their spray: %v, %v", eu.messages, us.messages)
+	}
+
+	// The messages of the spray of each cluster are prefixed by the name of the cluster
+	logger := &recordingLogger{}
+	s := newTestSpray(t, fake.NewCluster(), WithLogger(logger), WithClusters(PolicyRolling, Cluster{Name: "eu", Context: "eu-context"}, Cluster{Name: "us", Context: "us-context"}))
+	if _, err := s.RunClusters(context.Background()); err != nil {
+		t.Fatalf("spray failed: %s", err)
+	}
+	for _, cluster := range []string{"eu", "us"} {
+		if !logger.contains("[" + cluster + `] deploying solution chart "testdata/umbrella" in namespace "default"`) {
+			t.Errorf("no message prefixed by cluster %s: %v", cluster, logger.messages)
+		}
+	}
+}
+
+func writeHooksFile(t *testing.T, content string) string {
+	t.Helper()
+	hooksFile := filepath.Join(t.TempDir(), "hooks.yaml")
+	if err := os.WriteFile(hooksFile, []byte(content), 0644); err != nil {
+		t.Fatalf("writing hooks file: %s", err)
+	}
+	return hooksFile
+}
+
+// Names of the jobs created, or deleted, in the cluster
+func jobNames(t *testing.T, cluster *fake.Cluster, command string) []string {
+	t.Helper()
+	names := make([]string, 0)
+	for _, call := range cluster.Calls() {
+		switch {
+		case command == fake.CommandCreate && call.Command == fake.CommandCreate:
+			var job struct {
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+			}
+			if err := json.Unmarshal([]byte(call.Manifest), &job); err != nil {
+				t.Fatalf("reading job manifest: %s", err)
+			}
+			names = append(names, job.Metadata.Name)
+		case command == fake.CommandDelete && call.Command == fake.CommandDelete:
+			names = append(names, call.Names...)
+		}
+	}
+	return names
+}
+
+func TestHookJobs(t *testing.T) {
+	hooksFile := writeHooksFile(t, "hooks:\n- name: migrate\n  event: pre-weight\n  job:\n    image: db-tools:1.0\n")
+	cluster := fake.NewCluster()
+	if _, err := runTestSpray(t, cluster, WithHooksFile(hooksFile)); err != nil {
+		t.Fatalf("spray failed: %s", err)
+	}
+
+	// The jobs of the hook run for each weight, within the same second, have distinct names
+	names := jobNames(t, cluster, fake.CommandCreate)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !strings.HasPrefix(name, "spray-hook-migrate-") || seen[name] {
+			t.Errorf("unexpected or duplicate job name \"%s\" in %v", name, names)
+		}
+		seen[name] = true
+	}
+	if len(names) != 3 {
+		t.Errorf("expected a job for each of the 3 weights, got %v", names)
+	}
+	if deleted := jobNames(t, cluster, fake.CommandDelete); len(deleted) != 0 {
+		t.Errorf("completed jobs deleted: %v", deleted)
+	}
+}
+
+func TestHookJobTimeout(t *testing.T) {
+	hooksFile := writeHooksFile(t, "hooks:\n- name: migrate\n  event: pre-spray\n  timeout: 1\n  job:\n    image: db-tools:1.0\n")
+	cluster := fake.NewCluster()
+	cluster.ReadyAfter["spray-hook-migrate-*"] = -1
+	_, err := runTestSpray(t, cluster, WithHooksFile(hooksFile))
+	if err == nil || !strings.Contains(err.Error(), "timed out after 1s waiting for job") {
+		t.Fatalf("expected a timeout of the hook, got %v", err)
+	}
+	// The job which has not completed is deleted
+	if created, deleted := jobNames(t, cluster, fake.CommandCreate), jobNames(t, cluster, fake.CommandDelete); len(created) != 1 || !reflect.DeepEqual(deleted, created) {
+		t.Errorf("expected job %v to be deleted, got %v", created, deleted)
+	}
+}
+
+func TestHookJobInterrupted(t *testing.T) {
+	hooksFile := writeHooksFile(t, "hooks:\n- name: migrate\n  event: pre-spray\n  timeout: 600\n  job:\n    image: db-tools:1.0\n")
+	cluster := fake.NewCluster()
+	cluster.ReadyAfter["spray-hook-migrate-*"] = -1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSpray(t, cluster, WithHooksFile(hooksFile))
+
+	// The spray is interrupted while waiting for the job, whose polling stops at once
+	go func() {
+		for callIndex(cluster.Calls(), fake.CommandCreate, "") < 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+	startTime := time.Now()
+	_, err := s.Run(ctx)
+	if !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected an interruption, got %v", err)
+	}
+	if duration := time.Since(startTime); duration > 10*time.Second {
+		t.Errorf("wait for the job not interrupted after %s", duration)
+	}
+	if created, deleted := jobNames(t, cluster, fake.CommandCreate), jobNames(t, cluster, fake.CommandDelete); len(created) != 1 || !reflect.DeepEqual(deleted, created) {
+		t.Errorf("expected job %v to be deleted, got %v", created, deleted)
+	}
+}
@@ -0,0 +1,365 @@
+package helmspray
+
+import (
+	"github.com/gemalto/helm-spray/v4/pkg/helm"
+	"github.com/gemalto/helm-spray/v4/pkg/kubectl"
+	"github.com/gemalto/helm-spray/v4/pkg/notify"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"time"
+)
+
+// Logger receives the messages of helm spray, instead of stdout and stderr. The level of the messages goes from 1 (main
+// steps) to 5 (details), the output of the helm and kubectl commands being given at level 3.
+type Logger interface {
+	Info(level int, message string)
+	Error(message string)
+}
+
+// EventSink receives the events of a spray: the same events as the ones posted to the notification webhooks
+type EventSink interface {
+	Event(event notify.Event)
+}
+
+// Option configures a spray created by New
+type Option func(s *Spray) error
+
+// New creates a spray of an umbrella chart, given as a local directory or archive, a chart reference within a
+// repository, a URL or an OCI reference. Options not given have the same defaults as the flags of the command line.
+func New(chart string, options ...Option) (*Spray, error) {
+	s := &Spray{
+		ChartName:            chart,
+		Namespace:            "default",
+		Timeout:              300,
+		GracePeriod:          30,
+		NotifyRetries:        3,
+		NotifyTimeout:        10,
+		ClustersPolicy:       PolicySequential,
+		HaltOnClusterFailure: true,
+		GraphFormat:          GraphASCII,
+		GitOps: ExportOptions{
+			Project:           "default",
+			ArgoCDNamespace:   "argocd",
+			DestinationServer: "https://kubernetes.default.svc",
+			SourceKind:        "HelmRepository",
+			Interval:          "10m",
+		},
+	}
+	for _, option := range options {
+		if err := option(s); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// WithChartVersion sets the version (or version constraint) of the chart to fetch
+func WithChartVersion(version string) Option {
+	return func(s *Spray) error {
+		s.ChartVersion = version
+		return nil
+	}
+}
+
+// WithFetchOptions sets the options of the chart fetching: chart cache, provenance verification, repository
+// credentials...
+func WithFetchOptions(options helm.FetchOptions) Option {
+	return func(s *Spray) error {
+		s.ChartFetch = options
+		return nil
+	}
+}
+
+// WithNamespace sets the namespace to spray the chart into
+func WithNamespace(namespace string) Option {
+	return func(s *Spray) error {
+		s.Namespace = namespace
+		return nil
+	}
+}
+
+// WithCreateNamespace creates the namespace if necessary
+func WithCreateNamespace() Option {
+	return func(s *Spray) error {
+		s.CreateNamespace = true
+		return nil
+	}
+}
+
+// WithKube sets the cluster to spray the chart into, and the credentials used for it
+func WithKube(kube util.KubeConfig) Option {
+	return func(s *Spray) error {
+		s.Kube = kube
+		return nil
+	}
+}
+
+// WithTargets restricts the spray to the given sub-charts
+func WithTargets(subCharts ...string) Option {
+	return func(s *Spray) error {
+		s.Targets = append(s.Targets, subCharts...)
+		return nil
+	}
+}
+
+// WithExcludes excludes the given sub-charts from the spray
+func WithExcludes(subCharts ...string) Option {
+	return func(s *Spray) error {
+		s.Excludes = append(s.Excludes, subCharts...)
+		return nil
+	}
+}
+
+// WithReleasesPrefix prefixes the names of the releases by the given string
+func WithReleasesPrefix(prefix string) Option {
+	return func(s *Spray) error {
+		s.PrefixReleases = prefix
+		return nil
+	}
+}
+
+// WithReleasesPrefixedWithNamespace prefixes the names of the releases by the name of the namespace
+func WithReleasesPrefixedWithNamespace() Option {
+	return func(s *Spray) error {
+		s.PrefixReleasesWithNamespace = true
+		return nil
+	}
+}
+
+// WithValuesFiles adds values files, as '--values' does
+func WithValuesFiles(files ...string) Option {
+	return func(s *Spray) error {
+		s.ValuesOpts.ValueFiles = append(s.ValuesOpts.ValueFiles, files...)
+		return nil
+	}
+}
+
+// WithValuesDir sets the directory of the values files of the sub-charts, as '--values-dir' does
+func WithValuesDir(dir string) Option {
+	return func(s *Spray) error {
+		s.ValuesDir = dir
+		return nil
+	}
+}
+
+// WithValues adds values, as '--set' does
+func WithValues(values ...string) Option {
+	return func(s *Spray) error {
+		s.ValuesOpts.Values = append(s.ValuesOpts.Values, values...)
+		return nil
+	}
+}
+
+// WithStringValues adds string values, as '--set-string' does
+func WithStringValues(values ...string) Option {
+	return func(s *Spray) error {
+		s.ValuesOpts.StringValues = append(s.ValuesOpts.StringValues, values...)
+		return nil
+	}
+}
+
+// WithFileValues adds values read from files, as '--set-file' does
+func WithFileValues(values ...string) Option {
+	return func(s *Spray) error {
+		s.ValuesOpts.FileValues = append(s.ValuesOpts.FileValues, values...)
+		return nil
+	}
+}
+
+// WithInterpolation enables the "env" and "readFile" functions in the values files given through '--values'/'-f' and
+// in the values files of the values directory
+func WithInterpolation() Option {
+	return func(s *Spray) error {
+		s.Interpolate = true
+		return nil
+	}
+}
+
+// WithStrictEnv fails when an environment variable referenced by a values file is not defined
+func WithStrictEnv() Option {
+	return func(s *Spray) error {
+		s.StrictEnv = true
+		return nil
+	}
+}
+
+// WithSecretsKeys sets the keys used to decrypt the encrypted values files
+func WithSecretsKeys(keys util.SecretsKeys) Option {
+	return func(s *Spray) error {
+		s.SecretsKeys = keys
+		return nil
+	}
+}
+
+// WithReuseValues reuses the values of the current revisions of the releases
+func WithReuseValues() Option {
+	return func(s *Spray) error {
+		s.ReuseValues = true
+		return nil
+	}
+}
+
+// WithResetValues resets the values of the releases to the ones built into the chart
+func WithResetValues() Option {
+	return func(s *Spray) error {
+		s.ResetValues = true
+		return nil
+	}
+}
+
+// WithForce forces the update of the resources through delete/recreate if needed
+func WithForce() Option {
+	return func(s *Spray) error {
+		s.Force = true
+		return nil
+	}
+}
+
+// WithTimeout sets the time to wait for any individual Kubernetes operation, and for the readiness of the releases of
+// each weight
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *Spray) error {
+		s.Timeout = int((timeout + time.Second - 1) / time.Second)
+		return nil
+	}
+}
+
+// WithGracePeriod sets the time given to the in-flight upgrade to complete when the spray is interrupted, before it is
+// rolled back
+func WithGracePeriod(gracePeriod time.Duration) Option {
+	return func(s *Spray) error {
+		s.GracePeriod = int((gracePeriod + time.Second - 1) / time.Second)
+		return nil
+	}
+}
+
+// WithWaitFor sets the additional kinds of resources to wait for before processing the next weight
+func WithWaitFor(kinds ...string) Option {
+	return func(s *Spray) error {
+		waitFor, err := normalizeWaitFor(kinds)
+		if err != nil {
+			return err
+		}
+		s.WaitFor = waitFor
+		return nil
+	}
+}
+
+// WithRunTests runs the tests of the releases of each weight once they are ready
+func WithRunTests() Option {
+	return func(s *Spray) error {
+		s.RunTests = true
+		return nil
+	}
+}
+
+// WithHooksFile adds the spray hooks declared in the given file
+func WithHooksFile(file string) Option {
+	return func(s *Spray) error {
+		s.HooksFile = file
+		return nil
+	}
+}
+
+// WithNotifyWebhooks posts the events of the spray to the given URLs
+func WithNotifyWebhooks(urls ...string) Option {
+	return func(s *Spray) error {
+		s.NotifyWebhooks = append(s.NotifyWebhooks, urls...)
+		return nil
+	}
+}
+
+// WithEventSink gives the events of the spray to the given sink
+func WithEventSink(sink EventSink) Option {
+	return func(s *Spray) error {
+		s.EventSink = sink
+		return nil
+	}
+}
+
+// WithHelmClient runs the helm commands of the spray through the given client, instead of the helm binary
+func WithHelmClient(client helm.Client) Option {
+	return func(s *Spray) error {
+		s.Helm = client
+		return nil
+	}
+}
+
+// WithKubectlClient runs the kubectl commands of the spray and of its hooks through the given client, instead of the
+// kubectl binary
+func WithKubectlClient(client kubectl.Client) Option {
+	return func(s *Spray) error {
+		s.Kubectl = client
+		return nil
+	}
+}
+
+// WithLogger sends the messages of the spray, of its hooks and of the helm and kubectl commands to the given logger,
+// instead of stdout and stderr. The messages of the spray of each cluster are prefixed by the name of the cluster.
+func WithLogger(logger Logger) Option {
+	return func(s *Spray) error {
+		s.Logger = logger
+		return nil
+	}
+}
+
+// WithSkipPreflight does not run the pre-flight checks before the first upgrade
+func WithSkipPreflight() Option {
+	return func(s *Spray) error {
+		s.SkipPreflight = true
+		return nil
+	}
+}
+
+// WithKnownKinds sets the kinds of custom resources not defined by the CRDs of the chart, accepted by the pre-flight
+// checks
+func WithKnownKinds(kinds ...string) Option {
+	return func(s *Spray) error {
+		s.KnownKinds = append(s.KnownKinds, kinds...)
+		return nil
+	}
+}
+
+// WithClusters sprays the chart into each of the given clusters, according to the clusters policy
+func WithClusters(policy string, clusters ...Cluster) Option {
+	return func(s *Spray) error {
+		s.ClustersPolicy = policy
+		s.Clusters = append(s.Clusters, clusters...)
+		return nil
+	}
+}
+
+// WithDryRun simulates the spray
+func WithDryRun() Option {
+	return func(s *Spray) error {
+		s.DryRun = true
+		return nil
+	}
+}
+
+// WithOutputDir sets the output directory of the template and export commands
+func WithOutputDir(dir string) Option {
+	return func(s *Spray) error {
+		s.OutputDir = dir
+		return nil
+	}
+}
+
+// WithVerbose enables the verbose messages
+func WithVerbose() Option {
+	return func(s *Spray) error {
+		s.Verbose = true
+		return nil
+	}
+}
+
+// WithDebug enables the debug messages, including the ones of helm
+func WithDebug() Option {
+	return func(s *Spray) error {
+		s.Debug = true
+		s.Verbose = true
+		return nil
+	}
+}
@@ -0,0 +1,304 @@
+package helmspray
+
+import (
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/apis"
+	"github.com/gemalto/helm-spray/v4/internal/dependencies"
+	"github.com/gemalto/helm-spray/v4/internal/render"
+	"github.com/gemalto/helm-spray/v4/internal/values"
+	"github.com/gemalto/helm-spray/v4/pkg/helm"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// Scheme of the objects checked by the pre-flight checks: the built-in objects known by client-go, plus the
+// CustomResourceDefinitions
+var preflightScheme = func() *runtime.Scheme {
+	preflightScheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{scheme.AddToScheme, apiextensionsv1.AddToScheme, apiextensionsv1beta1.AddToScheme} {
+		if err := addToScheme(preflightScheme); err != nil {
+			panic(err)
+		}
+	}
+	return preflightScheme
+}()
+
+var preflightCodecs = serializer.NewCodecFactory(preflightScheme)
+
+// API groups of built-in objects whose types are not known by the pre-flight checks: their objects are only checked to
+// be well-formed
+var unstructuredGroups = []string{"apiregistration.k8s.io"}
+
+// Checks run before the first upgrade, so that nothing is changed in the cluster when they fail:
+//   - the values of each targeted release are validated against the schemas of the umbrella chart and of the sub-chart,
+//   - each targeted release is rendered locally, and the rendered objects shall be valid Kubernetes objects, or
+//     custom resources of known kinds or served by the cluster (a warning is issued for the other custom resources),
+//   - the API versions of the rendered objects shall be served by the cluster, and a warning is issued for the API
+//     versions that are removed in the next Kubernetes release.
+//
+// The failures of all the releases are reported at once.
+func (s *Spray) preflight(releases map[string]helm.Release, deps []dependencies.Dependency) error {
+	if s.SkipPreflight {
+		if s.Verbose {
+			s.logger().Info(1, "skipping pre-flight checks")
+		}
+		return nil
+	}
+	for _, file := range s.valuesOpts.ValueFiles {
+		if file == "-" {
+			s.logger().Info(1, "warning: values read from stdin, skipping pre-flight checks")
+			return nil
+		}
+	}
+	s.logger().Info(1, "running pre-flight checks...")
+
+	// The capabilities of the cluster are used for rendering the releases and for checking the API versions
+	capabilities, err := s.discoverCluster()
+	if err != nil {
+		s.preflightWarning(fmt.Sprintf("cannot discover the API versions served by the cluster, skipping their check: %s", err))
+	}
+
+	failures := make([]string, 0)
+	rendered := make(map[string][]render.Manifest)
+	renderedReleases := make([]dependencies.Dependency, 0)
+	allManifests := make([]render.Manifest, 0)
+	for _, dependency := range deps {
+		if !dependency.Targeted || !dependency.AllowedByTags {
+			continue
+		}
+		if s.Verbose {
+			s.logger().Info(2, "checking release \"%s\"...", dependency.CorrespondingReleaseName)
+		}
+		releaseValues, err := s.releaseValues(releases, dependency, deps)
+		if err != nil {
+			return fmt.Errorf("computing values of release \"%s\": %w", dependency.CorrespondingReleaseName, err)
+		}
+		if !s.SkipSchemaValidation {
+			if err := validateSchema(s.ChartName, releaseValues); err != nil {
+				failures = append(failures, s.preflightFailure(dependency, "values do not match the schemas", err))
+				continue
+			}
+		}
+		_, upgrade := releases[dependency.CorrespondingReleaseName]
+		release := render.Release{Name: dependency.CorrespondingReleaseName, Namespace: s.Namespace, IsUpgrade: upgrade, Capabilities: capabilities}
+		manifests, err := render.Render(s.ChartName, release, releaseValues)
+		if err != nil {
+			failures = append(failures, s.preflightFailure(dependency, "rendering failed", err))
+			continue
+		}
+		rendered[dependency.CorrespondingReleaseName] = manifests
+		renderedReleases = append(renderedReleases, dependency)
+		allManifests = append(allManifests, manifests...)
+	}
+
+	// Custom resources may be defined by any release of the umbrella chart
+	crdKinds, err := render.CRDKinds(s.ChartName, allManifests)
+	if err != nil {
+		return fmt.Errorf("analyzing custom resource definitions: %w", err)
+	}
+	knownKinds := append(crdKinds, s.KnownKinds...)
+	var servedVersions chartutil.VersionSet
+	if capabilities != nil {
+		servedVersions = capabilities.APIVersions
+	}
+	for _, dependency := range renderedReleases {
+		warnings, err := checkManifests(rendered[dependency.CorrespondingReleaseName], knownKinds, servedVersions)
+		if err != nil {
+			failures = append(failures, s.preflightFailure(dependency, "invalid rendered objects", err))
+		}
+		for _, warning := range warnings {
+			s.preflightWarning(fmt.Sprintf("release \"%s\": %s", dependency.CorrespondingReleaseName, warning))
+		}
+		if capabilities == nil {
+			continue
+		}
+		if err := s.checkAPIVersions(dependency, rendered[dependency.CorrespondingReleaseName], capabilities, crdKinds); err != nil {
+			failures = append(failures, s.preflightFailure(dependency, "API versions not served by the cluster", err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("pre-flight checks failed for %d release(s), spray interrupted:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+func (s *Spray) preflightFailure(dependency dependencies.Dependency, reason string, err error) string {
+	failure := fmt.Sprintf("release \"%s\" (sub-chart \"%s\"): %s:\n  %s", dependency.CorrespondingReleaseName, dependency.UsedName, reason, strings.ReplaceAll(strings.TrimSpace(err.Error()), "\n", "\n  "))
+	s.report.Diagnostics = append(s.report.Diagnostics, failure)
+	return failure
+}
+
+func (s *Spray) preflightWarning(warning string) {
+	s.logger().Info(1, "warning: %s", warning)
+	s.report.Warnings = append(s.report.Warnings, warning)
+}
+
+// Get the version and the API versions served by the cluster
+func (s *Spray) discoverCluster() (*chartutil.Capabilities, error) {
+	serverVersion, err := s.kubectlClient().GetServerVersion(s.Kube, s.Debug)
+	if err != nil {
+		return nil, fmt.Errorf("getting server version: %w", err)
+	}
+	apiVersions, err := s.kubectlClient().GetAPIVersions(s.Kube, s.Debug)
+	if err != nil {
+		return nil, fmt.Errorf("getting API versions: %w", err)
+	}
+	if s.Verbose {
+		s.logger().Info(2, "cluster version is %s, serving %d API versions", serverVersion.GitVersion, len(apiVersions))
+	}
+	return &chartutil.Capabilities{
+		KubeVersion: chartutil.KubeVersion{
+			Version: serverVersion.GitVersion,
+			Major:   serverVersion.Major,
+			Minor:   serverVersion.Minor,
+		},
+		APIVersions: apiVersions,
+		HelmVersion: chartutil.DefaultCapabilities.HelmVersion,
+	}, nil
+}
+
+// Check that the API versions of the rendered objects are served by the cluster (except for the custom resources whose
+// definitions are part of the chart), and warn about the objects whose API versions are removed in the next Kubernetes
+// release
+func (s *Spray) checkAPIVersions(dependency dependencies.Dependency, manifests []render.Manifest, capabilities *chartutil.Capabilities, crdKinds []string) error {
+	currentMinor, hasMinor := apis.MinorVersion(capabilities.KubeVersion.Version)
+	errs := make([]string, 0)
+	for _, manifest := range manifests {
+		if manifest.APIVersion == "" {
+			continue
+		}
+		if !capabilities.APIVersions.Has(manifest.APIVersion) && !isKnownKind(manifest, crdKinds) {
+			message := fmt.Sprintf("%s: %s \"%s\": API version \"%s\" is not served by the cluster (version %s)", manifest.Template, manifest.Kind, manifest.Name, manifest.APIVersion, capabilities.KubeVersion.Version)
+			if removal, ok := apis.RemovalOf(manifest.APIVersion, manifest.Kind); ok {
+				message = fmt.Sprintf("%s, it has been removed in Kubernetes %s, use %s instead", message, removal.RemovedIn, removal.Replacement)
+			}
+			errs = append(errs, message)
+			continue
+		}
+		removal, ok := apis.RemovalOf(manifest.APIVersion, manifest.Kind)
+		if !ok || !hasMinor {
+			continue
+		}
+		if removedMinor, ok := apis.MinorVersion(removal.RemovedIn); ok && removedMinor == currentMinor+1 {
+			s.preflightWarning(fmt.Sprintf("release \"%s\": %s: %s \"%s\" uses API version \"%s\", which is removed in Kubernetes %s, use %s instead", dependency.CorrespondingReleaseName, manifest.Template, manifest.Kind, manifest.Name, manifest.APIVersion, removal.RemovedIn, removal.Replacement))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Compute the values supplied to the release of a dependency, as given to helm upgrade: the values files (including the
+// processed values of the umbrella chart), the '--set*' flags and the "<dependency>.enabled" flags.
+// With '--reuse-values', the values of the current revision of the release are used as a base, as helm does.
+func (s *Spray) releaseValues(releases map[string]helm.Release, dependency dependencies.Dependency, deps []dependencies.Dependency) (map[string]interface{}, error) {
+	opts := s.valuesOpts
+	opts.Values = s.valuesSet(dependency, deps)
+	releaseValues, err := values.Provided(&opts, s.getterOptions())
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := releases[dependency.CorrespondingReleaseName]; ok && s.ReuseValues && !s.ResetValues {
+		currentValues, err := s.helmClient().GetValues(3, s.Kube, s.Namespace, dependency.CorrespondingReleaseName, s.Debug)
+		if err != nil {
+			return nil, fmt.Errorf("getting values of the current revision: %w", err)
+		}
+		releaseValues = chartutil.CoalesceTables(releaseValues, currentValues)
+	}
+	return releaseValues, nil
+}
+
+// Validate the values of a release against the schemas of the umbrella chart and of its enabled sub-charts, the same
+// way helm does before rendering the chart
+func validateSchema(chartPath string, releaseValues map[string]interface{}) error {
+	// The chart is loaded for each release, as the processing of the dependencies updates it
+	chart, err := loader.Load(chartPath)
+	if err != nil {
+		return fmt.Errorf("loading chart \"%s\": %w", chartPath, err)
+	}
+	if err := chartutil.ProcessDependenciesWithMerge(chart, releaseValues); err != nil {
+		return fmt.Errorf("processing dependencies: %w", err)
+	}
+	coalescedValues, err := chartutil.CoalesceValues(chart, releaseValues)
+	if err != nil {
+		return fmt.Errorf("merging values with chart: %w", err)
+	}
+	return chartutil.ValidateAgainstSchema(chart, coalescedValues)
+}
+
+// Check that the rendered objects can be decoded as Kubernetes objects, or are custom resources of known kinds, given as
+// "<apiVersion>/<kind>" or "<kind>", or of API versions served by the cluster (nil when they could not be discovered).
+// The objects of API groups unknown to the pre-flight checks and not served by the cluster are returned as warnings, as
+// their definitions may be installed outside of the chart.
+func checkManifests(manifests []render.Manifest, knownKinds []string, servedVersions chartutil.VersionSet) ([]string, error) {
+	warnings := make([]string, 0)
+	errs := make([]string, 0)
+	for _, manifest := range manifests {
+		err := decodeManifest(manifest)
+		if err == nil || isKnownKind(manifest, knownKinds) {
+			continue
+		}
+		if runtime.IsNotRegisteredError(err) && !preflightScheme.IsGroupRegistered(groupOf(manifest.APIVersion)) {
+			if !servedVersions.Has(manifest.APIVersion) {
+				warnings = append(warnings, fmt.Sprintf("%s: %s \"%s\" (%s): kind neither defined by the chart nor served by the cluster, not checked", manifest.Template, manifest.Kind, manifest.Name, manifest.APIVersion))
+			}
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s \"%s\" (%s): %s", manifest.Template, manifest.Kind, manifest.Name, manifest.APIVersion, err))
+	}
+	if len(errs) > 0 {
+		return warnings, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return warnings, nil
+}
+
+// Decode a rendered object, as a typed object, or as an unstructured object for the built-in groups without types
+func decodeManifest(manifest render.Manifest) error {
+	_, _, err := preflightCodecs.UniversalDeserializer().Decode([]byte(manifest.Content), nil, nil)
+	if err == nil || !runtime.IsNotRegisteredError(err) {
+		return err
+	}
+	group := groupOf(manifest.APIVersion)
+	for _, unstructuredGroup := range unstructuredGroups {
+		if group != unstructuredGroup {
+			continue
+		}
+		content, jsonErr := yaml.YAMLToJSON([]byte(manifest.Content))
+		if jsonErr != nil {
+			return jsonErr
+		}
+		_, _, err = unstructured.UnstructuredJSONScheme.Decode(content, nil, &unstructured.Unstructured{})
+		return err
+	}
+	return err
+}
+
+// Group of an API version, empty for the core group
+func groupOf(apiVersion string) string {
+	if i := strings.Index(apiVersion, "/"); i > 0 {
+		return apiVersion[:i]
+	}
+	return ""
+}
+
+func isKnownKind(manifest render.Manifest, knownKinds []string) bool {
+	if manifest.Kind == "" {
+		return false
+	}
+	for _, kind := range knownKinds {
+		if kind == manifest.Kind || kind == manifest.APIVersion+"/"+manifest.Kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package helmspray
+
+import (
+	"github.com/gemalto/helm-spray/v4/pkg/notify"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"time"
+)
+
+// Report gathers the outcome of a spray
+type Report struct {
+	Cluster     string          `json:"cluster,omitempty"`
+	Chart       string          `json:"chart"`
+	ChartDigest string          `json:"chartDigest,omitempty"`
+	ChartSigner string          `json:"chartSigner,omitempty"`
+	Namespace   string          `json:"namespace"`
+	StartTime   time.Time       `json:"startTime"`
+	Duration    time.Duration   `json:"duration"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	Diagnostics []string        `json:"diagnostics,omitempty"`
+	Warnings    []string        `json:"warnings,omitempty"`
+	Releases    []ReleaseResult `json:"releases"`
+}
+
+// ReleaseResult ...
+type ReleaseResult struct {
+	Name       string        `json:"name"`
+	SubChart   string        `json:"subChart"`
+	Weight     int           `json:"weight"`
+	AppVersion string        `json:"appVersion,omitempty"`
+	Revision   int           `json:"revision"`
+	Status     string        `json:"status"`
+	Duration   time.Duration `json:"duration"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// Statuses of a spray
+const (
+	StatusInProgress  = "in-progress"
+	StatusSucceeded   = "succeeded"
+	StatusFailed      = "failed"
+	StatusInterrupted = "interrupted"
+)
+
+// Log the status of the releases of an interrupted spray
+func (s *Spray) logProgress() {
+	s.logger().Info(1, "progress of the interrupted spray:")
+	for _, r := range s.report.Releases {
+		if r.Revision > 0 {
+			s.logger().Info(2, "release \"%s\" (weight %d): %s (revision %d)", r.Name, r.Weight, r.Status, r.Revision)
+		} else {
+			s.logger().Info(2, "release \"%s\" (weight %d): %s", r.Name, r.Weight, r.Status)
+		}
+	}
+}
+
+func (s *Spray) notify(eventType string, weight *int) {
+	if s.notifier == nil && s.EventSink == nil {
+		return
+	}
+	event := notify.Event{
+		Type:        eventType,
+		Timestamp:   time.Now(),
+		Cluster:     s.report.Cluster,
+		Chart:       s.report.Chart,
+		ChartDigest: s.report.ChartDigest,
+		ChartSigner: s.report.ChartSigner,
+		Namespace:   s.report.Namespace,
+		Weight:      weight,
+		Error:       s.report.Error,
+	}
+	if eventType == notify.SprayFailed {
+		event.Diagnostics = s.report.Diagnostics
+	}
+	if eventType == notify.SprayCompleted || eventType == notify.SprayFailed {
+		event.Duration = util.Duration(time.Since(s.report.StartTime))
+		event.Warnings = s.report.Warnings
+	}
+	for _, r := range s.report.Releases {
+		if weight == nil || r.Weight == *weight {
+			event.Releases = append(event.Releases, notify.Release{
+				Name:     r.Name,
+				Weight:   r.Weight,
+				Revision: r.Revision,
+				Status:   r.Status,
+				Duration: util.Duration(r.Duration),
+			})
+		}
+	}
+	if s.EventSink != nil {
+		s.EventSink.Event(event)
+	}
+	if s.notifier == nil {
+		return
+	}
+	if err := s.notifier.Notify(event); err != nil {
+		s.logger().Info(1, "warning: sending notification: %s", err)
+	}
+}
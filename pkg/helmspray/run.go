@@ -0,0 +1,169 @@
+package helmspray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/pkg/helm"
+	"os"
+	"strings"
+)
+
+// Run sprays the umbrella chart, after fetching it if needed, and returns the report of the spray, with the result of
+// each release, whether the spray succeeded or not (nil if the spray could not start).
+// The spray is interrupted when the context is cancelled or when its deadline is exceeded: the releases are not
+// upgraded anymore, and the wait for the readiness of the releases stops. A helm upgrade already running is given the
+// grace period of the spray to complete: past it, the helm process is killed (and given a few more seconds to release
+// its output), then the release is rolled back to its previous revision, or uninstalled if it was its first revision.
+func (s *Spray) Run(ctx context.Context) (*Report, error) {
+	s.ctx = ctx
+	defer func() { s.ctx = nil }()
+
+	if err := s.FetchChart(); err != nil {
+		return nil, err
+	}
+	err := s.Spray()
+	if s.report.Status == "" {
+		return nil, err
+	}
+	report := s.report
+	return &report, err
+}
+
+// RunClusters sprays the umbrella chart into each of the clusters, after fetching it if needed, as Run does for a
+// single cluster
+func (s *Spray) RunClusters(ctx context.Context) ([]ClusterResult, error) {
+	s.ctx = ctx
+	defer func() { s.ctx = nil }()
+
+	if err := s.FetchChart(); err != nil {
+		return nil, err
+	}
+	return s.SprayClusters()
+}
+
+// Validate checks the consistency of the options, and reads the password of the chart repository from its file
+func (s *Spray) Validate() error {
+	if s.ChartName == "" {
+		return errors.New("no chart to spray")
+	}
+
+	if s.ChartVersion != "" {
+		if strings.HasSuffix(s.ChartName, "tgz") {
+			return errors.New("cannot use --version together with chart archive")
+		}
+
+		if _, err := os.Stat(s.ChartName); err == nil {
+			return errors.New("cannot use --version together with chart directory")
+		}
+
+		if strings.HasPrefix(s.ChartName, "http://") || strings.HasPrefix(s.ChartName, "https://") {
+			return errors.New("cannot use --version together with chart HTTP(S) URL")
+		}
+	}
+
+	if s.ChartFetch.Repository.URL != "" && strings.Contains(s.ChartName, "://") {
+		return errors.New("cannot use --repo together with chart URL")
+	}
+	if err := s.ChartFetch.Repository.ReadPasswordFile(); err != nil {
+		return err
+	}
+
+	if s.PrefixReleasesWithNamespace && s.PrefixReleases != "" {
+		return errors.New("cannot use both --prefix-releases and --prefix-releases-with-namespace together")
+	}
+
+	if len(s.Targets) > 0 && len(s.Excludes) > 0 {
+		return errors.New("cannot use both --target and --exclude together")
+	}
+	return nil
+}
+
+// FetchChart fetches the chart into the chart cache if it is not a local file or directory, the chart name being then
+// the path of the fetched archive. Does nothing if the chart has already been fetched.
+func (s *Spray) FetchChart() error {
+	if s.FetchedChart.Path != "" && s.FetchedChart.Path == s.ChartName {
+		return nil
+	}
+
+	// If chart is specified through an URL, then fetch it from the URL.
+	if s.ChartFetch.Repository.URL != "" {
+		if s.ChartVersion != "" {
+			s.logger().Info(1, "fetching chart \"%s\" from repo \"%s\" with version \"%s\"...", s.ChartName, s.ChartFetch.Repository.URL, s.ChartVersion)
+		} else {
+			s.logger().Info(1, "fetching chart \"%s\" from repo \"%s\"...", s.ChartName, s.ChartFetch.Repository.URL)
+		}
+		return s.fetch()
+	} else if strings.HasPrefix(s.ChartName, "http://") || strings.HasPrefix(s.ChartName, "https://") || strings.HasPrefix(s.ChartName, "oci://") {
+		if s.ChartVersion != "" {
+			s.logger().Info(1, "fetching chart from URL \"%s\" with version \"%s\"...", s.ChartName, s.ChartVersion)
+		} else {
+			s.logger().Info(1, "fetching chart from URL \"%s\"...", s.ChartName)
+		}
+		return s.fetch()
+	} else if _, err := os.Stat(s.ChartName); err != nil {
+		// If local file (or directory) does not exist, then fetch it from a repo.
+		if s.ChartVersion != "" {
+			s.logger().Info(1, "fetching chart \"%s\" from repos with version \"%s\"...", s.ChartName, s.ChartVersion)
+		} else {
+			s.logger().Info(1, "fetching chart \"%s\" from repos...", s.ChartName)
+		}
+		return s.fetch()
+	}
+
+	if s.ChartFetch.Verify || s.ChartFetch.Digest != "" {
+		return errors.New("cannot use --verify or --chart-digest together with local chart file or directory")
+	}
+	s.logger().Info(1, "processing chart from local file or directory \"%s\"...", s.ChartName)
+	return nil
+}
+
+func (s *Spray) fetch() error {
+	options := s.ChartFetch
+	options.Log = s.logger()
+	fetchedChart, err := helm.Fetch(s.ChartName, s.ChartVersion, options, s.Debug)
+	if err != nil {
+		return fmt.Errorf("fetching chart %s with version %s: %w", s.ChartName, s.ChartVersion, err)
+	}
+	if fetchedChart.Signer != "" {
+		s.logger().Info(1, "chart \"%s\" verified, signed by %s", s.ChartName, fetchedChart.Signer)
+	}
+	if s.Verbose {
+		s.logger().Info(2, "chart archive \"%s\" has digest %s", fetchedChart.Path, fetchedChart.Digest)
+	}
+	s.ChartName = fetchedChart.Path
+	s.FetchedChart = fetchedChart
+	return nil
+}
+
+// SetFromHelmEnv sets the options transmitted through envvars when called through helm: the debug mode, the namespace
+// and the cluster connection options, plus the credentials of the chart repositories
+func (s *Spray) SetFromHelmEnv() {
+	// When called through helm, debug mode is transmitted through the HELM_DEBUG envvar
+	helmDebug := os.Getenv("HELM_DEBUG")
+	if helmDebug == "1" || strings.EqualFold(helmDebug, "true") || strings.EqualFold(helmDebug, "on") {
+		s.Debug = true
+	}
+	if s.Debug {
+		s.Verbose = true
+	}
+
+	// When called through helm, the cluster connection options are transmitted through the HELM_KUBE* envvars; KUBECONFIG,
+	// which may be a list of files, is inherited as is by helm and kubectl
+	s.Kube.Context = os.Getenv("HELM_KUBECONTEXT")
+	s.Kube.APIServer = os.Getenv("HELM_KUBEAPISERVER")
+	s.Kube.Token = os.Getenv("HELM_KUBETOKEN")
+	s.Kube.AsUser = os.Getenv("HELM_KUBEASUSER")
+
+	// Credentials of the chart repositories and registries, so that they are not given on the command line
+	s.ChartFetch.Repository.Username = os.Getenv("HELM_SPRAY_REPO_USERNAME")
+	s.ChartFetch.Repository.Password = os.Getenv("HELM_SPRAY_REPO_PASSWORD")
+
+	// When called through helm, namespace is transmitted through the HELM_NAMESPACE envvar
+	namespace := os.Getenv("HELM_NAMESPACE")
+	if len(namespace) > 0 {
+		s.Namespace = namespace
+	} else {
+		s.Namespace = "default"
+	}
+}
@@ -0,0 +1,138 @@
+package helmspray
+
+import (
+	"fmt"
+	"github.com/gemalto/helm-spray/v4/internal/dependencies"
+	"github.com/gemalto/helm-spray/v4/internal/render"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// IndexFileName is the name of the file listing the rendered releases in the output directory of the template command
+const IndexFileName = "index.yaml"
+
+// TemplateIndex lists the releases rendered by the template command, in their order of deployment
+type TemplateIndex struct {
+	Chart     string             `json:"chart"`
+	Namespace string             `json:"namespace"`
+	Releases  []TemplatedRelease `json:"releases"`
+}
+
+// TemplatedRelease ...
+type TemplatedRelease struct {
+	Name       string `json:"name"`
+	SubChart   string `json:"subChart"`
+	Weight     int    `json:"weight"`
+	Order      int    `json:"order"`
+	AppVersion string `json:"appVersion,omitempty"`
+	File       string `json:"file"`
+	Objects    int    `json:"objects"`
+	Hooks      int    `json:"hooks,omitempty"`
+}
+
+// Template renders locally the manifests of the targeted releases, with the values that a spray would give them, without
+// any access to the cluster. The manifests of each release are written into a file of the output directory, along with
+// an index file listing the releases in their order of deployment.
+func (s *Spray) Template() (TemplateIndex, error) {
+	defer s.removeTempDir()
+
+	_, deps, _, err := s.prepare()
+	if err != nil {
+		return TemplateIndex{}, err
+	}
+	err = checkTargetsAndExcludes(deps, s.Targets, s.Excludes)
+	if err != nil {
+		return TemplateIndex{}, fmt.Errorf("checking targets and excludes: %w", err)
+	}
+	for _, file := range s.valuesOpts.ValueFiles {
+		if file == "-" {
+			return TemplateIndex{}, fmt.Errorf("values cannot be read from stdin when rendering the releases")
+		}
+	}
+
+	capabilities, err := s.templateCapabilities()
+	if err != nil {
+		return TemplateIndex{}, err
+	}
+
+	s.logger().Info(1, "rendering solution chart \"%s\" into directory \"%s\"...", s.ChartName, s.OutputDir)
+	if err := os.MkdirAll(s.OutputDir, 0755); err != nil {
+		return TemplateIndex{}, fmt.Errorf("creating output directory: %w", err)
+	}
+
+	index := TemplateIndex{Chart: s.ChartName, Namespace: s.Namespace, Releases: make([]TemplatedRelease, 0)}
+	for _, dependency := range targetedInOrder(deps) {
+		release, err := s.templateRelease(dependency, deps, capabilities)
+		if err != nil {
+			return index, fmt.Errorf("rendering release \"%s\": %w", dependency.CorrespondingReleaseName, err)
+		}
+		release.Order = len(index.Releases) + 1
+		index.Releases = append(index.Releases, release)
+	}
+
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		return index, fmt.Errorf("generating index file: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(s.OutputDir, IndexFileName), data, 0644); err != nil {
+		return index, fmt.Errorf("writing index file: %w", err)
+	}
+
+	s.logger().Info(1, "%d release(s) of solution chart \"%s\" rendered", len(index.Releases), s.ChartName)
+	return index, nil
+}
+
+func (s *Spray) templateRelease(dependency dependencies.Dependency, deps []dependencies.Dependency, capabilities *chartutil.Capabilities) (TemplatedRelease, error) {
+	if s.Verbose {
+		s.logger().Info(2, "rendering release \"%s\" (weight %d)...", dependency.CorrespondingReleaseName, dependency.Weight)
+	}
+	releaseValues, err := s.releaseValues(nil, dependency, deps)
+	if err != nil {
+		return TemplatedRelease{}, fmt.Errorf("computing values: %w", err)
+	}
+	release := render.Release{Name: dependency.CorrespondingReleaseName, Namespace: s.Namespace, Capabilities: capabilities}
+	manifests, err := render.Render(s.ChartName, release, releaseValues)
+	if err != nil {
+		return TemplatedRelease{}, err
+	}
+
+	result := TemplatedRelease{
+		Name:       dependency.CorrespondingReleaseName,
+		SubChart:   dependency.UsedName,
+		Weight:     dependency.Weight,
+		AppVersion: dependency.AppVersion,
+		File:       dependency.CorrespondingReleaseName + ".yaml",
+	}
+	var sb strings.Builder
+	for _, manifest := range manifests {
+		if manifest.Hook {
+			result.Hooks++
+		} else {
+			result.Objects++
+		}
+		sb.WriteString("---\n# Source: " + manifest.Template + "\n")
+		sb.WriteString(strings.TrimSpace(manifest.Content) + "\n")
+	}
+	if err := os.WriteFile(filepath.Join(s.OutputDir, result.File), []byte(sb.String()), 0644); err != nil {
+		return TemplatedRelease{}, fmt.Errorf("writing manifests: %w", err)
+	}
+	return result, nil
+}
+
+// Capabilities used for rendering the releases: the default helm ones, overridden by '--kube-version' and
+// '--api-versions'
+func (s *Spray) templateCapabilities() (*chartutil.Capabilities, error) {
+	capabilities := chartutil.DefaultCapabilities.Copy()
+	if s.KubeVersion != "" {
+		kubeVersion, err := chartutil.ParseKubeVersion(s.KubeVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kube version \"%s\": %w", s.KubeVersion, err)
+		}
+		capabilities.KubeVersion = *kubeVersion
+	}
+	capabilities.APIVersions = append(capabilities.APIVersions, s.APIVersions...)
+	return capabilities, nil
+}
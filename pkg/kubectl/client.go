@@ -0,0 +1,28 @@
+package kubectl
+
+import (
+	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+)
+
+// Client runs the kubectl commands of a spray and of its hooks. CLI runs the kubectl binary, other implementations (like
+// the in-memory cluster of package fake) allow a spray to be run without any cluster.
+type Client interface {
+	AreDeploymentsReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error)
+	AreStatefulSetsReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error)
+	AreJobsReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error)
+	AreServicesReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error)
+	AreIngressesReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error)
+	ArePersistentVolumeClaimsBound(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error)
+	IsJobFailed(name string, kube util.KubeConfig, namespace string, debug bool) (bool, error)
+	GetJobLogs(name string, kube util.KubeConfig, namespace string) (string, error)
+	Create(manifest []byte, kube util.KubeConfig, namespace string, debug bool) error
+	DeleteJob(name string, kube util.KubeConfig, namespace string, debug bool) error
+	GetAPIVersions(kube util.KubeConfig, debug bool) ([]string, error)
+	GetServerVersion(kube util.KubeConfig, debug bool) (ServerVersion, error)
+}
+
+// CLI is the Client running the kubectl binary, logging through Log (to stdout and stderr when nil)
+type CLI struct {
+	Log *log.Logger
+}
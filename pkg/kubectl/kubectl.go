@@ -14,51 +14,56 @@ limitations under the License.
 */
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 
-	"github.com/gemalto/helm-spray/v4/internal/log"
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
-func GetDeployments(namespace string) ([]string, error) {
-	return getWorkloads("deployments", namespace)
+func (c CLI) GetDeployments(kube util.KubeConfig, namespace string) ([]string, error) {
+	return c.getWorkloads("deployments", kube, namespace)
 }
 
-func GetStatefulSets(namespace string) ([]string, error) {
-	return getWorkloads("statefulsets", namespace)
+func (c CLI) GetStatefulSets(kube util.KubeConfig, namespace string) ([]string, error) {
+	return c.getWorkloads("statefulsets", kube, namespace)
 }
 
-func GetJobs(namespace string) ([]string, error) {
-	return getWorkloads("jobs", namespace)
+func (c CLI) GetJobs(kube util.KubeConfig, namespace string) ([]string, error) {
+	return c.getWorkloads("jobs", kube, namespace)
 }
 
-func AreDeploymentsReady(names []string, namespace string, debug bool) (bool, error) {
-	return areWorkloadsReady("deployment", names, namespace, debug)
+func (c CLI) AreDeploymentsReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areWorkloadsReady("deployment", names, kube, namespace, debug)
 }
 
-func AreStatefulSetsReady(names []string, namespace string, debug bool) (bool, error) {
-	return areWorkloadsReady("statefulset", names, namespace, debug)
+func (c CLI) AreStatefulSetsReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areWorkloadsReady("statefulset", names, kube, namespace, debug)
 }
 
-func AreJobsReady(names []string, namespace string, debug bool) (bool, error) {
+func (c CLI) AreJobsReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
 	for _, name := range names {
-		cmd := exec.Command("kubectl", "--namespace", namespace, "get", "job", name, "--output=jsonpath={.status.succeeded}")
-		cmd.Stderr = os.Stderr
-		result, err := cmd.Output()
+		cmd := command(kube, namespace, "get", "job", name, "--output=jsonpath={.status.succeeded}")
+		result, err := c.output(kube, cmd)
 		if err != nil {
 			// Cannot make the difference between an error when calling kubectl and no corresponding resource found. Return "" in any case.
 			return false, err
 		}
 		strResult := string(result)
 		if debug {
-			log.Info(3, "kubectl output: %s", strResult)
+			c.Log.Info(3, "kubectl output: %s", strResult)
 		}
 		succeeded, _ := strconv.Atoi(strResult)
 		if succeeded < 1 {
 			if debug {
-				log.Info(3, "job %s is not completed", name)
+				c.Log.Info(3, "job %s is not completed", name)
 			}
 			return false, nil
 		}
@@ -66,10 +71,138 @@ func AreJobsReady(names []string, namespace string, debug bool) (bool, error) {
 	return true, nil
 }
 
-func getWorkloads(k8sObjectType string, namespace string) ([]string, error) {
-	cmd := exec.Command("kubectl", "--namespace", namespace, "get", k8sObjectType, "--output=jsonpath={.items..metadata.name}")
-	cmd.Stderr = os.Stderr
-	result, err := cmd.Output()
+func (c CLI) IsJobFailed(name string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	cmd := command(kube, namespace, "get", "job", name, "--output=jsonpath={.status.conditions[?(@.type==\"Failed\")].status}")
+	result, err := c.output(kube, cmd)
+	if err != nil {
+		return false, err
+	}
+	strResult := strings.TrimSpace(string(result))
+	if debug {
+		c.Log.Info(3, "kubectl output: %s", strResult)
+	}
+	return strResult == "True", nil
+}
+
+func (c CLI) GetJobLogs(name string, kube util.KubeConfig, namespace string) (string, error) {
+	cmd := command(kube, namespace, "logs", "job/"+name, "--all-containers")
+	remove, err := withToken(cmd, kube)
+	if err != nil {
+		return "", err
+	}
+	defer remove()
+	result, err := cmd.CombinedOutput()
+	return string(result), err
+}
+
+// Create the objects described by the given manifest (YAML or JSON)
+func (c CLI) Create(manifest []byte, kube util.KubeConfig, namespace string, debug bool) error {
+	cmd := command(kube, namespace, "create", "-f", "-")
+	cmd.Stdin = bytes.NewReader(manifest)
+	result, err := c.output(kube, cmd)
+	if debug {
+		c.Log.Info(3, "kubectl output: %s", string(result))
+	}
+	return err
+}
+
+// DeleteJob deletes a job and its pods, without waiting for their deletion
+func (c CLI) DeleteJob(name string, kube util.KubeConfig, namespace string, debug bool) error {
+	cmd := command(kube, namespace, "delete", "job", name, "--ignore-not-found", "--cascade=background", "--wait=false")
+	result, err := c.output(kube, cmd)
+	if debug {
+		c.Log.Info(3, "kubectl output: %s", string(result))
+	}
+	return err
+}
+
+// Services of type LoadBalancer are ready when an ingress point (ip or hostname) has been assigned
+func (c CLI) AreServicesReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areObjectsReady("service", "{.status.loadBalancer.ingress}", names, kube, namespace, debug, func(output string) bool {
+		return len(output) > 0
+	})
+}
+
+// Ingresses are ready when an address has been published in their status
+func (c CLI) AreIngressesReady(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areObjectsReady("ingress", "{.status.loadBalancer.ingress}", names, kube, namespace, debug, func(output string) bool {
+		return len(output) > 0
+	})
+}
+
+// PersistentVolumeClaims are ready when they are bound to a PersistentVolume
+func (c CLI) ArePersistentVolumeClaimsBound(names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
+	return c.areObjectsReady("persistentvolumeclaim", "{.status.phase}", names, kube, namespace, debug, func(output string) bool {
+		return output == "Bound"
+	})
+}
+
+// GetAPIVersions returns the API versions served by the cluster, as "<group>/<version>" ("v1" for the core group)
+func (c CLI) GetAPIVersions(kube util.KubeConfig, debug bool) ([]string, error) {
+	cmd := exec.Command("kubectl", append(kubectlArgs(kube), "api-versions")...)
+	result, err := c.output(kube, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if debug {
+		c.Log.Info(3, "kubectl output: %s", string(result))
+	}
+	return strings.Fields(string(result)), nil
+}
+
+// ServerVersion is the version of the Kubernetes API server of the cluster
+type ServerVersion struct {
+	Major      string `json:"major"`
+	Minor      string `json:"minor"`
+	GitVersion string `json:"gitVersion"`
+}
+
+// GetServerVersion returns the version of the Kubernetes API server of the cluster
+func (c CLI) GetServerVersion(kube util.KubeConfig, debug bool) (ServerVersion, error) {
+	cmd := exec.Command("kubectl", append(kubectlArgs(kube), "version", "-o", "json")...)
+	result, err := c.output(kube, cmd)
+	if err != nil {
+		return ServerVersion{}, err
+	}
+	if debug {
+		c.Log.Info(3, "kubectl output: %s", string(result))
+	}
+	var versions struct {
+		ServerVersion *ServerVersion `json:"serverVersion"`
+	}
+	if err := json.Unmarshal(result, &versions); err != nil {
+		return ServerVersion{}, err
+	}
+	if versions.ServerVersion == nil {
+		return ServerVersion{}, errors.New("no server version returned by kubectl")
+	}
+	return *versions.ServerVersion, nil
+}
+
+func (c CLI) areObjectsReady(k8sObjectType string, jsonPath string, names []string, kube util.KubeConfig, namespace string, debug bool, isReady func(output string) bool) (bool, error) {
+	for _, name := range names {
+		cmd := command(kube, namespace, "get", k8sObjectType, name, "--output=jsonpath="+jsonPath)
+		result, err := c.output(kube, cmd)
+		if err != nil {
+			return false, err
+		}
+		strResult := strings.TrimSpace(string(result))
+		if debug {
+			c.Log.Info(3, "kubectl output: %s", strResult)
+		}
+		if !isReady(strResult) {
+			if debug {
+				c.Log.Info(3, "%s %s is not ready", k8sObjectType, name)
+			}
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c CLI) getWorkloads(k8sObjectType string, kube util.KubeConfig, namespace string) ([]string, error) {
+	cmd := command(kube, namespace, "get", k8sObjectType, "--output=jsonpath={.items..metadata.name}")
+	result, err := c.output(kube, cmd)
 	if err != nil {
 		// Cannot make the difference between an error when calling kubectl and no corresponding resource found. Return "" in any case.
 		return nil, err
@@ -77,38 +210,36 @@ func getWorkloads(k8sObjectType string, namespace string) ([]string, error) {
 	return strings.Split(string(result), " "), nil
 }
 
-func areWorkloadsReady(k8sObjectType string, names []string, namespace string, debug bool) (bool, error) {
+func (c CLI) areWorkloadsReady(k8sObjectType string, names []string, kube util.KubeConfig, namespace string, debug bool) (bool, error) {
 	if len(names) == 0 {
 		return true, nil
 	}
 	if debug {
 		template := generateTemplate(names, "{{$ready := 0}}{{if .status.readyReplicas}}{{$ready = .status.readyReplicas}}{{end}}{{$current := .spec.replicas}}{{if .status.currentReplicas}}{{$current = .status.currentReplicas}}{{end}}{{$updated := 0}}{{if .status.updatedReplicas}}{{$updated = .status.updatedReplicas}}{{end}}{{printf \"{name: %s, ready: %d, current: %d, updated: %d}\" .metadata.name $ready $current $updated}}")
-		log.Info(3, "kubectl template: %s", template)
-		cmd := exec.Command("kubectl", "--namespace", namespace, "get", k8sObjectType, "-o", "go-template="+template)
-		cmd.Stderr = os.Stderr
-		result, err := cmd.Output()
+		c.Log.Info(3, "kubectl template: %s", template)
+		cmd := command(kube, namespace, "get", k8sObjectType, "-o", "go-template="+template)
+		result, err := c.output(kube, cmd)
 		if err != nil {
 			// Activating debug logs should not generate additional errors so let's only warn the user and go further
 			// If there is a real error linked to kubectl execution, it will pop up just after
-			log.Info(3, "warning: cannot get kubectl output because of an error (%s)", err)
+			c.Log.Info(3, "warning: cannot get kubectl output because of an error (%s)", err)
 		} else {
-			log.Info(3, "kubectl output: %s", string(result))
+			c.Log.Info(3, "kubectl output: %s", string(result))
 		}
 	}
 	template := generateTemplate(names, "{{$ready := 0}}{{if .status.readyReplicas}}{{$ready = .status.readyReplicas}}{{end}}{{$current := .spec.replicas}}{{if .status.currentReplicas}}{{$current = .status.currentReplicas}}{{end}}{{$updated := 0}}{{if .status.updatedReplicas}}{{$updated = .status.updatedReplicas}}{{end}}{{if or (lt $ready .spec.replicas) (lt $current .spec.replicas) (lt $updated .spec.replicas)}}{{printf \"%s \" .metadata.name}}{{end}}")
 	if debug {
-		log.Info(3, "kubectl template: %s", template)
+		c.Log.Info(3, "kubectl template: %s", template)
 	}
-	cmd := exec.Command("kubectl", "--namespace", namespace, "get", k8sObjectType, "-o", "go-template="+template)
-	cmd.Stderr = os.Stderr
-	result, err := cmd.Output()
+	cmd := command(kube, namespace, "get", k8sObjectType, "-o", "go-template="+template)
+	result, err := c.output(kube, cmd)
 	if err != nil {
 		// Cannot make the difference between an error when calling kubectl and no corresponding resource found. Return false in any case.
 		return false, err
 	}
 	strResult := string(result)
 	if debug {
-		log.Info(3, "kubectl output: %s", strResult)
+		c.Log.Info(3, "kubectl output: %s", strResult)
 	}
 	if len(strResult) > 0 {
 		return false, nil
@@ -116,6 +247,74 @@ func areWorkloadsReady(k8sObjectType string, names []string, namespace string, d
 	return true, nil
 }
 
+// Run a command and return its standard output, its error output being logged
+func (c CLI) output(kube util.KubeConfig, cmd *exec.Cmd) ([]byte, error) {
+	remove, err := withToken(cmd, kube)
+	if err != nil {
+		return nil, err
+	}
+	defer remove()
+	stderr := c.Log.Stderr()
+	cmd.Stderr = stderr
+	result, err := cmd.Output()
+	_ = stderr.Close()
+	return result, err
+}
+
+func command(kube util.KubeConfig, namespace string, args ...string) *exec.Cmd {
+	myargs := append(kubectlArgs(kube), "--namespace", namespace)
+	return exec.Command("kubectl", append(myargs, args...)...)
+}
+
+// User of the kubeconfig holding the token
+const tokenUser = "helm-spray-token"
+
+// Arguments selecting the cluster and the credentials. With a token, the kubeconfig is given by withToken, through the
+// environment.
+func kubectlArgs(kube util.KubeConfig) []string {
+	if kube.Token == "" {
+		return kube.KubectlArgs()
+	}
+	kube.Kubeconfig = ""
+	return append(kube.KubectlArgs(), "--user", tokenUser)
+}
+
+// Give the token to a command through a temporary kubeconfig readable by the current user only, rather than on the
+// command line where any user of the machine can see it. This kubeconfig is merged with the one selecting the cluster,
+// and is removed by the returned function once the command has completed.
+func withToken(cmd *exec.Cmd, kube util.KubeConfig) (func(), error) {
+	if kube.Token == "" {
+		return func() {}, nil
+	}
+	config := clientcmdapi.NewConfig()
+	config.AuthInfos[tokenUser] = &clientcmdapi.AuthInfo{Token: kube.Token}
+	content, err := clientcmd.Write(*config)
+	if err != nil {
+		return nil, fmt.Errorf("writing kubeconfig of the token: %w", err)
+	}
+	file, err := os.CreateTemp("", "spray-kubeconfig-*.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("creating kubeconfig of the token: %w", err)
+	}
+	remove := func() { _ = os.Remove(file.Name()) }
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return nil, fmt.Errorf("writing kubeconfig of the token: %w", err)
+	}
+
+	kubeconfigs := clientcmd.NewDefaultClientConfigLoadingRules().GetLoadingPrecedence()
+	if kube.Kubeconfig != "" {
+		kubeconfigs = []string{kube.Kubeconfig}
+	}
+	kubeconfigs = append(kubeconfigs, file.Name())
+	cmd.Env = append(os.Environ(), clientcmd.RecommendedConfigPathEnvVar+"="+strings.Join(kubeconfigs, string(os.PathListSeparator)))
+	return remove, nil
+}
+
 func generateTemplate(names []string, test string) string {
 	var sb strings.Builder
 	sb.WriteString("{{range .items}}")
@@ -0,0 +1,51 @@
+package kubectl
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gemalto/helm-spray/v4/pkg/util"
+)
+
+func TestToken(t *testing.T) {
+	kube := util.KubeConfig{Context: "eu-context", Kubeconfig: "cluster.kubeconfig", Token: "s3cr3t"}
+	cmd := command(kube, "default", "get", "pods")
+	remove, err := withToken(cmd, kube)
+	if err != nil {
+		t.Fatalf("giving the token: %s", err)
+	}
+
+	// The token is not on the command line, but in a kubeconfig readable by the current user only, merged with the one
+	// selecting the cluster
+	if strings.Contains(strings.Join(cmd.Args, " "), "s3cr3t") || slices.Contains(cmd.Args, "--kubeconfig") || !slices.Contains(cmd.Args, tokenUser) {
+		t.Errorf("unexpected arguments %v", cmd.Args)
+	}
+	var kubeconfigs []string
+	for _, env := range cmd.Env {
+		if value, found := strings.CutPrefix(env, "KUBECONFIG="); found {
+			kubeconfigs = filepath.SplitList(value)
+		}
+	}
+	if len(kubeconfigs) != 2 || kubeconfigs[0] != "cluster.kubeconfig" {
+		t.Fatalf("unexpected kubeconfigs %v", kubeconfigs)
+	}
+	info, err := os.Stat(kubeconfigs[1])
+	if err != nil {
+		t.Fatalf("reading kubeconfig of the token: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the kubeconfig of the token to be readable by the current user only, got %s", info.Mode())
+	}
+	if content, _ := os.ReadFile(kubeconfigs[1]); !strings.Contains(string(content), "token: s3cr3t") {
+		t.Errorf("token not found in kubeconfig:\n%s", content)
+	}
+
+	// The kubeconfig is removed once the command has completed
+	remove()
+	if _, err := os.Stat(kubeconfigs[1]); !os.IsNotExist(err) {
+		t.Errorf("kubeconfig of the token not removed: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+)
+
+// Types of events sent during a spray
+const (
+	SprayStarted    = "spray-started"
+	WeightCompleted = "weight-completed"
+	SprayFailed     = "spray-failed"
+	SprayCompleted  = "spray-completed"
+)
+
+// Event ...
+type Event struct {
+	Type        string    `json:"type"`
+	Timestamp   time.Time `json:"timestamp"`
+	Cluster     string    `json:"cluster,omitempty"`
+	Chart       string    `json:"chart"`
+	ChartDigest string    `json:"chartDigest,omitempty"`
+	ChartSigner string    `json:"chartSigner,omitempty"`
+	Namespace   string    `json:"namespace"`
+	Weight      *int      `json:"weight,omitempty"`
+	Releases    []Release `json:"releases,omitempty"`
+	Duration    string    `json:"duration,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Diagnostics []string  `json:"diagnostics,omitempty"`
+	Warnings    []string  `json:"warnings,omitempty"`
+}
+
+// Release ...
+type Release struct {
+	Name     string `json:"name"`
+	Weight   int    `json:"weight"`
+	Revision int    `json:"revision,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// Webhook posts events to a set of URLs
+type Webhook struct {
+	URLs     []string
+	Template *template.Template
+	Retries  int
+	Client   *http.Client
+	// Wait between the attempts, time.Sleep if not set
+	sleepFunc func(duration time.Duration)
+}
+
+// NewWebhook creates a Webhook posting the events to the given URLs.
+// If a template file is given, it is used to generate the payload from the event, otherwise the event is sent as JSON.
+func NewWebhook(urls []string, templateFile string, retries int, timeout int) (*Webhook, error) {
+	w := &Webhook{
+		URLs:    urls,
+		Retries: retries,
+		Client:  &http.Client{Timeout: time.Duration(timeout) * time.Second},
+	}
+	if templateFile != "" {
+		data, err := os.ReadFile(templateFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading notification template \"%s\": %w", templateFile, err)
+		}
+		w.Template, err = template.New(templateFile).Funcs(template.FuncMap{"toJson": toJson}).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("parsing notification template \"%s\": %w", templateFile, err)
+		}
+	}
+	return w, nil
+}
+
+// Notify posts the event to all the URLs of the webhook, retrying in case of failure.
+// Errors of all the URLs are returned together.
+func (w *Webhook) Notify(event Event) error {
+	payload, err := w.payload(event)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, url := range w.URLs {
+		if err := w.post(url, payload); err != nil {
+			errs = append(errs, fmt.Errorf("posting \"%s\" event to \"%s\": %w", event.Type, url, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *Webhook) payload(event Event) ([]byte, error) {
+	if w.Template == nil {
+		return json.Marshal(event)
+	}
+	var buf bytes.Buffer
+	if err := w.Template.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("generating notification payload: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *Webhook) post(url string, payload []byte) error {
+	var err error
+	backoff := time.Second
+	for attempt := 0; attempt <= w.Retries; attempt++ {
+		if attempt > 0 {
+			w.sleep(backoff)
+			backoff = backoff * 2
+		}
+		var resp *http.Response
+		resp, err = w.Client.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return err
+}
+
+func (w *Webhook) sleep(duration time.Duration) {
+	if w.sleepFunc != nil {
+		w.sleepFunc(duration)
+		return
+	}
+	time.Sleep(duration)
+}
+
+func toJson(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
@@ -0,0 +1,205 @@
+package notify
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server recording the payloads posted to it, answering with the given statuses in order (200 once exhausted)
+type recorder struct {
+	mutex    sync.Mutex
+	statuses []int
+	payloads []string
+	types    []string
+}
+
+func newServer(t *testing.T, statuses ...int) (*httptest.Server, *recorder) {
+	t.Helper()
+	r := &recorder{statuses: statuses}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.payloads = append(r.payloads, string(body))
+		r.types = append(r.types, req.Header.Get("Content-Type"))
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, r
+}
+
+func TestNotifyPayloads(t *testing.T) {
+	timestamp := time.Date(2024, 5, 2, 10, 30, 0, 0, time.UTC)
+	weight := 1
+	releases := []Release{{Name: "backend", Weight: 1, Revision: 3, Status: "deployed", Duration: "12s"}}
+	tests := []struct {
+		event    Event
+		expected string
+	}{
+		{
+			event:    Event{Type: SprayStarted, Timestamp: timestamp, Chart: "umbrella", ChartDigest: "sha256:0123", Namespace: "default", Releases: []Release{{Name: "backend", Weight: 1, Status: "pending"}}},
+			expected: `{"type":"spray-started","timestamp":"2024-05-02T10:30:00Z","chart":"umbrella","chartDigest":"sha256:0123","namespace":"default","releases":[{"name":"backend","weight":1,"status":"pending"}]}`,
+		},
+		{
+			event:    Event{Type: WeightCompleted, Timestamp: timestamp, Cluster: "eu", Chart: "umbrella", Namespace: "default", Weight: &weight, Releases: releases},
+			expected: `{"type":"weight-completed","timestamp":"2024-05-02T10:30:00Z","cluster":"eu","chart":"umbrella","namespace":"default","weight":1,"releases":[{"name":"backend","weight":1,"revision":3,"status":"deployed","duration":"12s"}]}`,
+		},
+		{
+			event:    Event{Type: SprayFailed, Timestamp: timestamp, Chart: "umbrella", Namespace: "default", Releases: releases, Duration: "1m5s", Error: "release \"web\" not ready", Diagnostics: []string{"pod \"web-0\": CrashLoopBackOff"}, Warnings: []string{"API version removed"}},
+			expected: `{"type":"spray-failed","timestamp":"2024-05-02T10:30:00Z","chart":"umbrella","namespace":"default","releases":[{"name":"backend","weight":1,"revision":3,"status":"deployed","duration":"12s"}],"duration":"1m5s","error":"release \"web\" not ready","diagnostics":["pod \"web-0\": CrashLoopBackOff"],"warnings":["API version removed"]}`,
+		},
+		{
+			event:    Event{Type: SprayCompleted, Timestamp: timestamp, Chart: "umbrella", ChartSigner: "Jane <jane@example.com>", Namespace: "default", Releases: releases, Duration: "1m5s"},
+			expected: `{"type":"spray-completed","timestamp":"2024-05-02T10:30:00Z","chart":"umbrella","chartSigner":"Jane \u003cjane@example.com\u003e","namespace":"default","releases":[{"name":"backend","weight":1,"revision":3,"status":"deployed","duration":"12s"}],"duration":"1m5s"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.event.Type, func(t *testing.T) {
+			server1, recorder1 := newServer(t)
+			server2, recorder2 := newServer(t)
+			w, err := NewWebhook([]string{server1.URL, server2.URL}, "", 0, 10)
+			if err != nil {
+				t.Fatalf("creating webhook: %s", err)
+			}
+			if err := w.Notify(test.event); err != nil {
+				t.Fatalf("notifying: %s", err)
+			}
+			// The event is posted as JSON to each URL
+			for _, r := range []*recorder{recorder1, recorder2} {
+				if !reflect.DeepEqual(r.payloads, []string{test.expected}) {
+					t.Errorf("expected payload %s, got %v", test.expected, r.payloads)
+				}
+				if !reflect.DeepEqual(r.types, []string{"application/json"}) {
+					t.Errorf("expected content type application/json, got %v", r.types)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyTemplate(t *testing.T) {
+	templateFile := filepath.Join(t.TempDir(), "chat.tmpl")
+	template := `{"text": "spray of {{ .Chart }} in {{ .Namespace }}: {{ .Type }}{{ if .Error }} ({{ .Error }}){{ end }}", "releases": {{ toJson .Releases }}}`
+	if err := os.WriteFile(templateFile, []byte(template), 0644); err != nil {
+		t.Fatalf("writing template: %s", err)
+	}
+	server, r := newServer(t)
+	w, err := NewWebhook([]string{server.URL}, templateFile, 0, 10)
+	if err != nil {
+		t.Fatalf("creating webhook: %s", err)
+	}
+	event := Event{Type: SprayFailed, Chart: "umbrella", Namespace: "prod", Error: "timeout", Releases: []Release{{Name: "web", Weight: 2, Status: "failed"}}}
+	if err := w.Notify(event); err != nil {
+		t.Fatalf("notifying: %s", err)
+	}
+	expected := `{"text": "spray of umbrella in prod: spray-failed (timeout)", "releases": [{"name":"web","weight":2,"status":"failed"}]}`
+	if !reflect.DeepEqual(r.payloads, []string{expected}) {
+		t.Errorf("expected payload %s, got %v", expected, r.payloads)
+	}
+
+	// Invalid templates are reported when the webhook is created, templates failing on an event when it is notified
+	if err := os.WriteFile(templateFile, []byte(`{{ .Type `), 0644); err != nil {
+		t.Fatalf("writing template: %s", err)
+	}
+	if _, err := NewWebhook([]string{server.URL}, templateFile, 0, 10); err == nil || !strings.Contains(err.Error(), "parsing notification template") {
+		t.Errorf("expected a parsing error, got %v", err)
+	}
+	if err := os.WriteFile(templateFile, []byte(`{{ .Unknown }}`), 0644); err != nil {
+		t.Fatalf("writing template: %s", err)
+	}
+	w, err = NewWebhook([]string{server.URL}, templateFile, 0, 10)
+	if err != nil {
+		t.Fatalf("creating webhook: %s", err)
+	}
+	if err := w.Notify(event); err == nil || !strings.Contains(err.Error(), "generating notification payload") {
+		t.Errorf("expected a generation error, got %v", err)
+	}
+	if _, err := NewWebhook([]string{server.URL}, filepath.Join(t.TempDir(), "missing.tmpl"), 0, 10); err == nil {
+		t.Errorf("expected an error for a missing template")
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	tests := []struct {
+		name             string
+		statuses         []int
+		expectedAttempts int
+		expectedBackoffs []time.Duration
+		expectedError    string
+	}{
+		{
+			name:             "success after 5xx",
+			statuses:         []int{http.StatusServiceUnavailable, http.StatusBadGateway},
+			expectedAttempts: 3,
+			expectedBackoffs: []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:             "failure after all retries",
+			statuses:         []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			expectedAttempts: 4,
+			expectedBackoffs: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+			expectedError:    "unexpected HTTP status 500 Internal Server Error",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, r := newServer(t, test.statuses...)
+			w, err := NewWebhook([]string{server.URL}, "", 3, 10)
+			if err != nil {
+				t.Fatalf("creating webhook: %s", err)
+			}
+			backoffs := make([]time.Duration, 0)
+			w.sleepFunc = func(duration time.Duration) { backoffs = append(backoffs, duration) }
+			err = w.Notify(Event{Type: SprayStarted})
+			if test.expectedError == "" && err != nil {
+				t.Errorf("expected no error, got %s", err)
+			}
+			if test.expectedError != "" && (err == nil || !strings.Contains(err.Error(), test.expectedError) || !strings.Contains(err.Error(), server.URL)) {
+				t.Errorf("expected error containing %q and the URL, got %v", test.expectedError, err)
+			}
+			if len(r.payloads) != test.expectedAttempts {
+				t.Errorf("expected %d attempts, got %d", test.expectedAttempts, len(r.payloads))
+			}
+			if !reflect.DeepEqual(backoffs, test.expectedBackoffs) {
+				t.Errorf("expected backoffs %v, got %v", test.expectedBackoffs, backoffs)
+			}
+		})
+	}
+}
+
+func TestNotifyTimeout(t *testing.T) {
+	// The server answers once the client has given up
+	released := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-released
+	}))
+	defer server.Close()
+	defer close(released)
+	w, err := NewWebhook([]string{server.URL}, "", 0, 1)
+	if err != nil {
+		t.Fatalf("creating webhook: %s", err)
+	}
+	if w.Client.Timeout != time.Second {
+		t.Errorf("expected a timeout of 1s, got %s", w.Client.Timeout)
+	}
+	startTime := time.Now()
+	err = w.Notify(Event{Type: SprayStarted})
+	if err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+	if duration := time.Since(startTime); duration > 5*time.Second {
+		t.Errorf("notification not timed out after %s", duration)
+	}
+}
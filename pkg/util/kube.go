@@ -0,0 +1,83 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KubeConfig gathers the options selecting the Kubernetes cluster and the credentials used by helm and kubectl
+type KubeConfig struct {
+	Context    string
+	Kubeconfig string
+	APIServer  string
+	Token      string
+	AsUser     string
+}
+
+// HelmArgs returns the corresponding arguments of a helm command, except for the token (see HelmEnv)
+func (k KubeConfig) HelmArgs() []string {
+	return k.args("--kube-context", "--kubeconfig", "--kube-apiserver", "--kube-as-user")
+}
+
+// HelmEnv returns the environment of a helm command, holding the token: unlike the command line, the environment of a
+// process cannot be read by the other users of the machine
+func (k KubeConfig) HelmEnv() []string {
+	env := os.Environ()
+	if k.Token != "" {
+		env = append(env, "HELM_KUBETOKEN="+k.Token)
+	}
+	return env
+}
+
+// KubectlArgs returns the corresponding arguments of a kubectl command, except for the token, which kubectl only reads
+// from the command line or a kubeconfig
+func (k KubeConfig) KubectlArgs() []string {
+	return k.args("--context", "--kubeconfig", "--server", "--as")
+}
+
+func (k KubeConfig) args(contextFlag, kubeconfigFlag, apiServerFlag, asUserFlag string) []string {
+	args := make([]string, 0)
+	if k.Context != "" {
+		args = append(args, contextFlag, k.Context)
+	}
+	if k.Kubeconfig != "" {
+		args = append(args, kubeconfigFlag, k.Kubeconfig)
+	}
+	if k.APIServer != "" {
+		args = append(args, apiServerFlag, k.APIServer)
+	}
+	if k.AsUser != "" {
+		args = append(args, asUserFlag, k.AsUser)
+	}
+	return args
+}
+
+// String prevents the token from being displayed in logs
+func (k KubeConfig) String() string {
+	token := ""
+	if k.Token != "" {
+		token = redacted
+	}
+	return fmt.Sprintf("{Context:%s Kubeconfig:%s APIServer:%s Token:%s AsUser:%s}", k.Context, k.Kubeconfig, k.APIServer, token, k.AsUser)
+}
+
+const redacted = "<redacted>"
+
+var sensitiveFlags = []string{"--kube-token", "--token", "--password"}
+
+// RedactArgs returns a copy of the arguments of a command where the values of the sensitive flags are hidden
+func RedactArgs(args []string) []string {
+	out := make([]string, len(args))
+	copy(out, args)
+	for i := range out {
+		for _, flag := range sensitiveFlags {
+			if out[i] == flag && i+1 < len(out) {
+				out[i+1] = redacted
+			} else if strings.HasPrefix(out[i], flag+"=") {
+				out[i] = flag + "=" + redacted
+			}
+		}
+	}
+	return out
+}
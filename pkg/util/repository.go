@@ -0,0 +1,57 @@
+package util
+
+import (
+	"fmt"
+	"helm.sh/helm/v3/pkg/getter"
+	"os"
+	"strings"
+)
+
+// RepositoryConfig gathers the location, the credentials and the TLS options used for accessing the chart repositories,
+// the OCI registries and the remote values files
+type RepositoryConfig struct {
+	URL                   string
+	Username              string
+	Password              string
+	PasswordFile          string
+	CAFile                string
+	CertFile              string
+	KeyFile               string
+	InsecureSkipTLSVerify bool
+	PassCredentialsAll    bool
+}
+
+// ReadPasswordFile sets the password from the content of the password file, if any
+func (r *RepositoryConfig) ReadPasswordFile() error {
+	if r.PasswordFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(r.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("reading password file: %w", err)
+	}
+	r.Password = strings.TrimRight(string(data), "\r\n")
+	return nil
+}
+
+// GetterOptions returns the options of the getters downloading remote files. The credentials are only given to the
+// host of the given URL, unless they are passed to all the hosts.
+func (r RepositoryConfig) GetterOptions(url string) []getter.Option {
+	return []getter.Option{
+		getter.WithURL(url),
+		getter.WithBasicAuth(r.Username, r.Password),
+		getter.WithPassCredentialsAll(r.PassCredentialsAll),
+		getter.WithTLSClientConfig(r.CertFile, r.KeyFile, r.CAFile),
+		getter.WithInsecureSkipVerifyTLS(r.InsecureSkipTLSVerify),
+	}
+}
+
+// String prevents the password from being displayed in logs
+func (r RepositoryConfig) String() string {
+	password := ""
+	if r.Password != "" {
+		password = redacted
+	}
+	return fmt.Sprintf("{URL:%s Username:%s Password:%s PasswordFile:%s CAFile:%s CertFile:%s KeyFile:%s InsecureSkipTLSVerify:%t PassCredentialsAll:%t}",
+		r.URL, r.Username, password, r.PasswordFile, r.CAFile, r.CertFile, r.KeyFile, r.InsecureSkipTLSVerify, r.PassCredentialsAll)
+}
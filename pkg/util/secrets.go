@@ -0,0 +1,9 @@
+package util
+
+// SecretsKeys gathers the keys used to decrypt the encrypted values files
+type SecretsKeys struct {
+	// age identity file, transmitted to sops through the SOPS_AGE_KEY_FILE envvar
+	AgeIdentityFile string
+	// PGP keyring directory, transmitted to sops through the GNUPGHOME envvar
+	PGPKeyring string
+}